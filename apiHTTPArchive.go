@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//HTTPAPIServerStreamArchiveDirectory check access and get the channel snapshot archive directory
+func HTTPAPIServerStreamArchiveDirectory(c *gin.Context, requestLogger *logrus.Entry) (string, bool) {
+	opt, err := Storage.StreamChannelInfo(c.Param("uuid"), c.Param("channel"))
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelInfo",
+		}).Errorln(err.Error())
+		return "", false
+	}
+
+	if !RemoteAuthorization("Archive", c.Param("uuid"), c.Param("channel"), c.Query("token"), c.ClientIP()) {
+		c.IndentedJSON(401, Message{Status: 0, Payload: ErrorStreamUnauthorized.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RemoteAuthorization",
+		}).Errorln(ErrorStreamUnauthorized.Error())
+		return "", false
+	}
+	return ArchiveDirectory(opt.Archive, c.Param("uuid"), c.Param("channel")), true
+}
+
+//HTTPAPIServerStreamArchiveRange parse the start and end query times, required when set
+func HTTPAPIServerStreamArchiveRange(c *gin.Context, required bool) (time.Time, time.Time, bool) {
+	var window [2]time.Time
+	for i, name := range []string{"start", "end"} {
+		val := c.Query(name)
+		if val == "" && !required {
+			continue
+		}
+		at, err := parseRecordTime(val)
+		if err != nil {
+			c.IndentedJSON(400, Message{Status: 0, Payload: "invalid " + name + " time"})
+			return time.Time{}, time.Time{}, false
+		}
+		window[i] = at
+	}
+	return window[0], window[1], true
+}
+
+//HTTPAPIServerStreamArchive list archived snapshots of the channel
+func HTTPAPIServerStreamArchive(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_archive",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamArchive",
+	})
+
+	directory, ok := HTTPAPIServerStreamArchiveDirectory(c, requestLogger)
+	if !ok {
+		return
+	}
+	start, end, ok := HTTPAPIServerStreamArchiveRange(c, false)
+	if !ok {
+		return
+	}
+	images, err := ArchiveList(directory, start, end)
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "ArchiveList",
+		}).Errorln(err.Error())
+		return
+	}
+	c.IndentedJSON(200, Message{Status: 1, Payload: images})
+}
+
+//HTTPAPIServerStreamArchiveImage archived snapshot taken at or before the time query
+func HTTPAPIServerStreamArchiveImage(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_archive",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamArchiveImage",
+	})
+
+	directory, ok := HTTPAPIServerStreamArchiveDirectory(c, requestLogger)
+	if !ok {
+		return
+	}
+	at, err := parseRecordTime(c.Query("time"))
+	if err != nil {
+		c.IndentedJSON(400, Message{Status: 0, Payload: "invalid time"})
+		return
+	}
+	// the image of the previous day is found when the time is just after midnight
+	images, err := ArchiveList(directory, at.Add(-24*time.Hour), at)
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "ArchiveList",
+		}).Errorln(err.Error())
+		return
+	}
+	if len(images) == 0 {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorArchiveNotFound.Error()})
+		return
+	}
+	image := images[len(images)-1]
+	c.Header("Cache-Control", "max-age=86400")
+	c.File(filepath.Join(directory, image.File))
+}
+
+//HTTPAPIServerStreamArchiveExport download archived snapshots of [start,end] as a MJPEG AVI or GIF timelapse
+func HTTPAPIServerStreamArchiveExport(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_archive",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamArchiveExport",
+	})
+
+	directory, ok := HTTPAPIServerStreamArchiveDirectory(c, requestLogger)
+	if !ok {
+		return
+	}
+	start, end, ok := HTTPAPIServerStreamArchiveRange(c, true)
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", "avi")
+	if format != "avi" && format != "gif" {
+		c.IndentedJSON(400, Message{Status: 0, Payload: "invalid format, expected avi or gif"})
+		return
+	}
+	fps, width := timelapseDefaultFPS, 0
+	for _, name := range []string{"fps", "width"} {
+		val := c.Query(name)
+		if val == "" {
+			continue
+		}
+		number, err := strconv.Atoi(val)
+		if err != nil || number <= 0 || (name == "fps" && number > timelapseMaxFPS) || (name == "width" && number > snapshotMaxDimension) {
+			c.IndentedJSON(400, Message{Status: 0, Payload: "invalid " + name})
+			return
+		}
+		if name == "fps" {
+			fps = number
+		} else {
+			width = number
+		}
+	}
+
+	images, err := ArchiveList(directory, start, end)
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "ArchiveList",
+		}).Errorln(err.Error())
+		return
+	}
+	if len(images) == 0 {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorArchiveNotFound.Error()})
+		return
+	}
+
+	// the AVI headers are patched once all frames are written, so the file is built in a temporary file
+	file, err := os.CreateTemp("", "timelapse-*."+format)
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "CreateTemp",
+		}).Errorln(err.Error())
+		return
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+	if format == "gif" {
+		err = ArchiveWriteGIF(file, directory, images, fps, width)
+	} else {
+		err = ArchiveWriteAVI(file, directory, images, fps, width)
+	}
+	if errors.Is(err, ErrorArchiveNotFound) {
+		c.IndentedJSON(404, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "ArchiveWrite",
+		}).Errorln(err.Error())
+		return
+	}
+	c.FileAttachment(file.Name(), c.Param("uuid")+"_"+c.Param("channel")+"_"+start.UTC().Format("20060102T150405Z")+"."+format)
+}
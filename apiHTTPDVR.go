@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//HTTPAPIServerStreamDVRWindow get channel DVR buffer and the before/after query window in seconds
+func HTTPAPIServerStreamDVRWindow(c *gin.Context, requestLogger *logrus.Entry) (*ChannelST, time.Duration, time.Duration, bool) {
+	opt, err := Storage.StreamChannelControl(c.Param("uuid"), c.Param("channel"))
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelControl",
+		}).Errorln(err.Error())
+		return nil, 0, 0, false
+	}
+	if opt.dvr == nil {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorDVRDisabled.Error()})
+		return nil, 0, 0, false
+	}
+	var window [2]time.Duration
+	for i, name := range []string{"before", "after"} {
+		val := c.Query(name)
+		if val == "" {
+			continue
+		}
+		seconds, err := strconv.Atoi(val)
+		if err != nil || seconds < 0 {
+			c.IndentedJSON(400, Message{Status: 0, Payload: "invalid " + name + " seconds"})
+			return nil, 0, 0, false
+		}
+		window[i] = time.Duration(seconds) * time.Second
+	}
+	before, after := window[0], window[1]
+	if before == 0 && after == 0 {
+		before = opt.dvr.Duration()
+	}
+	// the start of the clip must still be buffered once the after part is recorded
+	if before+after > opt.dvr.Duration() {
+		c.IndentedJSON(400, Message{Status: 0, Payload: ErrorDVRNotBuffered.Error()})
+		return nil, 0, 0, false
+	}
+	return opt, before, after, true
+}
+
+//HTTPAPIServerStreamDVRExport download the DVR buffer of [now-before,now+after] as MP4
+func HTTPAPIServerStreamDVRExport(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_dvr",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamDVRExport",
+	})
+
+	if !RemoteAuthorization("DVR", c.Param("uuid"), c.Param("channel"), c.Query("token"), c.ClientIP()) {
+		c.IndentedJSON(401, Message{Status: 0, Payload: ErrorStreamUnauthorized.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RemoteAuthorization",
+		}).Errorln(ErrorStreamUnauthorized.Error())
+		return
+	}
+	opt, before, after, ok := HTTPAPIServerStreamDVRWindow(c, requestLogger)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if after > 0 {
+		wait := time.NewTimer(after)
+		defer wait.Stop()
+		select {
+		case <-wait.C:
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+	codecs, packets, err := opt.dvr.Clip(now.Add(-before), now.Add(after))
+	if err != nil {
+		c.IndentedJSON(404, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+
+	file, err := os.CreateTemp("", "dvr-*.mp4")
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "CreateTemp",
+		}).Errorln(err.Error())
+		return
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	if err = DVRWriteMP4(file.Name(), codecs, packets); err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "DVRWriteMP4",
+		}).Errorln(err.Error())
+		return
+	}
+	c.FileAttachment(file.Name(), c.Param("uuid")+"_"+c.Param("channel")+"_"+now.Add(-before).UTC().Format("20060102T150405Z")+".mp4")
+}
+
+//HTTPAPIServerStreamDVRCapture save the DVR buffer of [now-before,now+after] to the capture directory
+func HTTPAPIServerStreamDVRCapture(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_dvr",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamDVRCapture",
+	})
+
+	opt, before, after, ok := HTTPAPIServerStreamDVRWindow(c, requestLogger)
+	if !ok {
+		return
+	}
+	if opt.DVR.CaptureDirectory == "" {
+		c.IndentedJSON(400, Message{Status: 0, Payload: "stream channel dvr capture directory not set"})
+		return
+	}
+
+	now := time.Now()
+	path := filepath.Join(opt.DVR.CaptureDirectory, filepath.Base(c.Param("uuid")), filepath.Base(c.Param("channel")), now.UTC().Format("20060102T150405.000Z")+".mp4")
+	go StreamDVRCapture(c.Param("uuid"), c.Param("channel"), path, now.Add(-before), now.Add(after))
+	c.IndentedJSON(200, Message{Status: 1, Payload: path})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//HTTP API auth schemes
+const (
+	httpAuthBasic  = "basic"
+	httpAuthDigest = "digest"
+	httpAuthRealm  = "RTSPtoWeb"
+)
+
+//httpDigestAuth server side digest auth of the private routes, nil with Basic auth
+var httpDigestAuth *DigestAuthServer
+
+//validateHTTPAuth check the HTTP auth options of the server config
+func validateHTTPAuth(server ServerST) error {
+	switch server.HTTPAuth {
+	case "", httpAuthBasic:
+		return nil
+	case httpAuthDigest:
+		return validateDigestAuthServerAlgorithms(server.HTTPDigestAlgos)
+	}
+	return fmt.Errorf("unknown http_auth: %v (available: %v, %v)", server.HTTPAuth, httpAuthBasic, httpAuthDigest)
+}
+
+//HTTPAPIServerAuth middleware protecting the private routes with the server login and password
+func HTTPAPIServerAuth() (gin.HandlerFunc, error) {
+	if Storage.ServerHTTPAuth() != httpAuthDigest {
+		return gin.BasicAuth(gin.Accounts{Storage.ServerHTTPLogin(): Storage.ServerHTTPPassword()}), nil
+	}
+	server, err := NewDigestAuthServer(
+		httpAuthRealm,
+		Storage.ServerHTTPLogin(),
+		Storage.ServerHTTPPassword(),
+		Storage.ServerHTTPDigestAlgorithms(),
+		Storage.ServerHTTPDigestNonceTimeout(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	httpDigestAuth = server
+	return HTTPAPIServerDigestAuth(server), nil
+}
+
+//HTTPAPIServerDigestAuth middleware answering requests without valid digest credentials with a challenge
+func HTTPAPIServerDigestAuth(server *DigestAuthServer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info, err := server.Authenticate(c.Request)
+		if err == nil {
+			if info != "" {
+				c.Header("Authentication-Info", info)
+			}
+			c.Set(gin.AuthUserKey, server.username)
+			c.Next()
+			return
+		}
+		if c.GetHeader("Authorization") != "" {
+			log.WithFields(logrus.Fields{
+				"module": "http_server",
+				"func":   "HTTPAPIServerDigestAuth",
+				"call":   "Authenticate",
+			}).Debugln(c.ClientIP(), err.Error())
+		}
+		if err = server.Challenge(c.Writer.Header(), errors.Is(err, ErrDigestAuthStaleNonce)); err != nil {
+			c.AbortWithStatusJSON(500, Message{Status: 0, Payload: err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(401, Message{Status: 0, Payload: ErrDigestAuthUnauthorized.Error()})
+	}
+}
+
+//HTTPAPIServerDigestAuthCache list cached digest auth states and their reuse statistics
+func HTTPAPIServerDigestAuthCache(c *gin.Context) {
+	entries := make(map[string][]DigestAuthCacheEntryST)
+	for name, cache := range Storage.DigestAuthCaches() {
+		entries[name] = cache.Entries()
+	}
+	c.IndentedJSON(200, Message{Status: 1, Payload: entries})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//HTTPAPIServerEvents list recent events, optionally of one stream channel
+func HTTPAPIServerEvents(c *gin.Context) {
+	c.IndentedJSON(200, Message{Status: 1, Payload: Storage.EventList(c.Query("stream"), c.Query("channel"))})
+}
+
+//HTTPAPIServerEventSnapshot snapshot attached to the event
+func HTTPAPIServerEventSnapshot(c *gin.Context) {
+	event, err := Storage.EventGet(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(404, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+	if len(event.Snapshot) == 0 {
+		c.IndentedJSON(404, Message{Status: 0, Payload: "event has no snapshot"})
+		return
+	}
+	c.Data(200, event.ContentType, event.Snapshot)
+}
+
+//HTTPAPIServerEventsSSE stream new events as server-sent events
+func HTTPAPIServerEventsSSE(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module": "http_events",
+		"func":   "HTTPAPIServerEventsSSE",
+	})
+	subscriber := Storage.EventSubscribe()
+	defer Storage.EventUnsubscribe(subscriber)
+	requestLogger.WithFields(logrus.Fields{
+		"call": "EventSubscribe",
+	}).Debugln("Client connected")
+	c.Header("Cache-Control", "no-cache")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-subscriber:
+			// snapshots are fetched from the event snapshot endpoint
+			event.Snapshot = nil
+			c.SSEvent(event.Type, event)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+	requestLogger.WithFields(logrus.Fields{
+		"call": "Stream",
+	}).Debugln("Client disconnected")
+}
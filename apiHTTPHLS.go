@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//HTTPAPIServerStreamHLSMuxer check access and get the channel HLS muxer, or the playback session one
+func HTTPAPIServerStreamHLSMuxer(c *gin.Context, requestLogger *logrus.Entry) (*MuxerHLS, bool) {
+	if c.Param("session") != "" {
+		session, ok := HTTPAPIServerStreamPlaybackGet(c, requestLogger)
+		if !ok || session.HLS() == nil {
+			if ok {
+				c.IndentedJSON(404, Message{Status: 0, Payload: ErrorPlaybackNotFound.Error()})
+			}
+			return nil, false
+		}
+		session.HLS().Touch()
+		return session.HLS(), true
+	}
+
+	if !Storage.StreamChannelExist(c.Param("uuid"), c.Param("channel")) {
+		c.IndentedJSON(500, Message{Status: 0, Payload: ErrorStreamNotFound.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelExist",
+		}).Errorln(ErrorStreamNotFound.Error())
+		return nil, false
+	}
+
+	if !RemoteAuthorization("HLS", c.Param("uuid"), c.Param("channel"), c.Query("token"), c.ClientIP()) {
+		c.IndentedJSON(401, Message{Status: 0, Payload: ErrorStreamUnauthorized.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RemoteAuthorization",
+		}).Errorln(ErrorStreamUnauthorized.Error())
+		return nil, false
+	}
+
+	muxer, err := Storage.StreamChannelHLSMuxer(c.Param("uuid"), c.Param("channel"))
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelHLSMuxer",
+		}).Errorln(err.Error())
+		return nil, false
+	}
+	return muxer, true
+}
+
+//HTTPAPIServerStreamHLSM3U8 send client m3u8 play list
+func HTTPAPIServerStreamHLSM3U8(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_hls",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamHLSM3U8",
+	})
+
+	muxer, ok := HTTPAPIServerStreamHLSMuxer(c, requestLogger)
+	if !ok {
+		return
+	}
+
+	// blocking playlist reload, see RFC 8216bis section 6.2.5.2
+	msn, part := -1, -1
+	if val := c.Query("_HLS_msn"); val != "" {
+		msn = stringToInt(val)
+		if val := c.Query("_HLS_part"); val != "" {
+			part = stringToInt(val)
+		}
+		if muxer.TooFarAhead(msn) {
+			c.IndentedJSON(400, Message{Status: 0, Payload: ErrorStreamNotHLSSegments.Error()})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c, 20*time.Second)
+	defer cancel()
+	if err := muxer.Wait(ctx, msn, part); err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Wait",
+		}).Errorln(err.Error())
+		return
+	}
+
+	query := ""
+	if token := c.Query("token"); token != "" {
+		query = url.Values{"token": []string{token}}.Encode()
+	}
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	_, err := c.Writer.Write([]byte(muxer.Playlist(query)))
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Write",
+		}).Errorln(err.Error())
+	}
+}
+
+//HTTPAPIServerStreamHLSInit send client fMP4 initialization section
+func HTTPAPIServerStreamHLSInit(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_hls",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamHLSInit",
+	})
+
+	muxer, ok := HTTPAPIServerStreamHLSMuxer(c, requestLogger)
+	if !ok {
+		return
+	}
+
+	if muxer.Init() == nil {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorStreamNotHLSSegments.Error()})
+		return
+	}
+	c.Data(200, "video/mp4", muxer.Init())
+}
+
+//HTTPAPIServerStreamHLSSegment send client complete media segment
+func HTTPAPIServerStreamHLSSegment(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_hls",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamHLSSegment",
+	})
+
+	muxer, ok := HTTPAPIServerStreamHLSMuxer(c, requestLogger)
+	if !ok {
+		return
+	}
+
+	name, ext, found := strings.Cut(c.Param("segment"), ".")
+	msn, err := strconv.Atoi(name)
+	if !found || err != nil || ext != muxer.SegmentExt() {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorStreamNotHLSSegments.Error()})
+		return
+	}
+
+	data, ok := muxer.Segment(msn)
+	if !ok {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorStreamNotHLSSegments.Error()})
+		return
+	}
+	if ext == "ts" {
+		c.Data(200, "video/mp2t", data)
+	} else {
+		c.Data(200, "video/iso.segment", data)
+	}
+}
+
+//HTTPAPIServerStreamHLSPart send client LL-HLS partial segment, blocking on preload hints
+func HTTPAPIServerStreamHLSPart(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_hls",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamHLSPart",
+	})
+
+	muxer, ok := HTTPAPIServerStreamHLSMuxer(c, requestLogger)
+	if !ok {
+		return
+	}
+
+	// part name is <msn>.<index>.m4s
+	pieces := strings.Split(c.Param("part"), ".")
+	if len(pieces) != 3 || pieces[2] != "m4s" {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorStreamNotHLSSegments.Error()})
+		return
+	}
+	msn, errMSN := strconv.Atoi(pieces[0])
+	index, errIndex := strconv.Atoi(pieces[1])
+	if errMSN != nil || errIndex != nil || muxer.TooFarAhead(msn) {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorStreamNotHLSSegments.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c, 20*time.Second)
+	defer cancel()
+	if err := muxer.Wait(ctx, msn, index); err != nil {
+		c.IndentedJSON(404, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+
+	data, ok := muxer.Part(msn, index)
+	if !ok {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorStreamNotHLSSegments.Error()})
+		return
+	}
+	c.Data(200, "video/iso.segment", data)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//mjpegBoundary multipart boundary of the MJPEG responses
+const mjpegBoundary = "mjpegframe"
+
+//HTTPAPIServerStreamMJPEG stream channel snapshots as multipart/x-mixed-replace MJPEG
+func HTTPAPIServerStreamMJPEG(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_mjpeg",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamMJPEG",
+	})
+
+	opt, err := Storage.StreamChannelInfo(c.Param("uuid"), c.Param("channel"))
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: ErrorStreamNotFound.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelInfo",
+		}).Errorln(err.Error())
+		return
+	}
+
+	if !RemoteAuthorization("MJPEG", c.Param("uuid"), c.Param("channel"), c.Query("token"), c.ClientIP()) {
+		c.IndentedJSON(401, Message{Status: 0, Payload: ErrorStreamUnauthorized.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RemoteAuthorization",
+		}).Errorln(ErrorStreamUnauthorized.Error())
+		return
+	}
+
+	// frames are the channel snapshots, there is no MJPEG without snapshot url
+	if opt.mjpeg == nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: ErrorStreamChannelSnapshotDisabled.Error()})
+		return
+	}
+
+	viewer, err := opt.mjpeg.Join(c.Param("uuid"), c.Param("channel"), opt.MaxViewers)
+	if err != nil {
+		c.IndentedJSON(503, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Join",
+		}).Errorln(err.Error())
+		return
+	}
+	defer opt.mjpeg.Leave(viewer)
+	requestLogger.WithFields(logrus.Fields{
+		"call": "Join",
+	}).Debugln("Viewer connected")
+
+	c.Header("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	c.Header("Cache-Control", "no-cache")
+	c.Status(200)
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			requestLogger.WithFields(logrus.Fields{
+				"call": "Done",
+			}).Debugln("Viewer disconnected")
+			return
+		case frame, ok := <-viewer:
+			if !ok {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "Leave",
+				}).Debugln("Stream channel removed")
+				return
+			}
+			contentType := frame.ContentType
+			if contentType == "" {
+				contentType = "image/jpeg"
+			}
+			_, err = fmt.Fprintf(c.Writer, "--%v\r\nContent-Type: %v\r\nContent-Length: %v\r\n\r\n", mjpegBoundary, contentType, len(frame.Body))
+			if err == nil {
+				_, err = c.Writer.Write(frame.Body)
+			}
+			if err == nil {
+				_, err = c.Writer.WriteString("\r\n")
+			}
+			if err != nil {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "Write",
+				}).Debugln(err.Error())
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4f"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+//HTTPAPIServerStreamMSE stream video over WebSocket as fragmented MP4 for Media Source Extensions
+func HTTPAPIServerStreamMSE(c *gin.Context) {
+	server := websocket.Server{
+		// token authorization is checked explicitly, any origin is allowed like for WebRTC
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			HTTPAPIServerStreamMSEWS(c, ws)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+//HTTPAPIServerStreamMSEWS serve upgraded MSE WebSocket connection
+func HTTPAPIServerStreamMSEWS(c *gin.Context, ws *websocket.Conn) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_mse",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamMSE",
+	})
+
+	defer func() {
+		err := ws.Close()
+		if err != nil {
+			requestLogger.WithFields(logrus.Fields{
+				"call": "Close",
+			}).Errorln(err.Error())
+		}
+	}()
+
+	if !Storage.StreamChannelExist(c.Param("uuid"), c.Param("channel")) {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelExist",
+		}).Errorln(ErrorStreamNotFound.Error())
+		return
+	}
+
+	if !RemoteAuthorization("WS", c.Param("uuid"), c.Param("channel"), c.Query("token"), c.ClientIP()) {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RemoteAuthorization",
+		}).Errorln(ErrorStreamUnauthorized.Error())
+		return
+	}
+
+	Storage.StreamChannelRun(c.Param("uuid"), c.Param("channel"))
+	err := ws.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "SetWriteDeadline",
+		}).Errorln(err.Error())
+		return
+	}
+	cid, ch, _, signals, err := Storage.ClientAdd(c.Param("uuid"), c.Param("channel"), MSE)
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "ClientAdd",
+		}).Errorln(err.Error())
+		return
+	}
+	defer Storage.ClientDelete(c.Param("uuid"), cid, c.Param("channel"))
+	codecs, err := Storage.StreamChannelCodecs(c.Param("uuid"), c.Param("channel"))
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamCodecs",
+		}).Errorln(err.Error())
+		return
+	}
+
+	// mp4f only supports H264, H265 and AAC tracks, drop the others and remap packet indexes
+	var tracks []av.CodecData
+	indexes := make(map[int8]int8)
+	for i, codec := range codecs {
+		switch codec.Type() {
+		case av.H264, av.H265, av.AAC:
+			indexes[int8(i)] = int8(len(tracks))
+			tracks = append(tracks, codec)
+		}
+	}
+	if len(tracks) == 0 {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamCodecs",
+		}).Errorln(ErrorStreamChannelCodecNotFound.Error())
+		return
+	}
+
+	muxerMSE := mp4f.NewMuxer(nil)
+	err = muxerMSE.WriteHeader(tracks)
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "WriteHeader",
+		}).Errorln(err.Error())
+		return
+	}
+	meta, init := muxerMSE.GetInit(tracks)
+	// the codec string is prefixed with 9 to tell it apart from media segments
+	err = websocket.Message.Send(ws, append([]byte{9}, meta...))
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Send",
+		}).Errorln(err.Error())
+		return
+	}
+	err = websocket.Message.Send(ws, init)
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Send",
+		}).Errorln(err.Error())
+		return
+	}
+
+	// fragment=gop sends a single moof/mdat per GOP, default is one per frame
+	perGOP := c.Query("fragment") == "gop"
+	lastTime := make(map[int8]time.Duration)
+	var videoStart bool
+	controlExit := make(chan bool, 10)
+	go func() {
+		defer func() {
+			controlExit <- true
+		}()
+		for {
+			var message string
+			err := websocket.Message.Receive(ws, &message)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	noVideo := time.NewTimer(10 * time.Second)
+	for {
+		select {
+		case <-controlExit:
+			requestLogger.WithFields(logrus.Fields{
+				"call": "controlExit",
+			}).Infoln("Client disconnected")
+			return
+		case <-noVideo.C:
+			requestLogger.WithFields(logrus.Fields{
+				"call": "ErrorStreamNoVideo",
+			}).Errorln(ErrorStreamNoVideo.Error())
+			return
+		case signal := <-signals:
+			// sent when the viewer is too slow to keep up with the stream, or the stream stops
+			if signal == SignalStreamStop {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "signals",
+				}).Infoln("Client stopped")
+				return
+			}
+		case pck := <-ch:
+			idx, ok := indexes[pck.Idx]
+			if !ok {
+				continue
+			}
+			if pck.IsKeyFrame {
+				noVideo.Reset(10 * time.Second)
+				videoStart = true
+			}
+			if !videoStart {
+				continue
+			}
+			pkt := *pck
+			pkt.Idx = idx
+			var ready bool
+			var buf []byte
+			if perGOP {
+				ready, buf, err = muxerMSE.WritePacket(pkt, true)
+			} else {
+				var duration time.Duration
+				if last, ok := lastTime[idx]; ok {
+					duration = pkt.Time - last
+				}
+				lastTime[idx] = pkt.Time
+				ready, buf, err = muxerMSE.WritePacketPrepush(pkt, duration, false)
+			}
+			if err != nil {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "WritePacket",
+				}).Errorln(err.Error())
+				return
+			}
+			if ready {
+				err = ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if err != nil {
+					requestLogger.WithFields(logrus.Fields{
+						"call": "SetWriteDeadline",
+					}).Errorln(err.Error())
+					return
+				}
+				err = websocket.Message.Send(ws, buf)
+				if err != nil {
+					requestLogger.WithFields(logrus.Fields{
+						"call": "Send",
+					}).Errorln(err.Error())
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//HTTPAPIServerMosaic compose a named layout, or the channels query list, into one JPEG
+func HTTPAPIServerMosaic(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module": "http_mosaic",
+		"layout": c.Param("layout"),
+		"func":   "HTTPAPIServerMosaic",
+	})
+
+	var cfg MosaicST
+	if c.Param("layout") != "" {
+		layout, ok := Storage.ServerMosaic(c.Param("layout"))
+		if !ok {
+			c.IndentedJSON(404, Message{Status: 0, Payload: "mosaic layout not found"})
+			return
+		}
+		cfg = layout
+	}
+	if val := c.Query("channels"); val != "" {
+		cfg.Channels = strings.Split(val, ",")
+	}
+	quality := snapshotDefaultQuality
+	for _, name := range []string{"columns", "width", "height", "quality"} {
+		val := c.Query(name)
+		if val == "" {
+			continue
+		}
+		number, err := strconv.Atoi(val)
+		if err != nil || number <= 0 {
+			c.IndentedJSON(400, Message{Status: 0, Payload: "invalid " + name})
+			return
+		}
+		switch name {
+		case "columns":
+			cfg.Columns = number
+		case "width":
+			cfg.Width = number
+		case "height":
+			cfg.Height = number
+		case "quality":
+			quality = number
+		}
+	}
+	if quality > 100 {
+		c.IndentedJSON(400, Message{Status: 0, Payload: "invalid quality"})
+		return
+	}
+
+	mosaic, err := StreamMosaic(c.Request.Context(), cfg)
+	if err != nil {
+		var transformErr snapshotTransformError
+		if errors.As(err, &transformErr) {
+			c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+			return
+		}
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamMosaic",
+		}).Errorln(err.Error())
+		return
+	}
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, mosaic, &jpeg.Options{Quality: quality}); err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Encode",
+		}).Errorln(err.Error())
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(200, "image/jpeg", buf.Bytes())
+}
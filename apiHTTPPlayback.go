@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//HTTPAPIServerStreamPlaybackSession check access and open channel recordings at the start query time
+func HTTPAPIServerStreamPlaybackSession(c *gin.Context, requestLogger *logrus.Entry) (*PlaybackSession, bool) {
+	if !Storage.StreamChannelExist(c.Param("uuid"), c.Param("channel")) {
+		c.IndentedJSON(500, Message{Status: 0, Payload: ErrorStreamNotFound.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelExist",
+		}).Errorln(ErrorStreamNotFound.Error())
+		return nil, false
+	}
+
+	if !RemoteAuthorization("Playback", c.Param("uuid"), c.Param("channel"), c.Query("token"), c.ClientIP()) {
+		c.IndentedJSON(401, Message{Status: 0, Payload: ErrorStreamUnauthorized.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RemoteAuthorization",
+		}).Errorln(ErrorStreamUnauthorized.Error())
+		return nil, false
+	}
+
+	start, err := parseRecordTime(c.Query("start"))
+	if err != nil {
+		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+		return nil, false
+	}
+	session, err := NewPlaybackSession(c.Param("uuid"), c.Param("channel"), start)
+	if err != nil {
+		status := 500
+		if errors.Is(err, ErrorRecordNotFound) {
+			status = 404
+		}
+		c.IndentedJSON(status, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "NewPlaybackSession",
+		}).Errorln(err.Error())
+		return nil, false
+	}
+	return session, true
+}
+
+//HTTPAPIServerStreamPlaybackWebRTC play back recordings over WebRTC
+func HTTPAPIServerStreamPlaybackWebRTC(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_playback",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamPlaybackWebRTC",
+	})
+
+	session, ok := HTTPAPIServerStreamPlaybackSession(c, requestLogger)
+	if !ok {
+		return
+	}
+	answer, err := session.StartWebRTC(c.PostForm("data"))
+	if err != nil {
+		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StartWebRTC",
+		}).Errorln(err.Error())
+		return
+	}
+	// the answer body is kept identical to the live endpoint, the session is returned in a header
+	c.Header("X-Playback-Session", session.ID())
+	_, err = c.Writer.Write([]byte(answer))
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Write",
+		}).Errorln(err.Error())
+	}
+}
+
+//HTTPAPIServerStreamPlaybackHLS start HLS playback of recordings and redirect to its playlist
+func HTTPAPIServerStreamPlaybackHLS(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_playback",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamPlaybackHLS",
+	})
+
+	opt, err := Storage.StreamChannelControl(c.Param("uuid"), c.Param("channel"))
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelControl",
+		}).Errorln(err.Error())
+		return
+	}
+	session, ok := HTTPAPIServerStreamPlaybackSession(c, requestLogger)
+	if !ok {
+		return
+	}
+	if err = session.StartHLS(opt.HLS); err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StartHLS",
+		}).Errorln(err.Error())
+		return
+	}
+	location := session.ID() + "/hls/index.m3u8"
+	if token := c.Query("token"); token != "" {
+		location += "?" + url.Values{"token": []string{token}}.Encode()
+	}
+	c.Header("X-Playback-Session", session.ID())
+	c.Redirect(302, location)
+}
+
+//HTTPAPIServerStreamPlaybackGet get playback session of the request
+func HTTPAPIServerStreamPlaybackGet(c *gin.Context, requestLogger *logrus.Entry) (*PlaybackSession, bool) {
+	if !RemoteAuthorization("Playback", c.Param("uuid"), c.Param("channel"), c.Query("token"), c.ClientIP()) {
+		c.IndentedJSON(401, Message{Status: 0, Payload: ErrorStreamUnauthorized.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RemoteAuthorization",
+		}).Errorln(ErrorStreamUnauthorized.Error())
+		return nil, false
+	}
+	session, err := Storage.PlaybackGet(c.Param("uuid"), c.Param("channel"), c.Param("session"))
+	if err != nil {
+		c.IndentedJSON(404, Message{Status: 0, Payload: err.Error()})
+		return nil, false
+	}
+	return session, true
+}
+
+//HTTPAPIServerStreamPlaybackStatus get playback session status
+func HTTPAPIServerStreamPlaybackStatus(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_playback",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamPlaybackStatus",
+	})
+
+	session, ok := HTTPAPIServerStreamPlaybackGet(c, requestLogger)
+	if !ok {
+		return
+	}
+	c.IndentedJSON(200, Message{Status: 1, Payload: session.Status()})
+}
+
+//HTTPAPIServerStreamPlaybackControl pause, resume or seek playback session
+func HTTPAPIServerStreamPlaybackControl(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_playback",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamPlaybackControl",
+	})
+
+	session, ok := HTTPAPIServerStreamPlaybackGet(c, requestLogger)
+	if !ok {
+		return
+	}
+	var action int
+	var seek time.Time
+	var err error
+	switch c.Param("action") {
+	case "pause":
+		action = PlaybackPause
+	case "resume":
+		action = PlaybackResume
+	case "seek":
+		action = PlaybackSeek
+		if seek, err = parseRecordTime(c.Query("time")); err != nil {
+			c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+			return
+		}
+	default:
+		c.IndentedJSON(404, Message{Status: 0, Payload: "unknown playback action"})
+		return
+	}
+	if err = session.Control(action, seek); err != nil {
+		status := 500
+		if errors.Is(err, ErrorRecordNotFound) || errors.Is(err, ErrorPlaybackNotFound) {
+			status = 404
+		}
+		c.IndentedJSON(status, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Control",
+		}).Errorln(err.Error())
+		return
+	}
+	c.IndentedJSON(200, Message{Status: 1, Payload: session.Status()})
+}
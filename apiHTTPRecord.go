@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//parseRecordTime parse RFC 3339 time or unix timestamp in seconds
+func parseRecordTime(val string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, val)
+}
+
+//mp4Tracks select tracks supported by the mp4 muxer, H264, H265 and AAC, and map packet indexes to them
+func mp4Tracks(codecs []av.CodecData) ([]av.CodecData, map[int8]int8) {
+	var tracks []av.CodecData
+	indexes := make(map[int8]int8)
+	for i, codec := range codecs {
+		switch codec.Type() {
+		case av.H264, av.H265, av.AAC:
+			indexes[int8(i)] = int8(len(tracks))
+			tracks = append(tracks, codec)
+		}
+	}
+	return tracks, indexes
+}
+
+//recordExportFile temporary file of an exported clip, writes fail once the limit is reached
+type recordExportFile struct {
+	*os.File
+	limit   int64
+	written int64
+}
+
+//Write count the bytes written, rewrites of the muxer included, so a clip never fills the disk
+func (file *recordExportFile) Write(p []byte) (int, error) {
+	if file.written+int64(len(p)) > file.limit {
+		return 0, ErrorRecordExportTooLarge
+	}
+	n, err := file.File.Write(p)
+	file.written += int64(n)
+	return n, err
+}
+
+//HTTPAPIServerStreamRecordDirectory check access and get the channel record settings and recordings directory
+func HTTPAPIServerStreamRecordDirectory(c *gin.Context, requestLogger *logrus.Entry) (RecordST, string, bool) {
+	opt, err := Storage.StreamChannelControl(c.Param("uuid"), c.Param("channel"))
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelControl",
+		}).Errorln(err.Error())
+		return RecordST{}, "", false
+	}
+
+	if !RemoteAuthorization("Playback", c.Param("uuid"), c.Param("channel"), c.Query("token"), c.ClientIP()) {
+		c.IndentedJSON(401, Message{Status: 0, Payload: ErrorStreamUnauthorized.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RemoteAuthorization",
+		}).Errorln(ErrorStreamUnauthorized.Error())
+		return RecordST{}, "", false
+	}
+	return opt.Record, RecordDirectory(opt.Record, c.Param("uuid"), c.Param("channel")), true
+}
+
+//HTTPAPIServerStreamRecordRanges list channel recorded time ranges
+func HTTPAPIServerStreamRecordRanges(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_record",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamRecordRanges",
+	})
+
+	_, directory, ok := HTTPAPIServerStreamRecordDirectory(c, requestLogger)
+	if !ok {
+		return
+	}
+
+	var start, end time.Time
+	var err error
+	if val := c.Query("start"); val != "" {
+		if start, err = parseRecordTime(val); err != nil {
+			c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+			return
+		}
+	}
+	if val := c.Query("end"); val != "" {
+		if end, err = parseRecordTime(val); err != nil {
+			c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+			return
+		}
+	}
+
+	segments, err := RecordIndexLoad(directory)
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RecordIndexLoad",
+		}).Errorln(err.Error())
+		return
+	}
+	c.IndentedJSON(200, Message{Status: 1, Payload: RecordRanges(segments, start, end)})
+}
+
+//HTTPAPIServerStreamRecordExport download recordings of [start,end] stitched into a single MP4
+func HTTPAPIServerStreamRecordExport(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_record",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamRecordExport",
+	})
+
+	cfg, directory, ok := HTTPAPIServerStreamRecordDirectory(c, requestLogger)
+	if !ok {
+		return
+	}
+
+	start, err := parseRecordTime(c.Query("start"))
+	if err != nil {
+		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+	end, err := parseRecordTime(c.Query("end"))
+	if err != nil {
+		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+	if !end.After(start) {
+		c.IndentedJSON(400, Message{Status: 0, Payload: ErrorRecordNotFound.Error()})
+		return
+	}
+	maxDuration := cfg.MaxExportDuration
+	if maxDuration <= 0 {
+		maxDuration = recordDefaultMaxExportDuration
+	}
+	if end.Sub(start) > time.Duration(maxDuration)*time.Second {
+		c.IndentedJSON(400, Message{Status: 0, Payload: ErrorRecordExportTooLong.Error()})
+		return
+	}
+
+	reader, err := NewRecordReader(directory, start)
+	if err != nil {
+		status := 500
+		if errors.Is(err, ErrorRecordNotFound) {
+			status = 404
+		}
+		c.IndentedJSON(status, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+	defer reader.Close()
+
+	tracks, indexes := mp4Tracks(reader.Codecs())
+	if len(tracks) == 0 {
+		c.IndentedJSON(500, Message{Status: 0, Payload: ErrorStreamChannelCodecNotFound.Error()})
+		return
+	}
+
+	// the muxer writes the moov box once all samples are known, so the clip is built in a temporary file
+	file, err := os.CreateTemp("", "export-*.mp4")
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "CreateTemp",
+		}).Errorln(err.Error())
+		return
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	maxSizeMB := cfg.MaxExportSizeMB
+	if maxSizeMB <= 0 {
+		maxSizeMB = recordDefaultMaxExportSizeMB
+	}
+	muxer := mp4.NewMuxer(&recordExportFile{File: file, limit: maxSizeMB * 1024 * 1024})
+	if err = muxer.WriteHeader(tracks); err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "WriteHeader",
+		}).Errorln(err.Error())
+		return
+	}
+	var written bool
+	for {
+		pkt, wall, err := reader.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+			requestLogger.WithFields(logrus.Fields{
+				"call": "ReadPacket",
+			}).Errorln(err.Error())
+			return
+		}
+		if !wall.Before(end) {
+			break
+		}
+		idx, ok := indexes[pkt.Idx]
+		if !ok {
+			continue
+		}
+		pkt.Idx = idx
+		if err = muxer.WritePacket(pkt); errors.Is(err, ErrorRecordExportTooLarge) {
+			c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+			return
+		} else if err != nil {
+			c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+			requestLogger.WithFields(logrus.Fields{
+				"call": "WritePacket",
+			}).Errorln(err.Error())
+			return
+		}
+		written = true
+	}
+	if !written {
+		c.IndentedJSON(404, Message{Status: 0, Payload: ErrorRecordNotFound.Error()})
+		return
+	}
+	if err = muxer.WriteTrailer(); errors.Is(err, ErrorRecordExportTooLarge) {
+		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+		return
+	} else if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "WriteTrailer",
+		}).Errorln(err.Error())
+		return
+	}
+	c.FileAttachment(file.Name(), c.Param("uuid")+"_"+c.Param("channel")+"_"+start.UTC().Format("20060102T150405Z")+".mp4")
+}
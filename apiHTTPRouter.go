@@ -34,12 +34,52 @@ func HTTPAPIServer() {
 	//Add private login password protect methods
 	privat := public.Group("/")
 	if Storage.ServerHTTPLogin() != "" && Storage.ServerHTTPPassword() != "" {
-		privat.Use(gin.BasicAuth(gin.Accounts{Storage.ServerHTTPLogin(): Storage.ServerHTTPPassword()}))
+		auth, err := HTTPAPIServerAuth()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"module": "http_router",
+				"func":   "HTTPAPIServer",
+				"call":   "HTTPAPIServerAuth",
+			}).Fatalln(err.Error())
+		}
+		privat.Use(auth)
 	}
 
 	privat.GET("/streams", HTTPAPIServerStreams)
 	public.GET("/stream/:uuid/channel/:channel/snapshot", HTTPAPIServerProduceSnapshot)
+	public.HEAD("/stream/:uuid/channel/:channel/snapshot", HTTPAPIServerProduceSnapshot)
+	privat.GET("/stream/:uuid/channel/:channel/snapshot/masks", HTTPAPIServerSnapshotMasks)
+	privat.PUT("/stream/:uuid/channel/:channel/snapshot/masks", HTTPAPIServerRequireLogin, HTTPAPIServerSnapshotMasksEdit)
 	public.POST("/stream/:uuid/channel/:channel/webrtc", HTTPAPIServerStreamWebRTC)
+	public.GET("/stream/:uuid/channel/:channel/webrtc/:session", HTTPAPIServerStreamWebRTCStatus)
+	public.POST("/stream/:uuid/channel/:channel/webrtc/:session/:action", HTTPAPIServerStreamWebRTCControl)
+	public.GET("/stream/:uuid/channel/:channel/mse", HTTPAPIServerStreamMSE)
+	public.GET("/stream/:uuid/channel/:channel/mjpeg", HTTPAPIServerStreamMJPEG)
+	public.GET("/stream/:uuid/channel/:channel/hls/live/index.m3u8", HTTPAPIServerStreamHLSM3U8)
+	public.GET("/stream/:uuid/channel/:channel/hls/live/init.mp4", HTTPAPIServerStreamHLSInit)
+	public.GET("/stream/:uuid/channel/:channel/hls/live/segment/:segment", HTTPAPIServerStreamHLSSegment)
+	public.GET("/stream/:uuid/channel/:channel/hls/live/part/:part", HTTPAPIServerStreamHLSPart)
+	public.GET("/stream/:uuid/channel/:channel/record/ranges", HTTPAPIServerStreamRecordRanges)
+	public.GET("/stream/:uuid/channel/:channel/record/export", HTTPAPIServerStreamRecordExport)
+	public.POST("/stream/:uuid/channel/:channel/playback/webrtc", HTTPAPIServerStreamPlaybackWebRTC)
+	public.GET("/stream/:uuid/channel/:channel/playback/hls", HTTPAPIServerStreamPlaybackHLS)
+	public.GET("/stream/:uuid/channel/:channel/playback/:session", HTTPAPIServerStreamPlaybackStatus)
+	public.POST("/stream/:uuid/channel/:channel/playback/:session/:action", HTTPAPIServerStreamPlaybackControl)
+	public.GET("/stream/:uuid/channel/:channel/playback/:session/hls/index.m3u8", HTTPAPIServerStreamHLSM3U8)
+	public.GET("/stream/:uuid/channel/:channel/playback/:session/hls/init.mp4", HTTPAPIServerStreamHLSInit)
+	public.GET("/stream/:uuid/channel/:channel/playback/:session/hls/segment/:segment", HTTPAPIServerStreamHLSSegment)
+	public.GET("/stream/:uuid/channel/:channel/playback/:session/hls/part/:part", HTTPAPIServerStreamHLSPart)
+	public.GET("/stream/:uuid/channel/:channel/dvr/export", HTTPAPIServerStreamDVRExport)
+	privat.POST("/stream/:uuid/channel/:channel/dvr/capture", HTTPAPIServerRequireLogin, HTTPAPIServerStreamDVRCapture)
+	public.GET("/stream/:uuid/channel/:channel/archive", HTTPAPIServerStreamArchive)
+	public.GET("/stream/:uuid/channel/:channel/archive/image", HTTPAPIServerStreamArchiveImage)
+	public.GET("/stream/:uuid/channel/:channel/archive/export", HTTPAPIServerStreamArchiveExport)
+	public.GET("/mosaic", HTTPAPIServerMosaic)
+	public.GET("/mosaic/:layout", HTTPAPIServerMosaic)
+	privat.GET("/events", HTTPAPIServerEvents)
+	privat.GET("/events/sse", HTTPAPIServerEventsSSE)
+	privat.GET("/events/:id/snapshot", HTTPAPIServerEventSnapshot)
+	privat.GET("/debug/digest_auth", HTTPAPIServerDigestAuthCache)
 
 	/*
 		HTTPS Mode Cert
@@ -98,3 +138,12 @@ func HTTPAPIServerStreams(c *gin.Context) {
 
 	c.IndentedJSON(200, Message{Status: 1, Payload: data})
 }
+
+//HTTPAPIServerRequireLogin refuse write routes of the private group, left open without server login and password
+func HTTPAPIServerRequireLogin(c *gin.Context) {
+	if Storage.ServerHTTPLogin() == "" || Storage.ServerHTTPPassword() == "" {
+		c.AbortWithStatusJSON(403, Message{Status: 0, Payload: "this endpoint requires the server http_login and http_password"})
+		return
+	}
+	c.Next()
+}
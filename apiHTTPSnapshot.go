@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -18,10 +21,8 @@ import (
 )
 
 const (
-	snapshotModuleHikvisionNonceExpirationSpoof = "hikvision_spoof_nonce_expiration"
-	oneYear = time.Hour * 24 * 365 * 10
+	snapshotDefaultCacheControl = "no-cache"
 )
-var isAllDigitsRe = regexp.MustCompile("^[0-9]+$")
 var httpTransportsByTimeout = make(map[uint]http.RoundTripper)
 
 func HttpTransportWithTimeout(timeout uint) http.RoundTripper {
@@ -47,74 +48,185 @@ func HttpTransportWithTimeout(timeout uint) http.RoundTripper {
 	return http.DefaultTransport
 }
 
-func (s *SnapshotST) LoadModules() {
-	if s.Modules == nil {
-		return
+func (s *SnapshotST) LoadModules() error {
+	s.modules = nil
+	for _, name := range s.Modules {
+		factory, ok := snapshotModuleRegistry[name]
+		if !ok {
+			return fmt.Errorf("unknown module in snapshot configuration: %v (available: %v)", name, strings.Join(SnapshotModuleNames(), ", "))
+		}
+
+		module, err := factory(s, s.ModuleConfig[name])
+		if err != nil {
+			return fmt.Errorf("snapshot module %v: %w", name, err)
+		}
+		s.modules = append(s.modules, module)
 	}
 
-	for _, module := range s.Modules {
-		switch module {
-		case snapshotModuleHikvisionNonceExpirationSpoof:
-			// Hikvision nonces are in the form of `<hash>:<unix_ts>`. The timestamp is not embedded
-			// into the hash whatsoever, so we can just spoof its expiration :-)
-			if !s.DigestAuth.Enabled || !s.DigestAuth.AllowNonceReuse {
-				return
-			}
+	for name := range s.ModuleConfig {
+		if !containsFold(s.Modules, name) {
+			return fmt.Errorf("module_config of %v which is not in the snapshot modules", name)
+		}
+	}
 
-			s.DigestAuth.requestor.Hooks.BeforePersistState = func(c context.Context, state *DigestAuthState) {
-				// assume already generated states are already patched
-				if !state.IsFresh() {
-					return
-				}
-				// note: potential for races here between the get and set, but it's not really that
-				// relevant as all nonces keep being valid, we just alter the timestamp.
-				nonce, expiration, found := strings.Cut(state.Get("nonce"), ":")
-
-				if !found || !isAllDigitsRe.MatchString(expiration) {
-					if logger, ok := c.Value("logger").(*logrus.Entry); ok {
-						logger.Warnf(
-							"Module '%v' is registered for snapshot config, but incompatible nonce was found",
-							snapshotModuleHikvisionNonceExpirationSpoof,
-						)
-					}
-					return
-				}
-
-				expiration = strconv.FormatInt(time.Now().Add(oneYear).UnixMilli(), 10)
-				state.Set("nonce", fmt.Sprintf("%v:%v", nonce, expiration))
+	if s.DigestAuth.requestor != nil && len(s.modules) != 0 {
+		modules := s.modules
+		s.DigestAuth.requestor.Hooks.BeforePersistState = func(c context.Context, state *DigestAuthState) {
+			for _, module := range modules {
+				module.BeforePersistState(c, state)
 			}
-		default:
-			log.Fatalf("unknown module in snapshot configuration: %v", module)
 		}
 	}
+	return nil
 }
 
 func (s *SnapshotST) RequestSnapshot(c context.Context) (*http.Response, error) {
-	// Determine auth type.
-	if !s.DigestAuth.Enabled {
-		// fast path
-		return s.client.Get(s.URL)
+	rawURL, err := Storage.CredentialsURL(s.URL, s.credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(c, "GET", rawURL, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	for _, module := range s.modules {
+		if err := module.BeforeRequest(c, req); err != nil {
+			return nil, err
+		}
 	}
 
-	uri, err := url.Parse(s.URL)
+	res, err := s.doSnapshotRequest(c, req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create URL: %w", err)
+		// modules may move the credentials into the query, keep them out of the logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+		}
+		return nil, err
 	}
 
-	res, err := s.DigestAuth.requestor.Request(c, *uri)
+	for _, module := range s.modules {
+		if err := module.AfterResponse(c, res); err != nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			return nil, err
+		}
+	}
+	return res, nil
+}
 
-	if errors.Is(err, ErrDigestAuthMissingCredentials) {
+func (s *SnapshotST) doSnapshotRequest(c context.Context, req *http.Request) (*http.Response, error) {
+	// Determine auth type.
+	if !s.DigestAuth.Enabled {
+		// fast path
+		return s.client.Do(req)
+	}
+
+	if req.URL.User == nil {
 		// no credentials in URL, assume this was by mistake
 		if logger, ok := c.Value("logger").(*logrus.Entry); ok {
 			logger.Logger.Warnf(
 				"attempted to use digest auth authenticator with URL with no credentials in it: %v",
-				s.URL,
+				req.URL.Host+req.URL.Path,
 			)
 		}
-		return s.client.Get(s.URL)
+		return s.client.Do(req)
+	}
+
+	return s.DigestAuth.requestor.Do(req, req.URL.User)
+}
+
+type snapshotStatusError int
+
+func (e snapshotStatusError) Error() string {
+	return fmt.Sprintf("camera responded with status %v", int(e))
+}
+
+type SnapshotImageST struct {
+	Body        []byte
+	ContentType string
+	ETag        string
+	Modified    time.Time
+
+	fetched time.Time
+}
+
+func (s *SnapshotST) FetchSnapshot(c context.Context) (*SnapshotImageST, error) {
+	if s.mjpeg != nil {
+		return s.mjpeg.Latest(c)
+	}
+
+	res, err := s.RequestSnapshot(c)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	// error pages of the camera (e.g. 401 on bad credentials) must not be served as an image
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		io.Copy(io.Discard, res.Body)
+		return nil, snapshotStatusError(res.StatusCode)
+	}
+
+	if s.Mode == snapshotModeMJPEG {
+		// the first complete frame, the connection is closed on return
+		reader, err := mjpegReader(res)
+		if err != nil {
+			return nil, err
+		}
+		return mjpegFrame(reader)
 	}
 
-	return res, err
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading camera response failed: %w", err)
+	}
+
+	image := &SnapshotImageST{
+		Body:        body,
+		ContentType: res.Header.Get("Content-Type"),
+		ETag:        res.Header.Get("ETag"),
+		Modified:    time.Now(),
+		fetched:     time.Now(),
+	}
+	if image.ETag == "" {
+		sum := sha256.Sum256(body)
+		image.ETag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+	if lastModified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		image.Modified = lastModified
+	}
+	return image, nil
+}
+
+func (s *SnapshotST) Snapshot(c context.Context) (*SnapshotImageST, error) {
+	if s.cache == nil {
+		return s.FetchSnapshot(c)
+	}
+	return s.cache.Get(c)
+}
+
+func (s *SnapshotST) Transform(source *SnapshotImageST, transform SnapshotTransformST) (*SnapshotImageST, error) {
+	if s.cache == nil {
+		return transform.Apply(source)
+	}
+	return s.cache.Variant(source, transform)
+}
+
+func snapshotAdmin(c *gin.Context) bool {
+	if httpDigestAuth != nil {
+		// the public route sends no challenge, browsers send the credentials of the private ones
+		_, err := httpDigestAuth.Authenticate(c.Request)
+		return err == nil
+	}
+	login, password, ok := c.Request.BasicAuth()
+	if !ok || Storage.ServerHTTPLogin() == "" || Storage.ServerHTTPPassword() == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(login), []byte(Storage.ServerHTTPLogin())) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(Storage.ServerHTTPPassword())) == 1
 }
 
 func HTTPAPIServerProduceSnapshot(c *gin.Context) {
@@ -138,18 +250,145 @@ func HTTPAPIServerProduceSnapshot(c *gin.Context) {
 	}
 
 	if channel.Snapshot.URL == "" {
-		c.JSON(500, Message{Status: 0, Payload: ErrorStreamChannelSnapshotDisabled.Error()})
+		snapshotKeyframe(c, channel, logger)
+		return
+	}
+
+	transform, transformed, err := ParseSnapshotTransform(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(400, Message{Status: 0, Payload: err.Error()})
 		return
 	}
 
 	cfg := channel.Snapshot
-	res, err := cfg.RequestSnapshot(context.WithValue(c, "logger", logger))
+	if cfg.privacy != nil {
+		// unmasked images are only served to the server admin, when allowed by the channel
+		unmasked, _ := strconv.ParseBool(c.Query("unmasked"))
+		if !unmasked {
+			transform.privacy = cfg.privacy
+			transformed = true
+		} else if !cfg.AdminUnmasked || !snapshotAdmin(c) {
+			c.JSON(403, Message{Status: 0, Payload: "unmasked snapshots require admin credentials"})
+			return
+		}
+	}
+	if cfg.overlay != nil {
+		transform.overlay = cfg.overlay
+		transformed = true
+	}
+	image, err := cfg.Snapshot(context.WithValue(c, "logger", logger))
 	if err != nil {
 		logger.Errorf("request to camera failed: %v", err)
-		c.JSON(500, Message{Status: 0, Payload: "request to camera failed"})
+		var statusErr snapshotStatusError
+		if errors.As(err, &statusErr) {
+			c.JSON(502, Message{Status: 0, Payload: statusErr.Error()})
+		} else {
+			c.JSON(502, Message{Status: 0, Payload: "request to camera failed"})
+		}
 		return
 	}
 
-	defer res.Body.Close()
-	io.Copy(c.Writer, res.Body)
+	if transformed {
+		image, err = cfg.Transform(image, transform)
+		if err != nil {
+			var transformErr snapshotTransformError
+			if errors.As(err, &transformErr) {
+				c.JSON(400, Message{Status: 0, Payload: transformErr.Error()})
+			} else {
+				logger.Errorf("snapshot transform failed: %v", err)
+				c.JSON(502, Message{Status: 0, Payload: "snapshot transform failed"})
+			}
+			return
+		}
+	}
+
+	serveSnapshot(c, cfg, image)
+}
+
+func serveSnapshot(c *gin.Context, cfg SnapshotST, image *SnapshotImageST) {
+	if image.ContentType != "" {
+		c.Header("Content-Type", image.ContentType)
+	}
+	cacheControl := cfg.CacheControl
+	if cacheControl == "" {
+		cacheControl = snapshotDefaultCacheControl
+	}
+	c.Header("Cache-Control", cacheControl)
+	c.Header("ETag", image.ETag)
+
+	// handles If-None-Match/If-Modified-Since, HEAD requests and Content-Length
+	http.ServeContent(c.Writer, c.Request, "", image.Modified, bytes.NewReader(image.Body))
+}
+
+// Channels without snapshot url serve their last H264/H265 keyframe as a single frame MP4. The
+// frame isn't decoded, so it can't be masked, resized or overlaid.
+func snapshotKeyframe(c *gin.Context, channel *ChannelST, logger *logrus.Entry) {
+	if channel.keyframe == nil {
+		c.JSON(500, Message{Status: 0, Payload: ErrorStreamChannelSnapshotDisabled.Error()})
+		return
+	}
+	if len(channel.Snapshot.Masks) > 0 {
+		c.JSON(403, Message{Status: 0, Payload: "privacy masks require the snapshot url"})
+		return
+	}
+	if _, transformed, err := ParseSnapshotTransform(c.Request.URL.Query()); err != nil || transformed {
+		c.JSON(400, Message{Status: 0, Payload: "keyframe snapshots can't be transformed"})
+		return
+	}
+
+	// on demand channels are started and stop again once they have no viewers
+	Storage.StreamChannelRun(c.Param("uuid"), c.Param("channel"))
+	if err := channel.keyframe.Wait(c); err != nil {
+		logger.Errorf("waiting for a keyframe failed: %v", err)
+		c.JSON(502, Message{Status: 0, Payload: ErrorStreamNoVideo.Error()})
+		return
+	}
+	image, err := channel.keyframe.Snapshot()
+	if err != nil {
+		logger.Errorf("keyframe snapshot failed: %v", err)
+		c.JSON(502, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+	serveSnapshot(c, channel.Snapshot, image)
+}
+
+func HTTPAPIServerSnapshotMasks(c *gin.Context) {
+	channel, err := Storage.StreamChannelInfo(c.Param("uuid"), c.Param("channel"))
+	if err != nil {
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+
+	masks := channel.Snapshot.Masks
+	if masks == nil {
+		masks = []SnapshotMaskST{}
+	}
+	c.IndentedJSON(200, Message{Status: 1, Payload: masks})
+}
+
+func HTTPAPIServerSnapshotMasksEdit(c *gin.Context) {
+	logger := log.WithFields(logrus.Fields{
+		"module":  "http_snapshot",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerSnapshotMasksEdit",
+	})
+
+	var masks []SnapshotMaskST
+	if err := c.BindJSON(&masks); err != nil {
+		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+
+	if _, err := NewSnapshotPrivacy(masks); err != nil {
+		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+
+	if err := Storage.StreamChannelSnapshotMasks(c.Param("uuid"), c.Param("channel"), masks); err != nil {
+		logger.Errorf("updating snapshot masks failed: %v", err)
+		c.IndentedJSON(500, Message{Status: 0, Payload: err.Error()})
+		return
+	}
+	c.IndentedJSON(200, Message{Status: 1, Payload: Success})
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"strconv"
 	"time"
 
+	"github.com/deepch/vdk/av"
 	webrtc "github.com/deepch/vdk/format/webrtcv3"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -31,7 +34,7 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 		}).Errorln(ErrorStreamNotFound.Error())
 		return
 	}
-	
+
 	Storage.StreamChannelRun(c.Param("uuid"), c.Param("channel"))
 	codecs, err := Storage.StreamChannelCodecs(c.Param("uuid"), c.Param("channel"))
 	if err != nil {
@@ -50,8 +53,35 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 		}).Errorln(err.Error())
 		return
 	}
+	cid, ch, _, _, err := Storage.ClientAdd(c.Param("uuid"), c.Param("channel"), WEBRTC)
+	if err == ErrorStreamViewerLimit {
+		c.IndentedJSON(503, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "ClientAdd",
+		}).Errorln(err.Error())
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "ClientAdd",
+		}).Errorln(err.Error())
+		return
+	}
+	timeshift, err := Storage.ClientTimeshift(c.Param("uuid"), c.Param("channel"), cid)
+	if err != nil {
+		Storage.ClientDelete(c.Param("uuid"), cid, c.Param("channel"))
+		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "ClientTimeshift",
+		}).Errorln(err.Error())
+		return
+	}
+	// the answer body is kept unchanged for existing players, the session is returned in a header
+	c.Header("X-WebRTC-Session", cid)
 	_, err = c.Writer.Write([]byte(answer))
 	if err != nil {
+		Storage.ClientDelete(c.Param("uuid"), cid, c.Param("channel"))
 		c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
 		requestLogger.WithFields(logrus.Fields{
 			"call": "Write",
@@ -59,18 +89,13 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 		return
 	}
 	go func() {
-		cid, ch, _, err := Storage.ClientAdd(c.Param("uuid"), c.Param("channel"), WEBRTC)
-		if err != nil {
-			c.IndentedJSON(400, Message{Status: 0, Payload: err.Error()})
-			requestLogger.WithFields(logrus.Fields{
-				"call": "ClientAdd",
-			}).Errorln(err.Error())
-			return
-		}
 		defer Storage.ClientDelete(c.Param("uuid"), cid, c.Param("channel"))
+		defer timeshift.Close()
 		var videoStart bool
 		noVideo := time.NewTimer(10 * time.Second)
 		for {
+			var pkt av.Packet
+			var ok bool
 			select {
 			case <-noVideo.C:
 				//				c.IndentedJSON(500, Message{Status: 0, Payload: ErrorStreamNoVideo.Error()})
@@ -78,22 +103,111 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 					"call": "ErrorStreamNoVideo",
 				}).Errorln(ErrorStreamNoVideo.Error())
 				return
+			case request := <-timeshift.Requests():
+				timeshift.Apply(request)
+				continue
+			case <-timeshift.Timer():
+				//rewound viewers are fed from the DVR buffer, live packets are dropped meanwhile
+				pkt, ok = timeshift.BufferedPacket()
 			case pck := <-ch:
 				if pck.IsKeyFrame {
-					noVideo.Reset(10 * time.Second)
 					videoStart = true
 				}
 				if !videoStart {
 					continue
 				}
-				err = muxerWebRTC.WritePacket(*pck)
-				if err != nil {
-					requestLogger.WithFields(logrus.Fields{
-						"call": "WritePacket",
-					}).Errorln(err.Error())
-					return
-				}
+				pkt, ok = timeshift.LivePacket(pck)
+			}
+			if !ok {
+				continue
+			}
+			if pkt.IsKeyFrame {
+				noVideo.Reset(10 * time.Second)
+			}
+			err = muxerWebRTC.WritePacket(pkt)
+			if err != nil {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "WritePacket",
+				}).Errorln(err.Error())
+				return
 			}
 		}
 	}()
 }
+
+//HTTPAPIServerStreamWebRTCTimeshift check access and get timeshift state of the request session
+func HTTPAPIServerStreamWebRTCTimeshift(c *gin.Context, requestLogger *logrus.Entry) (*StreamTimeshift, bool) {
+	if !RemoteAuthorization("WebRTC", c.Param("uuid"), c.Param("channel"), c.Query("token"), c.ClientIP()) {
+		c.IndentedJSON(401, Message{Status: 0, Payload: ErrorStreamUnauthorized.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "RemoteAuthorization",
+		}).Errorln(ErrorStreamUnauthorized.Error())
+		return nil, false
+	}
+	timeshift, err := Storage.ClientTimeshift(c.Param("uuid"), c.Param("channel"), c.Param("session"))
+	if err != nil {
+		c.IndentedJSON(404, Message{Status: 0, Payload: err.Error()})
+		return nil, false
+	}
+	return timeshift, true
+}
+
+//HTTPAPIServerStreamWebRTCStatus get live WebRTC viewer timeshift status
+func HTTPAPIServerStreamWebRTCStatus(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_webrtc",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamWebRTCStatus",
+	})
+
+	timeshift, ok := HTTPAPIServerStreamWebRTCTimeshift(c, requestLogger)
+	if !ok {
+		return
+	}
+	c.IndentedJSON(200, Message{Status: 1, Payload: timeshift.Status()})
+}
+
+//HTTPAPIServerStreamWebRTCControl rewind live WebRTC viewer or return it to live
+func HTTPAPIServerStreamWebRTCControl(c *gin.Context) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "http_webrtc",
+		"stream":  c.Param("uuid"),
+		"channel": c.Param("channel"),
+		"func":    "HTTPAPIServerStreamWebRTCControl",
+	})
+
+	timeshift, ok := HTTPAPIServerStreamWebRTCTimeshift(c, requestLogger)
+	if !ok {
+		return
+	}
+	var rewind time.Duration
+	switch c.Param("action") {
+	case "rewind":
+		seconds, err := strconv.Atoi(c.Query("seconds"))
+		if err != nil || seconds <= 0 {
+			c.IndentedJSON(400, Message{Status: 0, Payload: "invalid rewind seconds"})
+			return
+		}
+		rewind = time.Duration(seconds) * time.Second
+	case "live":
+	default:
+		c.IndentedJSON(404, Message{Status: 0, Payload: "unknown webrtc action"})
+		return
+	}
+	if err := timeshift.Control(rewind); err != nil {
+		status := 500
+		switch {
+		case errors.Is(err, ErrorDVRDisabled), errors.Is(err, ErrorClientNotFound):
+			status = 404
+		case errors.Is(err, ErrorDVRNotBuffered):
+			status = 409
+		}
+		c.IndentedJSON(status, Message{Status: 0, Payload: err.Error()})
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Control",
+		}).Errorln(err.Error())
+		return
+	}
+	c.IndentedJSON(200, Message{Status: 1, Payload: timeshift.Status()})
+}
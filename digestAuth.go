@@ -3,12 +3,16 @@ package main
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // RFC 7616
@@ -23,16 +27,169 @@ const (
 	digestAuthParamResponse = "response"
 	digestAuthParamUri = "uri"
 	digestAuthParamUsername = "username"
+	digestAuthParamUsernameExt = "username*"
+	digestAuthParamOpaque = "opaque"
+	digestAuthParamStale = "stale"
+	digestAuthParamUserhash = "userhash"
+	digestAuthParamCharset = "charset"
+	digestAuthParamNextNonce = "nextnonce"
+
+	digestAuthCharsetUtf8 = "UTF-8"
 
 	digestAuthAlgoUnspecified = ""
 	digestAuthAlgoMd5 = "md5"
 	digestAuthAlgoMd5Sess = "md5-sess"
+	digestAuthAlgoSha256 = "sha-256"
+	digestAuthAlgoSha256Sess = "sha-256-sess"
+	digestAuthAlgoSha512256 = "sha-512-256"
+	digestAuthAlgoSha512256Sess = "sha-512-256-sess"
+	digestAuthSessSuffix = "-sess"
+
+	digestAuthSchemeDigest = "Digest"
+	digestAuthSchemeBasic = "Basic"
+	// Basic as it is named in a scheme preference, next to the digest algorithms
+	digestAuthSchemeBasicName = "basic"
 
 	digestAuthQopUnspecified = ""
 	digestAuthQopAuth = "auth"
 	digestAuthQopAuthInt = "auth-int"
 )
 
+// Default preference of the answered challenge, the strongest digest algorithm first. Basic sends
+// the password in clear text, it is only answered when a scheme preference lists it.
+var digestAuthDefaultSchemes = []string{
+	digestAuthAlgoSha512256,
+	digestAuthAlgoSha256,
+	digestAuthAlgoMd5,
+}
+
+// Schemes a preference may list.
+var digestAuthSupportedSchemes = []string{
+	digestAuthAlgoSha512256,
+	digestAuthAlgoSha256,
+	digestAuthAlgoMd5,
+	digestAuthSchemeBasicName,
+}
+
+// Generates the client nonce, replaced in tests to reproduce the RFC 7616 examples.
+var digestAuthClientNonce = func() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to fill cnonce: %w", err)
+	}
+
+	hash := md5.Sum(buf)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Returns the hex encoded hash function of the algorithm.
+func digestAuthHash(algo string) (func(string) string, bool) {
+	switch strings.TrimSuffix(algo, digestAuthSessSuffix) {
+	case digestAuthAlgoUnspecified, digestAuthAlgoMd5:
+		return func(input string) string {
+			sum := md5.Sum([]byte(input))
+			return hex.EncodeToString(sum[:])
+		}, true
+	case digestAuthAlgoSha256:
+		return func(input string) string {
+			sum := sha256.Sum256([]byte(input))
+			return hex.EncodeToString(sum[:])
+		}, true
+	case digestAuthAlgoSha512256:
+		return func(input string) string {
+			sum := sha512.Sum512_256([]byte(input))
+			return hex.EncodeToString(sum[:])
+		}, true
+	}
+	return nil, false
+}
+
+// Name of the challenge in a scheme preference: "basic" or the digest algorithm without -sess, ""
+// if the scheme or algorithm is not supported.
+func authChallengeName(challenge AuthChallenge) string {
+	if strings.EqualFold(challenge.Scheme, digestAuthSchemeBasic) {
+		return digestAuthSchemeBasicName
+	}
+	if !strings.EqualFold(challenge.Scheme, digestAuthSchemeDigest) {
+		return ""
+	}
+
+	algo := strings.ToLower(challenge.Params[digestAuthParamAlgorithm])
+	if _, ok := digestAuthHash(algo); !ok {
+		return ""
+	}
+
+	algo = strings.TrimSuffix(algo, digestAuthSessSuffix)
+	if algo == digestAuthAlgoUnspecified {
+		return digestAuthAlgoMd5
+	}
+	return algo
+}
+
+// Validates a scheme preference, e.g. ["sha-256", "md5", "basic"].
+func validateAuthSchemes(schemes []string) error {
+	for _, scheme := range schemes {
+		if !containsFold(digestAuthSupportedSchemes, scheme) {
+			return fmt.Errorf("unknown auth scheme: %v", scheme)
+		}
+	}
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, item := range values {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Picks the challenge that comes first in the scheme preference, cameras may send one challenge per
+// algorithm and a Basic one next to them.
+func selectAuthChallenge(challenges []AuthChallenge, schemes []string) (AuthChallenge, error) {
+	if len(schemes) == 0 {
+		schemes = digestAuthDefaultSchemes
+	}
+
+	for _, scheme := range schemes {
+		for _, challenge := range challenges {
+			if strings.EqualFold(authChallengeName(challenge), scheme) {
+				return challenge, nil
+			}
+		}
+	}
+
+	var offered []string
+	for _, challenge := range challenges {
+		offered = append(offered, challenge.Scheme+" "+challenge.Params[digestAuthParamAlgorithm])
+	}
+	return AuthChallenge{}, fmt.Errorf("no challenge matching the auth schemes %q in %q", schemes, offered)
+}
+
+// Picks auth over auth-int from the qop options offered by the server.
+func selectDigestQop(qops string) (string, error) {
+	if strings.TrimSpace(qops) == "" {
+		return digestAuthQopUnspecified, nil
+	}
+
+	var authInt bool
+	for _, qop := range strings.Split(qops, ",") {
+		switch strings.ToLower(strings.TrimSpace(qop)) {
+		case digestAuthQopAuth:
+			return digestAuthQopAuth, nil
+		case digestAuthQopAuthInt:
+			authInt = true
+		}
+	}
+
+	if authInt {
+		return digestAuthQopAuthInt, nil
+	}
+	return "", fmt.Errorf("unknown qop: %v", qops)
+}
+
 type DigestAuthState struct {
 	mu sync.Mutex
 
@@ -41,16 +198,16 @@ type DigestAuthState struct {
 	createdAt time.Time
 }
 
-func newDigestAuthStateFromChallenge(challenge string) (*DigestAuthState, error) {
-	params, err := parseWWWAuthenticate(challenge)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse challenge from WWW-Authenticate header: %w", err)
+func newDigestAuthStateFromParams(params map[string]string) *DigestAuthState {
+	copied := make(map[string]string, len(params))
+	for key, val := range params {
+		copied[key] = val
 	}
 
 	return &DigestAuthState{
-		params: params,
+		params: copied,
 		createdAt: time.Now(),
-	}, nil
+	}
 }
 
 func (s *DigestAuthState) IsFresh() bool {
@@ -74,10 +231,80 @@ func (s *DigestAuthState) Set(param, value string) {
 	s.params[param] = value
 }
 
-// Computes digest authentication response. Mutates the input state.
+// Inputs of the request digest, the values of the Authorization header except for the password.
+type digestAuthResponseInput struct {
+	sess bool
+	username string
+	realm string
+	password string
+	nonce string
+	nonceCount string
+	cnonce string
+	qop string
+	method string
+	uri string
+	body []byte
+}
+
+// Computes the request digest (RFC 7616 section 3.4.1), on the client as well as on the server.
+func computeDigestAuthResponse(mkHash func(string) string, in digestAuthResponseInput) string {
+	var ha1, ha2, response string
+
+	// compute ha1
+	{
+		// HA1 = H(username:realm:password)
+		ha1 = mkHash(fmt.Sprintf("%v:%v:%v", in.username, in.realm, in.password))
+
+		if in.sess {
+			// HA1 = H(H(username:realm:password):nonce:cnonce)
+			ha1 = mkHash(fmt.Sprintf("%v:%v:%v", ha1, in.nonce, in.cnonce))
+		}
+	}
+
+	// compute ha2
+	{
+		if in.qop == digestAuthQopAuth || in.qop == digestAuthQopUnspecified {
+			// HA2 = H(method:digestURI)
+			ha2 = fmt.Sprintf("%v:%v", in.method, in.uri)
+		} else {
+			// HA2 = H(method:digestURI:H(entityBody))
+			ha2 = fmt.Sprintf("%v:%v:%v", in.method, in.uri, mkHash(string(in.body)))
+		}
+
+		ha2 = mkHash(ha2)
+	}
+
+	// compute response
+	{
+		if in.qop == digestAuthQopAuth || in.qop == digestAuthQopAuthInt {
+			// response = H(HA1:nonce:nonceCount:cnonce:qop:HA2)
+			response = fmt.Sprintf("%v:%v:%v:%v:%v:%v", ha1, in.nonce, in.nonceCount, in.cnonce, in.qop, ha2)
+		} else { // unspecified
+			// response = H(HA1:nonce:HA2)
+			response = fmt.Sprintf("%v:%v:%v", ha1, in.nonce, ha2)
+		}
+
+		response = mkHash(response)
+	}
+
+	return response
+}
+
+// Computes digest authentication response of a GET request. Mutates the input state.
 func (s *DigestAuthState) ComputeResponse(
 	requestUri string,
 	credentials *url.Userinfo,
+) (string, error) {
+	return s.ComputeResponseForRequest("GET", requestUri, nil, credentials)
+}
+
+// Computes digest authentication response of any request, the body is only hashed with auth-int.
+// Mutates the input state.
+func (s *DigestAuthState) ComputeResponseForRequest(
+	method string,
+	requestUri string,
+	body []byte,
+	credentials *url.Userinfo,
 ) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -86,92 +313,130 @@ func (s *DigestAuthState) ComputeResponse(
 	params := s.params
 	rawNonceCount := s.nonceCount
 
-	algo, qop, realm, nonce :=
+	// realm and nonce are case sensitive, only the algorithm and qop tokens are not
+	algo, realm, nonce :=
 		strings.ToLower(params[digestAuthParamAlgorithm]),
-		strings.ToLower(params[digestAuthParamQop]),
-		strings.ToLower(params[digestAuthParamRealm]),
-		strings.ToLower(params[digestAuthParamNonce])
+		params[digestAuthParamRealm],
+		params[digestAuthParamNonce]
+
+	qop, err := selectDigestQop(params[digestAuthParamQop])
+	if err != nil {
+		return "", err
+	}
 
 	nonceCount := fmt.Sprintf("%08x", rawNonceCount)
+	username := credentials.Username()
 	pass, _ := credentials.Password()
 
-	mkMd5 := func(input string) string {
-		sum := md5.Sum([]byte(input))
-		return hex.EncodeToString(sum[:])
+	charsetUtf8 := strings.EqualFold(params[digestAuthParamCharset], digestAuthCharsetUtf8)
+	if charsetUtf8 {
+		// RFC 7616 section 4, credentials are hashed as NFC normalized UTF-8
+		username, pass = norm.NFC.String(username), norm.NFC.String(pass)
 	}
 
-	var cnonce, ha1, ha2, response string
+	// H is MD5, SHA-256 or SHA-512/256 depending on the algorithm
+	mkHash, ok := digestAuthHash(algo)
+	if !ok {
+		return "", fmt.Errorf("unknown algo: %v", algo)
+	}
 
 	// compute cnonce
-	{
-		buf := make([]byte, 16)
-		_, err := rand.Read(buf)
-		if err != nil {
-			return "", fmt.Errorf("failed to fill cnonce: %w", err)
-		}
-
-		hash := md5.Sum(buf)
-		cnonce = hex.EncodeToString(hash[:])
+	cnonce, err := digestAuthClientNonce()
+	if err != nil {
+		return "", err
 	}
 
-	// compute ha1
-	{
-		if algo == digestAuthAlgoMd5 || algo == digestAuthAlgoMd5Sess || algo == digestAuthAlgoUnspecified {
-			// HA1 = MD5(username:realm:password)
-			ha1 = mkMd5(fmt.Sprintf("%v:%v:%v", credentials.Username(), realm, pass))
-		} else {
-			return "", fmt.Errorf("unknown algo: %v", algo)
-		}
-
-		if algo == digestAuthAlgoMd5Sess {
-			// HA1 = MD5(MD5(username:realm:password):nonce:cnonce)
-			ha1 = mkMd5(fmt.Sprintf("%v:%v:%v", ha1, nonce, cnonce))
-			params[digestAuthParamClientNonce] = cnonce
+	sess := strings.HasSuffix(algo, digestAuthSessSuffix)
+	response := computeDigestAuthResponse(mkHash, digestAuthResponseInput{
+		sess: sess,
+		username: username,
+		realm: realm,
+		password: pass,
+		nonce: nonce,
+		nonceCount: nonceCount,
+		cnonce: cnonce,
+		qop: qop,
+		method: method,
+		uri: requestUri,
+		body: body,
+	})
+
+	// only the params of an Authorization header are sent back, tokens unquoted as in RFC 7616
+	var pieces []string
+	add := func(key, val string, quoted bool) {
+		if quoted {
+			val = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(val) + `"`
 		}
+		pieces = append(pieces, key+"="+val)
 	}
 
-	// compute ha2
-	{
-		if qop == digestAuthQopAuth || qop == digestAuthQopUnspecified {
-			// HA2 = MD5(method:digestURI)
-			ha2 = fmt.Sprintf("GET:%v", requestUri)
-		} else if qop == digestAuthQopAuthInt {
-			// HA2 = MD5(method:digestURI:MD5(entityBody))
-			// assume entityBody is empty
-			ha2 = fmt.Sprintf("GET:%v:d41d8cd98f00b204e9800998ecf8427e", requestUri)
-		} else {
-			return "", fmt.Errorf("unknown qop: %v", qop)
-		}
-
-		ha2 = mkMd5(ha2)
+	userhash := strings.EqualFold(params[digestAuthParamUserhash], "true")
+	switch {
+	case userhash:
+		// username = H(username:realm)
+		add(digestAuthParamUsername, mkHash(fmt.Sprintf("%v:%v", username, realm)), true)
+	case charsetUtf8 && !isASCII(username):
+		add(digestAuthParamUsernameExt, encodeExtValue(username), false)
+	default:
+		add(digestAuthParamUsername, username, true)
 	}
 
-	// compute response
-	{
-		if qop == digestAuthQopAuth || qop == digestAuthQopAuthInt {
-			// response = MD5(HA1:nonce:nonceCount:cnonce:qop:HA2)
-			response = fmt.Sprintf("%v:%v:%v:%v:%v:%v", ha1, nonce, nonceCount, cnonce, qop, ha2)
-			params[digestAuthParamClientNonce] = cnonce
-		} else { // unspecified
-			// response = MD5(HA1:nonce:HA2)
-			response = fmt.Sprintf("%v:%v:%v", ha1, nonce, ha2)
-		}
-
-		sum := md5.Sum([]byte(response))
-		response = hex.EncodeToString(sum[:])
+	add(digestAuthParamRealm, realm, true)
+	add(digestAuthParamUri, requestUri, true)
+	if params[digestAuthParamAlgorithm] != "" {
+		add(digestAuthParamAlgorithm, params[digestAuthParamAlgorithm], false)
+	}
+	add(digestAuthParamNonce, nonce, true)
+	if qop != digestAuthQopUnspecified {
+		add(digestAuthParamNonceCount, nonceCount, false)
+		add(digestAuthParamClientNonce, cnonce, true)
+		add(digestAuthParamQop, qop, false)
+	} else if sess {
+		add(digestAuthParamClientNonce, cnonce, true)
+	}
+	add(digestAuthParamResponse, response, true)
+	if opaque, ok := params[digestAuthParamOpaque]; ok {
+		add(digestAuthParamOpaque, opaque, true)
+	}
+	if userhash {
+		add(digestAuthParamUserhash, "true", false)
 	}
 
-	params[digestAuthParamUsername] = credentials.Username()
-	params[digestAuthParamNonceCount] = nonceCount
-	params[digestAuthParamUri] = requestUri
-	params[digestAuthParamResponse] = response
+	return "Digest " + strings.Join(pieces, ", "), nil
+}
 
-	var pieces []string
+// Switches to the nextnonce of an Authentication-Info header, the nonce count starts over.
+func (s *DigestAuthState) rotateNonce(nonce string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	for key, val := range params {
-		val = strings.ReplaceAll(val, "\"", "\\\"")
-		pieces = append(pieces, fmt.Sprintf("%v=\"%v\"", key, val))
+	s.params[digestAuthParamNonce] = nonce
+	s.nonceCount = 0
+	s.createdAt = time.Now()
+}
+
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= 0x80 {
+			return false
+		}
 	}
+	return true
+}
 
-	return "Digest " + strings.Join(pieces, ", "), nil
+// RFC 5987 ext-value of an UTF-8 string, e.g. UTF-8''J%C3%A4s%C3%B8n%20Doe
+func encodeExtValue(value string) string {
+	const attrChars = "!#$&+-.^_`|~"
+
+	var out strings.Builder
+	out.WriteString("UTF-8''")
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte(attrChars, c) != -1 {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"container/list"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	digestAuthCacheMaxEntries = 256
+	// entries unused for this long are evicted
+	digestAuthCacheTTL = time.Hour
+)
+
+// Shared by every requestor without its own cache.
+var digestAuthSharedCache = NewDigestAuthStateCache(digestAuthCacheMaxEntries, digestAuthCacheTTL)
+
+type digestAuthCacheKey struct {
+	host string
+	realm string
+	username string
+}
+
+type digestAuthCacheEntry struct {
+	key digestAuthCacheKey
+	// nil once discarded, the entry is kept for its statistics until evicted
+	state *DigestAuthState
+	// paths of the protection space (RFC 7616 domain param), empty for the whole host
+	domain []string
+	storedAt time.Time
+	usedAt time.Time
+	stores int
+	reuses int
+	failures int
+	stale int
+}
+
+type DigestAuthCacheEntryST struct {
+	Host string `json:"host"`
+	Realm string `json:"realm"`
+	Username string `json:"username"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Domain []string `json:"domain,omitempty"`
+	Valid bool `json:"valid"`
+	NonceCount int `json:"nonce_count"`
+	StoredAt time.Time `json:"stored_at"`
+	UsedAt time.Time `json:"used_at"`
+	Stores int `json:"stores"`
+	Reuses int `json:"reuses"`
+	Failures int `json:"failures"`
+	Stale int `json:"stale"`
+}
+
+// LRU cache of digest auth states keyed by host, realm and username, so requestors using different
+// credentials or realms of the same camera do not reuse each other's nonces.
+type DigestAuthStateCache struct {
+	mu sync.Mutex
+
+	maxEntries int
+	ttl time.Duration
+	entries map[digestAuthCacheKey]*list.Element
+	// most recently used first
+	lru *list.List
+}
+
+func NewDigestAuthStateCache(maxEntries int, ttl time.Duration) *DigestAuthStateCache {
+	return &DigestAuthStateCache{
+		maxEntries: maxEntries,
+		ttl: ttl,
+		entries: make(map[digestAuthCacheKey]*list.Element),
+		lru: list.New(),
+	}
+}
+
+// Length of the longest domain path containing the request path, 0 when the domain is the whole
+// host and -1 when the path is outside of the domain.
+func digestAuthDomainMatch(domain []string, path string) int {
+	if len(domain) == 0 {
+		return 0
+	}
+
+	best := -1
+	for _, prefix := range domain {
+		if strings.HasPrefix(path, prefix) && len(prefix) > best {
+			best = len(prefix)
+		}
+	}
+	return best
+}
+
+// Paths of the space separated URIs of the domain param, absolute or relative.
+func digestAuthDomainPaths(domain string) []string {
+	var paths []string
+	for _, raw := range strings.Fields(domain) {
+		uri, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+
+		path := uri.Path
+		if path == "" {
+			path = "/"
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Must be called with the lock held.
+func (cache *DigestAuthStateCache) evict(now time.Time) {
+	for element := cache.lru.Back(); element != nil; element = cache.lru.Back() {
+		entry := element.Value.(*digestAuthCacheEntry)
+		if cache.lru.Len() <= cache.maxEntries && now.Sub(entry.usedAt) < cache.ttl {
+			return
+		}
+
+		cache.lru.Remove(element)
+		delete(cache.entries, entry.key)
+	}
+}
+
+// Finds the state to reuse for the request. The realm is unknown before the challenge, the state of
+// the domain containing the path wins, then the most recently used one. States that canReuse
+// rejects are discarded.
+func (cache *DigestAuthStateCache) Load(
+	uri *url.URL,
+	username string,
+	canReuse func(*DigestAuthState) bool,
+) (*DigestAuthState, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	cache.evict(now)
+
+	var found *list.Element
+	best := -1
+	for element := cache.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*digestAuthCacheEntry)
+		if entry.state == nil || entry.key.host != uri.Host || entry.key.username != username {
+			continue
+		}
+
+		if !canReuse(entry.state) {
+			entry.state = nil
+			continue
+		}
+
+		if match := digestAuthDomainMatch(entry.domain, uri.Path); match > best {
+			found, best = element, match
+		}
+	}
+
+	if found == nil {
+		return nil, false
+	}
+
+	entry := found.Value.(*digestAuthCacheEntry)
+	entry.usedAt = now
+	entry.reuses++
+	cache.lru.MoveToFront(found)
+
+	return entry.state, true
+}
+
+func (cache *DigestAuthStateCache) Store(uri *url.URL, username string, state *DigestAuthState) {
+	key := digestAuthCacheKey{
+		host: uri.Host,
+		realm: state.Get(digestAuthParamRealm),
+		username: username,
+	}
+	domain := digestAuthDomainPaths(state.Get("domain"))
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		element = cache.lru.PushFront(&digestAuthCacheEntry{key: key})
+		cache.entries[key] = element
+	}
+	cache.lru.MoveToFront(element)
+
+	entry := element.Value.(*digestAuthCacheEntry)
+	if entry.state != state {
+		entry.state, entry.domain, entry.storedAt = state, domain, now
+		entry.stores++
+	}
+	entry.usedAt = now
+
+	cache.evict(now)
+}
+
+// Stops reusing the state the server rejected, counted as stale when only its nonce expired.
+func (cache *DigestAuthStateCache) Reject(state *DigestAuthState, stale bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for element := cache.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*digestAuthCacheEntry)
+		if entry.state != state {
+			continue
+		}
+
+		entry.state = nil
+		if stale {
+			entry.stale++
+		} else {
+			entry.failures++
+		}
+		return
+	}
+}
+
+// Snapshot of the entries and their statistics, most recently used first. Nonces are not exposed.
+func (cache *DigestAuthStateCache) Entries() []DigestAuthCacheEntryST {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.evict(time.Now())
+
+	entries := make([]DigestAuthCacheEntryST, 0, cache.lru.Len())
+	for element := cache.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*digestAuthCacheEntry)
+		out := DigestAuthCacheEntryST{
+			Host: entry.key.host,
+			Realm: entry.key.realm,
+			Username: entry.key.username,
+			Domain: entry.domain,
+			Valid: entry.state != nil,
+			StoredAt: entry.storedAt,
+			UsedAt: entry.usedAt,
+			Stores: entry.stores,
+			Reuses: entry.reuses,
+			Failures: entry.failures,
+			Stale: entry.stale,
+		}
+
+		if entry.state != nil {
+			entry.state.mu.Lock()
+			out.Algorithm = entry.state.params[digestAuthParamAlgorithm]
+			out.NonceCount = entry.state.nonceCount
+			entry.state.mu.Unlock()
+		}
+		entries = append(entries, out)
+	}
+	return entries
+}
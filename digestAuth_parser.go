@@ -151,9 +151,30 @@ func parseWWWAuthenticate(h string) (map[string]string, error) {
 		return nil, fmt.Errorf("unexpected invalid header: %v", h)
 	}
 
-	rawParams := strings.TrimLeft(strings.TrimPrefix(h, "Digest"), " ")
-	rawParamsRunes := []rune(rawParams)
+	return parseAuthParams(strings.TrimLeft(strings.TrimPrefix(h, "Digest"), " "))
+}
+
+// Parses the comma separated auth-params of a single challenge.
+func parseAuthParams(rawParams string) (map[string]string, error) {
+	if len(rawParams) > 512 { // arbitrary length limit
+		return nil, fmt.Errorf("unexpected invalid auth params: %v", rawParams)
+	}
 
+	return parseAuthParamsUnlimited(rawParams)
+}
+
+// Parses the auth-params of a Digest Authorization header, allowed to be longer than challenges as
+// the uri param repeats the request target.
+func parseAuthorization(h string) (map[string]string, error) {
+	scheme, rawParams, _ := strings.Cut(strings.TrimSpace(h), " ")
+	if !strings.EqualFold(scheme, digestAuthSchemeDigest) || len(h) > 8192 { // arbitrary length limit
+		return nil, fmt.Errorf("unexpected invalid authorization header: %.32v", h)
+	}
+
+	return parseAuthParamsUnlimited(rawParams)
+}
+
+func parseAuthParamsUnlimited(rawParams string) (map[string]string, error) {
 	out := make(map[string]string)
 	var ps parserState = newParserStateParsingKey(out)
 
@@ -178,7 +199,8 @@ func parseWWWAuthenticate(h string) (map[string]string, error) {
 					goto parserFail
 				}
 
-				value := string(rawParamsRunes[s.start:pos])
+				// pos and start are byte offsets
+				value := rawParams[s.start:pos]
 				next, err := s.Next(value)
 
 				if err != nil {
@@ -256,9 +278,105 @@ func parseWWWAuthenticate(h string) (map[string]string, error) {
 		return nil, fmt.Errorf("unexpected character at pos %d, state %v: %c", pos, ps, char)
 	}
 
+	// an unquoted value ends with the string, e.g. `nonce="abc", algorithm=MD5`
+	if s, ok := ps.(*parserStateParsingToken); ok && s.ok {
+		next, err := s.Next(rawParams[s.start:])
+		if err != nil {
+			return nil, err
+		}
+
+		ps = next
+	}
+
 	if s, ok := ps.(*parserStateParsingDelimiter); !ok || s.Delim != ',' {
 		return nil, fmt.Errorf("parser finished at end of string in invalid state %v", ps)
 	}
 
 	return out, nil
 }
+
+type AuthChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// Splits a WWW-Authenticate header on the commas that are not within a quoted string.
+func splitAuthHeader(h string) []string {
+	var pieces []string
+	var quoted, escape bool
+	start := 0
+
+	for pos, char := range h {
+		switch {
+		case escape:
+			escape = false
+		case quoted && char == '\\':
+			escape = true
+		case char == '"':
+			quoted = !quoted
+		case !quoted && char == ',':
+			pieces = append(pieces, h[start:pos])
+			start = pos + 1
+		}
+	}
+
+	return append(pieces, h[start:])
+}
+
+// Parses every challenge of a WWW-Authenticate header, e.g.
+// `Basic realm="cam", Digest realm="cam", nonce="abc", algorithm=SHA-256`. A piece starting with
+// a token followed by '=' is a param of the current challenge, any other piece starts a new one.
+func parseAuthChallenges(h string) ([]AuthChallenge, error) {
+	if len(h) > 4096 { // arbitrary length limit
+		return nil, fmt.Errorf("unexpected invalid header: %v", h)
+	}
+
+	type rawChallenge struct {
+		scheme string
+		params []string
+	}
+	var raw []rawChallenge
+
+	for _, piece := range splitAuthHeader(h) {
+		piece = strings.TrimSpace(piece)
+		if piece == "" {
+			continue
+		}
+
+		token := piece
+		if end := strings.IndexAny(piece, " \t="); end != -1 {
+			token = piece[:end]
+		}
+		rest := strings.TrimSpace(piece[len(token):])
+
+		if strings.HasPrefix(rest, "=") {
+			if len(raw) == 0 {
+				return nil, fmt.Errorf("auth param without a scheme: %v", piece)
+			}
+			raw[len(raw)-1].params = append(raw[len(raw)-1].params, piece)
+			continue
+		}
+
+		challenge := rawChallenge{scheme: token}
+		if rest != "" {
+			challenge.params = append(challenge.params, rest)
+		}
+		raw = append(raw, challenge)
+	}
+
+	var challenges []AuthChallenge
+	for _, challenge := range raw {
+		params, err := parseAuthParams(strings.Join(challenge.params, ", "))
+		if err != nil {
+			if strings.EqualFold(challenge.scheme, digestAuthSchemeDigest) {
+				return nil, fmt.Errorf("invalid %v challenge: %w", challenge.scheme, err)
+			}
+			// params of other schemes, e.g. a token68, are not needed
+			params = map[string]string{}
+		}
+
+		challenges = append(challenges, AuthChallenge{Scheme: challenge.scheme, Params: params})
+	}
+
+	return challenges, nil
+}
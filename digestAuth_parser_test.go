@@ -86,3 +86,26 @@ func TestDigestAuthParser_Invalid(t *testing.T) {
 
 	}
 }
+
+func TestDigestAuthParser_MultipleChallenges(t *testing.T) {
+	input := `Basic realm="cam, \"1\"", Digest realm="cam", nonce="a,b", algorithm=SHA-256, Negotiate, ` +
+		`Digest  realm = "cam", nonce="c"`
+	expected := []AuthChallenge {
+		{Scheme: "Basic", Params: map[string]string{"realm": `cam, "1"`}},
+		{Scheme: "Digest", Params: map[string]string{"realm": "cam", "nonce": "a,b", "algorithm": "SHA-256"}},
+		{Scheme: "Negotiate", Params: map[string]string{}},
+		{Scheme: "Digest", Params: map[string]string{"realm": "cam", "nonce": "c"}},
+	}
+
+	if got, err := parseAuthChallenges(input); err != nil || !reflect.DeepEqual(expected, got) {
+		t.Fatalf("parseAuthChallenges(%q) = %v, %v - wanted %v", input, got, err, expected)
+	}
+}
+
+func TestDigestAuthParser_MultipleChallengesInvalid(t *testing.T) {
+	for _, input := range []string{`realm="cam", Basic`, `Digest realm="cam`} {
+		if got, err := parseAuthChallenges(input); err == nil {
+			t.Errorf("parseAuthChallenges(%q) = %v - wanted an error", input, got)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -8,7 +9,6 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -18,6 +18,9 @@ type DigestAuthNonceReusePolicy struct {
 	canReuse func(*url.URL, *DigestAuthState) bool
 }
 
+// arbitrary limit of the request body kept in memory to be replayed
+const digestAuthMaxBodySize = 16 << 20
+
 var (
 	ErrDigestAuthMissingCredentials = errors.New("credentials to perform digest authentication are missing")
 	DigestAuthNonceReuseAlways = DigestAuthNonceReusePolicy{func(u *url.URL, das *DigestAuthState) bool {
@@ -26,7 +29,6 @@ var (
 	DigestAuthNonceReuseNever = DigestAuthNonceReusePolicy{func(u *url.URL, das *DigestAuthState) bool {
 		return false
 	}}
-	perHostAuthStateCache sync.Map
 )
 
 func DigestAuthNonceReuseWithinTimeout(timeoutSeconds int) DigestAuthNonceReusePolicy {
@@ -41,6 +43,10 @@ type DigestAuthRequestor struct {
 	*http.Client
 	EnablePerHostAuthStateCache bool
 	NonceReusePolicy DigestAuthNonceReusePolicy
+	// Preference of the answered challenge, see digestAuthDefaultSchemes
+	Schemes []string
+	// States cache of this requestor only, digestAuthSharedCache when nil
+	Cache *DigestAuthStateCache
 	Hooks struct {
 		BeforePersistState func(context.Context, *DigestAuthState)
 	}
@@ -54,40 +60,121 @@ func NewDigestAuthRequestor(client *http.Client) *DigestAuthRequestor {
 	}
 }
 
-func challengeFromResponse(res *http.Response) (string, error) {
-	auth := strings.TrimSpace(res.Header.Get("www-authenticate"))
-	if res.StatusCode != http.StatusUnauthorized || auth == "" {
+func (r *DigestAuthRequestor) cache() *DigestAuthStateCache {
+	if r.Cache != nil {
+		return r.Cache
+	}
+	return digestAuthSharedCache
+}
+
+func (r *DigestAuthRequestor) challengeFromResponse(res *http.Response) (AuthChallenge, error) {
+	var challenges []AuthChallenge
+	var parseErr error
+	// challenges come in several headers, or comma joined in one
+	for _, auth := range res.Header.Values("www-authenticate") {
+		parsed, err := parseAuthChallenges(strings.TrimSpace(auth))
+		if err != nil {
+			// an invalid header does not prevent answering a valid one
+			parseErr = err
+			continue
+		}
+		challenges = append(challenges, parsed...)
+	}
+
+	if res.StatusCode != http.StatusUnauthorized || len(challenges) == 0 {
 		// unexpected non-OK status, croak
-		return "", fmt.Errorf("unexpected status (%v) or empty WWW-Authenticate header", res.Status)
+		if parseErr != nil {
+			return AuthChallenge{}, fmt.Errorf("unexpected status (%v) or invalid WWW-Authenticate header: %w", res.Status, parseErr)
+		}
+		return AuthChallenge{}, fmt.Errorf("unexpected status (%v) or empty WWW-Authenticate header", res.Status)
 	}
 
-	return auth, nil
+	return selectAuthChallenge(challenges, r.Schemes)
 }
 
-func (r *DigestAuthRequestor) retrieveChallenge(c context.Context, uri *url.URL) (string, *http.Response, error) {
-	if uri.User != nil {
-		panic("programmer error: DigestAuthRequestor.fetchAuthParams invoked with URL with credentials")
+// Replayable copy of a request, sent once to retrieve the challenge and once more to answer it.
+type digestAuthRequest struct {
+	orig *http.Request
+	body []byte
+}
+
+func newDigestAuthRequest(req *http.Request) (*digestAuthRequest, error) {
+	out := &digestAuthRequest{orig: req}
+	if req.Body == nil || req.Body == http.NoBody {
+		return out, nil
 	}
 
-	req, err := http.NewRequestWithContext(c, "GET", uri.String(), http.NoBody)
+	defer req.Body.Close()
+
+	// the body is kept in memory, it is sent twice and hashed with auth-int
+	body, err := io.ReadAll(io.LimitReader(req.Body, digestAuthMaxBodySize+1))
 	if err != nil {
-		return "", nil, fmt.Errorf("nonce mk request failed: %w", err)
+		return nil, fmt.Errorf("failed to read request body: %w", err)
 	}
-	res, err := r.Client.Do(req)
+	if len(body) > digestAuthMaxBodySize {
+		return nil, fmt.Errorf("request body exceeds %v bytes", digestAuthMaxBodySize)
+	}
+
+	out.body = body
+	return out, nil
+}
+
+// Builds a new request without the credentials of the URL, answering with `authorization` if set.
+func (d *digestAuthRequest) build(authorization string) *http.Request {
+	req := d.orig.Clone(d.orig.Context())
+	req.URL.User = nil
+
+	req.Body, req.GetBody, req.ContentLength = http.NoBody, nil, 0
+	if len(d.body) != 0 {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(d.body)), nil
+		}
+		req.Body, _ = req.GetBody()
+		req.ContentLength = int64(len(d.body))
+	}
+
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	} else {
+		req.Header.Del("Authorization")
+	}
+
+	return req
+}
+
+// Sends the request without credentials. Returns the challenge when the response is a 401, or the
+// response itself otherwise.
+func (r *DigestAuthRequestor) retrieveChallenge(d *digestAuthRequest) (*AuthChallenge, *http.Response, error) {
+	res, err := r.Client.Do(d.build(""))
 	if err != nil {
-		return "", nil, fmt.Errorf("nonce request failed: %w", err)
+		return nil, nil, fmt.Errorf("nonce request failed: %w", err)
 	}
 
-	if res.StatusCode >= 200 && res.StatusCode <= 299 {
-		// unexpected OK status, assume auth has been disabled
-		return "", res, nil
+	if res.StatusCode != http.StatusUnauthorized {
+		// no challenge, assume auth has been disabled or the server failed before checking it
+		return nil, res, nil
 	}
 
 	io.Copy(io.Discard, res.Body)
 	res.Body.Close()
 
-	challenge, err := challengeFromResponse(res)
-	return challenge, nil, err
+	challenge, err := r.challengeFromResponse(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &challenge, nil, nil
+}
+
+func (r *DigestAuthRequestor) requestBasic(d *digestAuthRequest, credentials *url.Userinfo) (*http.Response, error) {
+	req := d.build("")
+	pass, _ := credentials.Password()
+	req.SetBasicAuth(credentials.Username(), pass)
+
+	res, err := r.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	return res, nil
 }
 
 func (r *DigestAuthRequestor) Request(c context.Context, origUri url.URL) (*http.Response, error) {
@@ -96,101 +183,135 @@ func (r *DigestAuthRequestor) Request(c context.Context, origUri url.URL) (*http
 		return nil, ErrDigestAuthMissingCredentials
 	}
 
-	// zero out user info from the original url to retrieve the auth info
-	credentials := origUri.User
-	noCredsUri := origUri
-	noCredsUri.User = nil
+	req, err := http.NewRequestWithContext(c, "GET", origUri.String(), http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("mk request failed: %w", err)
+	}
+
+	return r.Do(req, origUri.User)
+}
+
+// Performs the request with any method and body, answering the challenge of the server with the
+// credentials. The credentials of the request URL are never sent as is.
+func (r *DigestAuthRequestor) Do(req *http.Request, credentials *url.Userinfo) (*http.Response, error) {
+	d, err := newDigestAuthRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.do(d, credentials)
+}
+
+func (r *DigestAuthRequestor) do(d *digestAuthRequest, credentials *url.Userinfo) (*http.Response, error) {
+	c := d.orig.Context()
+	uri := d.orig.URL
+	requestUri := uri.RequestURI()
 
 	var state *DigestAuthState
+	// whether the state comes from a challenge of this request rather than from the cache
+	var fresh bool
 
 	if r.EnablePerHostAuthStateCache {
-		if loaded, ok := perHostAuthStateCache.Load(origUri.Host); ok {
-			state = loaded.(*DigestAuthState)
+		state, _ = r.cache().Load(uri, credentials.Username(), func(loaded *DigestAuthState) bool {
+			loaded.mu.Lock()
+			defer loaded.mu.Unlock()
 
-			state.mu.Lock()
-			canReuse := r.NonceReusePolicy.canReuse != nil && r.NonceReusePolicy.canReuse(&origUri, state)
-			state.mu.Unlock()
-
-			if !canReuse {
-				perHostAuthStateCache.Delete(origUri.Host)
-				state = nil
-			}
-		}
+			return r.NonceReusePolicy.canReuse != nil && r.NonceReusePolicy.canReuse(uri, loaded)
+		})
 	}
 
 	// base case, no previous state -- need to fetch challenge
 	if state == nil {
-		challenge, response, err := r.retrieveChallenge(c, &noCredsUri)
+		challenge, response, err := r.retrieveChallenge(d)
 
 		if err != nil {
 			return nil, err
-		} else if challenge == "" {
+		} else if challenge == nil {
 			// no challenge = no auth
 			return response, nil
 		}
 
-		state, err = newDigestAuthStateFromChallenge(challenge)
-
-		if err != nil {
-			return nil, fmt.Errorf("failed to create a new digest auth state: %w", err)
+		if !strings.EqualFold(challenge.Scheme, digestAuthSchemeDigest) {
+			// Basic is the only other selectable scheme, it has no state to persist
+			return r.requestBasic(d, credentials)
 		}
+
+		state, fresh = newDigestAuthStateFromParams(challenge.Params), true
 	}
 
+	// a fresh state is answered again once when the server only found its nonce stale
+	staleRetried := false
+
 computeResponseAndFetch:
-	digestResponse, err := state.ComputeResponse(noCredsUri.RequestURI(), credentials)
+	digestResponse, err := state.ComputeResponseForRequest(d.orig.Method, requestUri, d.body, credentials)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compute digest response: %w", err)
 	}
 
 	// final req
-	req, err := http.NewRequestWithContext(c, "GET", noCredsUri.String(), http.NoBody)
-	if err != nil {
-		return nil, fmt.Errorf("mk request failed: %w", err)
-	}
-
-	req.Header.Add("Authorization", digestResponse)
-
-	res, err := r.Client.Do(req)
+	res, err := r.Client.Do(d.build(digestResponse))
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
 
-	if !r.EnablePerHostAuthStateCache { // if the cache is disabled, no nonce reusing is possible
-		goto end
-	}
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge, challengeErr := r.challengeFromResponse(res)
+		isDigest := challengeErr == nil && strings.EqualFold(challenge.Scheme, digestAuthSchemeDigest)
+		// stale=true: the credentials were right but the nonce expired, not an authentication failure
+		stale := isDigest && strings.EqualFold(challenge.Params[digestAuthParamStale], "true")
 
-	// We might have received an unauthorized state if the reuse attempt failed. Restart from
-	// scratch if this is the case.
-	if res.StatusCode == http.StatusUnauthorized && !state.IsFresh() {
+		// a fresh state rejected without stale=true means wrong credentials, return the 401
+		if fresh && (!stale || staleRetried) {
+			goto end
+		}
+
+		io.Copy(io.Discard, res.Body)
 		res.Body.Close()
 
-		if logger, ok := c.Value("logger").(*logrus.Entry); ok {
-			logger.Warn(
-				"digestAuth: state reuse attempt failed. If you see lots of these, you might want to " +
-				"tweak `nonce_reuse_timeout` or your server might not support state reusing",
-			)
+		// We might have received an unauthorized state if the reuse attempt failed. Restart from
+		// scratch if this is the case.
+		if !stale {
+			if logger, ok := c.Value("logger").(*logrus.Entry); ok {
+				logger.Warn(
+					"digestAuth: state reuse attempt failed. If you see lots of these, you might want to " +
+					"tweak `nonce_reuse_timeout` or your server might not support state reusing",
+				)
+			}
 		}
 
-		perHostAuthStateCache.Delete(origUri.Host)
+		if r.EnablePerHostAuthStateCache {
+			r.cache().Reject(state, stale)
+		}
 
 		// Attempt to get a new challenge from the response to avoid another roundtrip,
 		// or start from scratch.
-		if challenge, err := challengeFromResponse(res); err == nil {
-			state, err = newDigestAuthStateFromChallenge(challenge)
-			if err == nil {
-				// note: no risk of infinite looping here, state.IsFresh() is true.
-				goto computeResponseAndFetch
-			}
+		if isDigest {
+			staleRetried = staleRetried || fresh
+			state, fresh = newDigestAuthStateFromParams(challenge.Params), true
+			// note: no risk of infinite looping here, the new state is fresh and staleRetried
+			// prevents answering more than one stale nonce with a fresh state.
+			goto computeResponseAndFetch
 		}
 
 		// Failed to find a challenge, try again from scratch.
-		return r.Request(c, origUri)
-	} else if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return r.do(d, credentials)
+	}
+
+	if !r.EnablePerHostAuthStateCache { // if the cache is disabled, no nonce reusing is possible
+		goto end
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
 		if r.Hooks.BeforePersistState != nil {
 			r.Hooks.BeforePersistState(c, state)
 		}
 
-		perHostAuthStateCache.Store(origUri.Host, state)
+		// the server may hand out the nonce of the next request
+		if info, err := parseAuthParams(res.Header.Get("Authentication-Info")); err == nil && info[digestAuthParamNextNonce] != "" {
+			state.rotateNonce(info[digestAuthParamNextNonce])
+		}
+
+		r.cache().Store(uri, credentials.Username(), state)
 	}
 
 	end: return res, err
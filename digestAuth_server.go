@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	digestAuthServerNonceTimeout = 5 * time.Minute
+	// nonces answered by an authenticated client within their timeout, each one keeps its nonce counts
+	digestAuthServerMaxNonces = 4096
+	// nonce counts below the highest one seen minus this window are rejected as replays
+	digestAuthServerReplayWindow = 64
+	// unix nano issue time, random bytes, HMAC-SHA256 of both truncated to 16 bytes
+	digestAuthServerNonceSize = 8 + 8 + 16
+)
+
+var (
+	ErrDigestAuthUnauthorized = errors.New("digest authentication failed")
+	// the credentials are right but the nonce expired or was replayed, the client retries with
+	// the new nonce without prompting the user
+	ErrDigestAuthStaleNonce = errors.New("digest authentication nonce is stale")
+)
+
+// Algorithms offered by the server when none are configured, browsers without SHA-256 support
+// fall back to MD5.
+var digestAuthServerDefaultAlgorithms = []string{
+	digestAuthAlgoSha256,
+	digestAuthAlgoMd5,
+}
+
+// Server side of RFC 7616 for a single user. Nonces are signed rather than stored, only the nonce
+// counts of the nonces in use by authenticated clients are kept to reject replayed requests.
+type DigestAuthServer struct {
+	realm string
+	// offered in this order, e.g. ["sha-256", "md5"]
+	algorithms []string
+	nonceTimeout time.Duration
+	username string
+	password string
+	key []byte
+
+	mu sync.Mutex
+	nonces map[string]*digestAuthServerNonce
+}
+
+type digestAuthServerNonce struct {
+	expiresAt time.Time
+	highest uint64
+	// bit i is set once the nonce count highest-i was used
+	seen uint64
+}
+
+// Records a nonce count, false if it was already used or is too old to tell.
+func (n *digestAuthServerNonce) use(nonceCount uint64) bool {
+	switch {
+	case nonceCount > n.highest:
+		if shift := nonceCount - n.highest; shift >= digestAuthServerReplayWindow {
+			n.seen = 0
+		} else {
+			n.seen <<= shift
+		}
+		n.seen |= 1
+		n.highest = nonceCount
+		return true
+	case n.highest-nonceCount >= digestAuthServerReplayWindow:
+		return false
+	}
+
+	bit := uint64(1) << (n.highest - nonceCount)
+	if n.seen&bit != 0 {
+		return false
+	}
+	n.seen |= bit
+	return true
+}
+
+// Validates server algorithms, the digest algorithms of the default scheme preference.
+func validateDigestAuthServerAlgorithms(algorithms []string) error {
+	for _, algo := range algorithms {
+		if !containsFold(digestAuthDefaultSchemes, algo) {
+			return fmt.Errorf("unknown digest auth algorithm: %v", algo)
+		}
+	}
+	return nil
+}
+
+func NewDigestAuthServer(
+	realm string,
+	username string,
+	password string,
+	algorithms []string,
+	nonceTimeout time.Duration,
+) (*DigestAuthServer, error) {
+	if err := validateDigestAuthServerAlgorithms(algorithms); err != nil {
+		return nil, err
+	}
+	if len(algorithms) == 0 {
+		algorithms = digestAuthServerDefaultAlgorithms
+	}
+	if nonceTimeout <= 0 {
+		nonceTimeout = digestAuthServerNonceTimeout
+	}
+
+	// signs the nonces, the ones issued before a restart are answered as stale
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to fill nonce key: %w", err)
+	}
+
+	server := &DigestAuthServer{
+		realm: realm,
+		nonceTimeout: nonceTimeout,
+		// the challenges announce charset=UTF-8, clients hash NFC normalized credentials
+		username: norm.NFC.String(username),
+		password: norm.NFC.String(password),
+		key: key,
+		nonces: make(map[string]*digestAuthServerNonce),
+	}
+	for _, algo := range algorithms {
+		server.algorithms = append(server.algorithms, strings.ToLower(algo))
+	}
+	return server, nil
+}
+
+func (server *DigestAuthServer) nonceMac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, server.key)
+	mac.Write(payload)
+	return mac.Sum(nil)[:digestAuthServerNonceSize-16]
+}
+
+func (server *DigestAuthServer) newNonce(now time.Time) (string, error) {
+	buf := make([]byte, 16, digestAuthServerNonceSize)
+	binary.BigEndian.PutUint64(buf, uint64(now.UnixNano()))
+	if _, err := rand.Read(buf[8:]); err != nil {
+		return "", fmt.Errorf("failed to fill nonce: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(append(buf, server.nonceMac(buf)...)), nil
+}
+
+// Issue time of a nonce signed by this server, false for foreign or expired nonces.
+func (server *DigestAuthServer) checkNonce(nonce string, now time.Time) (time.Time, bool) {
+	buf, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(buf) != digestAuthServerNonceSize {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(buf[16:], server.nonceMac(buf[:16])) {
+		return time.Time{}, false
+	}
+
+	issuedAt := time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	return issuedAt, now.Before(issuedAt.Add(server.nonceTimeout))
+}
+
+// Records the nonce count of a valid nonce, false for replays.
+func (server *DigestAuthServer) useNonce(nonce string, issuedAt time.Time, nonceCount uint64, now time.Time) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	entry, ok := server.nonces[nonce]
+	if !ok {
+		for key, other := range server.nonces {
+			if !now.Before(other.expiresAt) {
+				delete(server.nonces, key)
+			}
+		}
+		// forgetting the counts of a nonce still valid would allow replaying it, the client
+		// is told to retry once a nonce expires instead
+		if len(server.nonces) >= digestAuthServerMaxNonces {
+			return false
+		}
+
+		entry = &digestAuthServerNonce{expiresAt: issuedAt.Add(server.nonceTimeout)}
+		server.nonces[nonce] = entry
+	}
+	return entry.use(nonceCount)
+}
+
+// Sets one WWW-Authenticate challenge per algorithm, in order of preference.
+func (server *DigestAuthServer) Challenge(header http.Header, stale bool) error {
+	nonce, err := server.newNonce(time.Now())
+	if err != nil {
+		return err
+	}
+
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+	for _, algo := range server.algorithms {
+		challenge := fmt.Sprintf(
+			`%v realm="%v", qop="%v", algorithm=%v, nonce="%v", charset=%v`,
+			digestAuthSchemeDigest, quote(server.realm), digestAuthQopAuth, strings.ToUpper(algo), nonce,
+			digestAuthCharsetUtf8,
+		)
+		if stale {
+			challenge += ", " + digestAuthParamStale + "=true"
+		}
+		header.Add("WWW-Authenticate", challenge)
+	}
+	return nil
+}
+
+// Username of the Authorization header, hashed with userhash or RFC 5987 encoded as username*.
+func digestAuthServerUsername(params map[string]string) (string, error) {
+	if ext, ok := params[digestAuthParamUsernameExt]; ok {
+		const prefix = "utf-8''"
+		if len(ext) < len(prefix) || !strings.EqualFold(ext[:len(prefix)], prefix) {
+			return "", fmt.Errorf("unsupported %v encoding: %v", digestAuthParamUsernameExt, ext)
+		}
+		return url.PathUnescape(ext[len(prefix):])
+	}
+	return params[digestAuthParamUsername], nil
+}
+
+// Verifies the Digest Authorization header of the request, ErrDigestAuthStaleNonce asks for a
+// new challenge with stale=true. Returns the Authentication-Info header value, a nextnonce once
+// half of the nonce timeout elapsed.
+func (server *DigestAuthServer) Authenticate(req *http.Request) (string, error) {
+	h := req.Header.Get("Authorization")
+	if h == "" {
+		return "", ErrDigestAuthUnauthorized
+	}
+	params, err := parseAuthorization(h)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrDigestAuthUnauthorized, err)
+	}
+
+	algo := strings.ToLower(params[digestAuthParamAlgorithm])
+	if algo == digestAuthAlgoUnspecified {
+		algo = digestAuthAlgoMd5
+	}
+	if !containsFold(server.algorithms, algo) {
+		return "", fmt.Errorf("%w: algorithm not offered: %v", ErrDigestAuthUnauthorized, algo)
+	}
+	mkHash, _ := digestAuthHash(algo)
+
+	if params[digestAuthParamRealm] != server.realm {
+		return "", fmt.Errorf("%w: unknown realm", ErrDigestAuthUnauthorized)
+	}
+
+	// only auth is offered, auth-int would require buffering every request body
+	if !strings.EqualFold(params[digestAuthParamQop], digestAuthQopAuth) || params[digestAuthParamClientNonce] == "" {
+		return "", fmt.Errorf("%w: qop=auth with a cnonce is required", ErrDigestAuthUnauthorized)
+	}
+	nonceCount, err := strconv.ParseUint(params[digestAuthParamNonceCount], 16, 32)
+	if err != nil || nonceCount == 0 {
+		return "", fmt.Errorf("%w: invalid nonce count", ErrDigestAuthUnauthorized)
+	}
+
+	// the uri param must be the request target, or a captured header would authorize other paths
+	requestUri := req.RequestURI
+	if requestUri == "" {
+		requestUri = req.URL.RequestURI()
+	}
+	if params[digestAuthParamUri] != requestUri {
+		return "", fmt.Errorf("%w: uri does not match the request", ErrDigestAuthUnauthorized)
+	}
+
+	username, err := digestAuthServerUsername(params)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrDigestAuthUnauthorized, err)
+	}
+	expectedUsername := server.username
+	if strings.EqualFold(params[digestAuthParamUserhash], "true") {
+		// username = H(username:realm)
+		expectedUsername = mkHash(fmt.Sprintf("%v:%v", server.username, server.realm))
+	}
+	if subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) != 1 {
+		return "", fmt.Errorf("%w: unknown user", ErrDigestAuthUnauthorized)
+	}
+
+	nonce := params[digestAuthParamNonce]
+	response := computeDigestAuthResponse(mkHash, digestAuthResponseInput{
+		username: server.username,
+		realm: server.realm,
+		password: server.password,
+		nonce: nonce,
+		nonceCount: params[digestAuthParamNonceCount],
+		cnonce: params[digestAuthParamClientNonce],
+		qop: digestAuthQopAuth,
+		method: req.Method,
+		uri: requestUri,
+	})
+	if subtle.ConstantTimeCompare([]byte(params[digestAuthParamResponse]), []byte(response)) != 1 {
+		return "", fmt.Errorf("%w: wrong response", ErrDigestAuthUnauthorized)
+	}
+
+	now := time.Now()
+	issuedAt, ok := server.checkNonce(nonce, now)
+	if !ok || !server.useNonce(nonce, issuedAt, nonceCount, now) {
+		return "", ErrDigestAuthStaleNonce
+	}
+
+	if now.Sub(issuedAt) < server.nonceTimeout/2 {
+		return "", nil
+	}
+	nextNonce, err := server.newNonce(now)
+	if err != nil {
+		return "", nil
+	}
+	return fmt.Sprintf(`%v="%v"`, digestAuthParamNextNonce, nextNonce), nil
+}
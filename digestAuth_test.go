@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RFC 7616 section 3.9.1
+const (
+	rfc7616Realm = "http-auth@example.org"
+	rfc7616Nonce = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+	rfc7616ClientNonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+	rfc7616Opaque = "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"
+)
+
+func withClientNonce(t *testing.T, cnonce string) {
+	saved := digestAuthClientNonce
+	digestAuthClientNonce = func() (string, error) {
+		return cnonce, nil
+	}
+	t.Cleanup(func() {
+		digestAuthClientNonce = saved
+	})
+}
+
+func computeDigestResponse(t *testing.T, challenge, uri string, credentials *url.Userinfo) map[string]string {
+	challenges, err := parseAuthChallenges(challenge)
+	if err != nil || len(challenges) != 1 {
+		t.Fatalf("parseAuthChallenges(%q) = %v, %v", challenge, challenges, err)
+	}
+
+	auth, err := newDigestAuthStateFromParams(challenges[0].Params).ComputeResponse(uri, credentials)
+	if err != nil {
+		t.Fatalf("ComputeResponse(%q) = %v", uri, err)
+	}
+
+	params, err := parseWWWAuthenticate(auth)
+	if err != nil {
+		t.Fatalf("parseWWWAuthenticate(%q) = %v", auth, err)
+	}
+	return params
+}
+
+func TestDigestAuth_RFC7616(t *testing.T) {
+	withClientNonce(t, rfc7616ClientNonce)
+
+	tests := []struct {
+		algorithm string
+		response string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+
+	for _, test := range tests {
+		challenge := `Digest realm="` + rfc7616Realm + `", qop="auth, auth-int", algorithm=` + test.algorithm +
+			`, nonce="` + rfc7616Nonce + `", opaque="` + rfc7616Opaque + `"`
+		params := computeDigestResponse(t, challenge, "/dir/index.html", url.UserPassword("Mufasa", "Circle of Life"))
+
+		if params[digestAuthParamResponse] != test.response {
+			t.Errorf("%v response = %q - wanted %q", test.algorithm, params[digestAuthParamResponse], test.response)
+		}
+		if params[digestAuthParamQop] != digestAuthQopAuth || params[digestAuthParamNonceCount] != "00000001" ||
+			params[digestAuthParamClientNonce] != rfc7616ClientNonce || params["opaque"] != rfc7616Opaque {
+			t.Errorf("%v unexpected authorization params %v", test.algorithm, params)
+		}
+	}
+}
+
+// Inputs of RFC 7616 section 3.9.2. The published response and userhash of that example cannot be
+// reproduced by any implementation, the expected value is computed with Python hashlib sha512_256.
+func TestDigestAuth_RFC7616_SHA512256(t *testing.T) {
+	withClientNonce(t, "NTg6RKcb9boFIAS3KrFK9BGeh+iDa/sm6jUMp2wds69v")
+
+	challenge := `Digest realm="api@example.org", qop="auth", algorithm=SHA-512-256, ` +
+		`nonce="5TsQWLVdgBdmrQ0XsxbDODV+57QdFR34I9HAbC/RVvkK", opaque="HRPCssKJSGjCrkzDg8OhwpzCiGPChXYjwrI2QmXDnsOS"`
+	params := computeDigestResponse(t, challenge, "/doe.json", url.UserPassword("Jäsøn Doe", "Secret, or not?"))
+
+	expected := "3798d4131c277846293534c3edc11bd8a5e4cdcbff78b05db9d95eeb1cec68a5"
+	if params[digestAuthParamResponse] != expected {
+		t.Fatalf("response = %q - wanted %q", params[digestAuthParamResponse], expected)
+	}
+}
+
+func TestDigestAuth_SelectChallenge(t *testing.T) {
+	challenges := []AuthChallenge{
+		{Scheme: "Basic", Params: map[string]string{"realm": "cam"}},
+		{Scheme: "Digest", Params: map[string]string{"nonce": "a", "algorithm": "MD5"}},
+		{Scheme: "Digest", Params: map[string]string{"nonce": "b", "algorithm": "SHA-512-256-sess"}},
+		{Scheme: "Digest", Params: map[string]string{"nonce": "c", "algorithm": "SHA-256"}},
+		{Scheme: "Digest", Params: map[string]string{"nonce": "d", "algorithm": "UNKNOWN"}},
+	}
+
+	tests := []struct {
+		schemes []string
+		expected int
+	}{
+		{nil, 2},
+		{[]string{"md5", "sha-256"}, 1},
+		{[]string{"BASIC", "sha-256"}, 0},
+	}
+
+	for _, test := range tests {
+		if got, err := selectAuthChallenge(challenges, test.schemes); err != nil || !reflect.DeepEqual(got, challenges[test.expected]) {
+			t.Errorf("selectAuthChallenge(%q) = %v, %v - wanted %v", test.schemes, got, err, challenges[test.expected])
+		}
+	}
+
+	// Basic is never answered unless listed
+	if got, err := selectAuthChallenge(challenges[:1], nil); err == nil {
+		t.Fatalf("selectAuthChallenge() = %v - wanted an error for Basic without opt-in", got)
+	}
+	if got, err := selectAuthChallenge(challenges[:1], []string{"sha-256", "basic"}); err != nil || got.Scheme != "Basic" {
+		t.Fatalf("selectAuthChallenge() = %v, %v - wanted the listed Basic challenge", got, err)
+	}
+	if err := validateAuthSchemes([]string{"md5", "Basic"}); err != nil {
+		t.Errorf("validateAuthSchemes() = %v", err)
+	}
+
+	if got, err := selectAuthChallenge(challenges[4:], nil); err == nil {
+		t.Fatalf("selectAuthChallenge() = %v - wanted an error for an unsupported algorithm", got)
+	}
+}
+
+func TestDigestAuth_TransportReplaysBody(t *testing.T) {
+	withClientNonce(t, rfc7616ClientNonce)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "<state>on</state>" {
+			t.Errorf("%v %v body = %q", r.Method, r.URL, body)
+		}
+
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			w.Header().Add("WWW-Authenticate", `Digest realm="cam", nonce="abc", qop="auth-int", algorithm=SHA-256`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// computed with Python hashlib, HA2 = H(PUT:/io?port=1:H(<state>on</state>))
+		params, err := parseWWWAuthenticate(auth)
+		if err != nil || params[digestAuthParamResponse] != "14af4c921fe7c0ab2f5ecf7cd63aa63a47fa25dd13ca0049c2644880de84f0ca" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	transport := NewDigestAuthTransport(nil, url.UserPassword("admin", "secret"))
+	transport.Requestor.EnablePerHostAuthStateCache = false
+	client := &http.Client{Transport: transport}
+
+	req, _ := http.NewRequest("PUT", server.URL+"/io?port=1", strings.NewReader("<state>on</state>"))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("PUT failed: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %v - wanted %v", res.StatusCode, http.StatusNoContent)
+	}
+}
+
+func TestDigestAuth_StateCache(t *testing.T) {
+	cache := NewDigestAuthStateCache(2, time.Hour)
+	always := func(*DigestAuthState) bool { return true }
+	uri, _ := url.Parse("http://cam/ISAPI/Streaming/channels/101/picture")
+
+	admin := newDigestAuthStateFromParams(map[string]string{"realm": "cam", "nonce": "a"})
+	viewer := newDigestAuthStateFromParams(map[string]string{"realm": "cam", "nonce": "b"})
+	cache.Store(uri, "admin", admin)
+	cache.Store(uri, "viewer", viewer)
+
+	if got, ok := cache.Load(uri, "admin", always); !ok || got != admin {
+		t.Fatalf("Load(admin) = %v, %v - wanted the admin state", got, ok)
+	}
+
+	// viewer is the least recently used entry
+	other := newDigestAuthStateFromParams(map[string]string{"realm": "other", "nonce": "c"})
+	cache.Store(uri, "admin", other)
+	if got, ok := cache.Load(uri, "viewer", always); ok {
+		t.Fatalf("Load(viewer) = %v - wanted the evicted entry missing", got)
+	}
+
+	cache.Reject(other, false)
+	if got, ok := cache.Load(uri, "admin", always); !ok || got != admin {
+		t.Fatalf("Load(admin) = %v, %v - wanted the admin state of the remaining realm", got, ok)
+	}
+	if got, ok := cache.Load(uri, "admin", func(*DigestAuthState) bool { return false }); ok {
+		t.Fatalf("Load(admin) = %v - wanted no state once the policy refuses it", got)
+	}
+
+	entries := cache.Entries()
+	if len(entries) != 2 || entries[0].Realm != "cam" || entries[0].Reuses != 2 || entries[0].Valid ||
+		entries[1].Realm != "other" || entries[1].Failures != 1 {
+		t.Fatalf("Entries() = %+v", entries)
+	}
+}
+
+// Camera accepting any digest response to its current nonce, recording the nonce and nonce count
+// answered by each request, "" for requests without credentials.
+type digestAuthTestCamera struct {
+	mu sync.Mutex
+	issued int
+	nonce string
+	// answers every nonce as stale, or every request as unauthorized as with a changed password
+	stale bool
+	unauthorized bool
+	// hands out a new nonce in the Authentication-Info header of each response
+	nextNonce bool
+	answered []string
+}
+
+func (cam *digestAuthTestCamera) rotate() string {
+	cam.issued++
+	cam.nonce = fmt.Sprintf("n%v", cam.issued)
+	return cam.nonce
+}
+
+func (cam *digestAuthTestCamera) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cam.mu.Lock()
+	defer cam.mu.Unlock()
+
+	challenge := func(stale bool) {
+		value := `Digest realm="cam", qop="auth", algorithm=MD5, nonce="` + cam.nonce + `"`
+		if stale {
+			value += ", stale=true"
+		}
+		w.Header().Set("WWW-Authenticate", value)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	params, err := parseWWWAuthenticate(r.Header.Get("Authorization"))
+	if err != nil {
+		cam.answered = append(cam.answered, "")
+		challenge(false)
+		return
+	}
+	cam.answered = append(cam.answered, params[digestAuthParamNonce]+"/"+params[digestAuthParamNonceCount])
+
+	switch {
+	case cam.unauthorized:
+		challenge(false)
+	case cam.stale:
+		cam.rotate()
+		challenge(true)
+	case params[digestAuthParamNonce] != cam.nonce:
+		challenge(true)
+	case cam.nextNonce:
+		w.Header().Set("Authentication-Info", `nextnonce="`+cam.rotate()+`"`)
+	}
+}
+
+func (cam *digestAuthTestCamera) Answered() []string {
+	cam.mu.Lock()
+	defer cam.mu.Unlock()
+
+	answered := cam.answered
+	cam.answered = nil
+	return answered
+}
+
+func newDigestAuthTestRequestor(t *testing.T, cam *digestAuthTestCamera) (*DigestAuthRequestor, func() int) {
+	cam.rotate()
+	server := httptest.NewServer(cam)
+	t.Cleanup(server.Close)
+
+	requestor := NewDigestAuthRequestor(server.Client())
+	requestor.NonceReusePolicy = DigestAuthNonceReuseAlways
+	requestor.Cache = NewDigestAuthStateCache(8, time.Hour)
+
+	uri, _ := url.Parse(server.URL + "/snapshot")
+	uri.User = url.UserPassword("admin", "secret")
+	return requestor, func() int {
+		res, err := requestor.Request(context.Background(), *uri)
+		if err != nil {
+			t.Fatalf("Request() = %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+}
+
+func TestDigestAuth_RequestorStaleNonce(t *testing.T) {
+	cam := &digestAuthTestCamera{}
+	requestor, request := newDigestAuthTestRequestor(t, cam)
+
+	if status := request(); status != http.StatusOK {
+		t.Fatalf("first request = %v", status)
+	}
+	cam.Answered()
+
+	// the cached nonce expired, the stale challenge is answered without asking for another one
+	cam.rotate()
+	if status := request(); status != http.StatusOK {
+		t.Fatalf("request with an expired nonce = %v", status)
+	}
+	if answered := cam.Answered(); !reflect.DeepEqual(answered, []string{"n1/00000002", "n2/00000001"}) {
+		t.Errorf("answered = %v - wanted the stale nonce then the new one", answered)
+	}
+	entries := requestor.Cache.Entries()
+	if len(entries) != 1 || entries[0].Stale != 1 || entries[0].Failures != 0 || !entries[0].Valid {
+		t.Errorf("Entries() = %+v - wanted one stale nonce and no failure", entries)
+	}
+
+	// a fresh nonce answered as stale again is retried only once
+	cam.stale = true
+	if status := request(); status != http.StatusUnauthorized {
+		t.Fatalf("request to a camera answering every nonce as stale = %v", status)
+	}
+	if answered := cam.Answered(); !reflect.DeepEqual(answered, []string{"n2/00000002", "n3/00000001", "n4/00000001"}) {
+		t.Errorf("answered = %v - wanted a single retry of the fresh nonce", answered)
+	}
+}
+
+func TestDigestAuth_RequestorNextNonce(t *testing.T) {
+	cam := &digestAuthTestCamera{nextNonce: true}
+	_, request := newDigestAuthTestRequestor(t, cam)
+
+	for i := 0; i < 3; i++ {
+		if status := request(); status != http.StatusOK {
+			t.Fatalf("request %v = %v", i, status)
+		}
+	}
+	// the nonce count starts over with each nextnonce, no request goes out without credentials
+	answered := cam.Answered()
+	if !reflect.DeepEqual(answered, []string{"", "n1/00000001", "n2/00000001", "n3/00000001"}) {
+		t.Errorf("answered = %v - wanted each nextnonce used once", answered)
+	}
+}
+
+func TestDigestAuth_RequestorFailure(t *testing.T) {
+	cam := &digestAuthTestCamera{}
+	requestor, request := newDigestAuthTestRequestor(t, cam)
+
+	if status := request(); status != http.StatusOK {
+		t.Fatalf("first request = %v", status)
+	}
+	cam.Answered()
+
+	cam.unauthorized = true
+	if status := request(); status != http.StatusUnauthorized {
+		t.Fatalf("request with wrong credentials = %v", status)
+	}
+	// the cached state is rejected, the challenge of the 401 is answered once
+	if answered := cam.Answered(); !reflect.DeepEqual(answered, []string{"n1/00000002", "n1/00000001"}) {
+		t.Errorf("answered = %v", answered)
+	}
+	entries := requestor.Cache.Entries()
+	if len(entries) != 1 || entries[0].Failures != 1 || entries[0].Stale != 0 || entries[0].Valid {
+		t.Errorf("Entries() = %+v - wanted one failure", entries)
+	}
+}
+
+func TestDigestAuth_RequestorBasic(t *testing.T) {
+	var authorizations []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cam"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	requestor := NewDigestAuthRequestor(server.Client())
+	requestor.Cache = NewDigestAuthStateCache(8, time.Hour)
+	uri, _ := url.Parse(server.URL + "/snapshot")
+	uri.User = url.UserPassword("admin", "secret")
+
+	// the password is not sent in clear text without opt-in
+	if res, err := requestor.Request(context.Background(), *uri); err == nil {
+		res.Body.Close()
+		t.Fatalf("Request() = %v - wanted an error with the default schemes", res.Status)
+	}
+
+	requestor.Schemes = []string{"sha-256", "md5", "basic"}
+	res, err := requestor.Request(context.Background(), *uri)
+	if err != nil {
+		t.Fatalf("Request() = %v", err)
+	}
+	res.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if res.StatusCode != http.StatusOK || len(authorizations) != 3 || authorizations[0] != "" || authorizations[1] != "" ||
+		!strings.HasPrefix(authorizations[2], "Basic ") {
+		t.Errorf("status = %v, authorizations = %q - wanted the Basic challenge answered", res.StatusCode, authorizations)
+	}
+	if entries := requestor.Cache.Entries(); len(entries) != 0 {
+		t.Errorf("Entries() = %+v - wanted no state stored for Basic", entries)
+	}
+}
+
+func TestDigestAuth_UsernameEncoding(t *testing.T) {
+	credentials := url.UserPassword("Jäsøn Doe", "Secret, or not?")
+	challenge := `Digest realm="api@example.org", nonce="abc", algorithm=SHA-256, charset=UTF-8`
+
+	params := computeDigestResponse(t, challenge, "/doe.json", credentials)
+	if params[digestAuthParamUsernameExt] != "UTF-8''J%C3%A4s%C3%B8n%20Doe" || params[digestAuthParamUsername] != "" {
+		t.Errorf("charset=UTF-8 username params = %v", params)
+	}
+
+	params = computeDigestResponse(t, challenge+", userhash=true", "/doe.json", credentials)
+	sum := sha256.Sum256([]byte("Jäsøn Doe:api@example.org"))
+	if params[digestAuthParamUsername] != hex.EncodeToString(sum[:]) || params[digestAuthParamUserhash] != "true" {
+		t.Errorf("userhash=true username params = %v", params)
+	}
+}
+
+func TestDigestAuth_Server(t *testing.T) {
+	credentials := url.UserPassword("Jäsøn Doe", "Secret, or not?")
+	server, err := NewDigestAuthServer("RTSPtoWeb", "Jäsøn Doe", "Secret, or not?", []string{"sha-256", "md5"}, 0)
+	if err != nil {
+		t.Fatalf("NewDigestAuthServer() = %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := server.Authenticate(r); err != nil {
+			server.Challenge(w.Header(), errors.Is(err, ErrDigestAuthStaleNonce))
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: NewDigestAuthTransport(nil, credentials)}
+	for i := 0; i < 2; i++ {
+		res, err := client.Post(ts.URL+"/streams?page=2", "text/plain", strings.NewReader("body"))
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("request %v = %v, %v", i, res, err)
+		}
+	}
+
+	header := http.Header{}
+	server.Challenge(header, false)
+	challenges, err := parseAuthChallenges(strings.Join(header.Values("WWW-Authenticate"), ", "))
+	if err != nil || len(challenges) != 2 || challenges[1].Params[digestAuthParamAlgorithm] != "MD5" {
+		t.Fatalf("Challenge() = %v, %v", challenges, err)
+	}
+
+	state := newDigestAuthStateFromParams(challenges[0].Params)
+	auth, err := state.ComputeResponse("/streams", credentials)
+	if err != nil {
+		t.Fatalf("ComputeResponse() = %v", err)
+	}
+	req := httptest.NewRequest("GET", "/streams", nil)
+	req.Header.Set("Authorization", auth)
+	if _, err := server.Authenticate(req); err != nil {
+		t.Fatalf("Authenticate() = %v", err)
+	}
+	if _, err := server.Authenticate(req); !errors.Is(err, ErrDigestAuthStaleNonce) {
+		t.Errorf("Authenticate() of a replayed request = %v - wanted a stale nonce", err)
+	}
+
+	req = httptest.NewRequest("GET", "/streams/other", nil)
+	req.Header.Set("Authorization", auth)
+	if _, err := server.Authenticate(req); !errors.Is(err, ErrDigestAuthUnauthorized) {
+		t.Errorf("Authenticate() of another uri = %v - wanted a failure", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// http.RoundTripper performing digest auth (or Basic, see DigestAuthRequestor.Schemes) for any
+// method and body. Redirects are left to the client using the transport.
+type DigestAuthTransport struct {
+	Requestor *DigestAuthRequestor
+	// Credentials used for every request, the userinfo of the request URL is used when nil.
+	// Prefer setting them here: http.Client sends the userinfo of the URL as Basic auth.
+	Credentials *url.Userinfo
+}
+
+func NewDigestAuthTransport(next http.RoundTripper, credentials *url.Userinfo) *DigestAuthTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &DigestAuthTransport{
+		Requestor: NewDigestAuthRequestor(&http.Client{
+			Transport: next,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}),
+		Credentials: credentials,
+	}
+}
+
+func (t *DigestAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	credentials := t.Credentials
+	if credentials == nil {
+		credentials = req.URL.User
+	}
+
+	if credentials == nil {
+		// nothing to authenticate with
+		return t.Requestor.Client.Transport.RoundTrip(req)
+	}
+
+	return t.Requestor.Do(req, credentials)
+}
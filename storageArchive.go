@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Default snapshot archive options
+const (
+	archiveDefaultDirectory = "snapshots"
+	archiveDefaultInterval  = 60
+	archiveFileLayout       = "15-04-05"
+	archiveFileExt          = ".jpg"
+	archiveWindowLayout     = "15:04"
+)
+
+//ArchiveImageST one archived snapshot file
+type ArchiveImageST struct {
+	File  string    `json:"file"`
+	Time  time.Time `json:"time"`
+	Bytes int64     `json:"bytes"`
+}
+
+//ArchiveDirectory channel snapshot archive directory
+func ArchiveDirectory(cfg ArchiveST, streamID string, channelID string) string {
+	directory := cfg.Directory
+	if directory == "" {
+		directory = archiveDefaultDirectory
+	}
+	return filepath.Join(filepath.Clean(directory), filepath.Base(streamID), filepath.Base(channelID))
+}
+
+//ArchiveImagePath relative path of a snapshot taken at the given time, laid out by date
+func ArchiveImagePath(at time.Time) string {
+	at = at.UTC()
+	return filepath.Join(at.Format(recordDateLayout), at.Format(archiveFileLayout)+archiveFileExt)
+}
+
+//ArchiveList archived snapshots of [start,end] sorted by time, zero times leave the range open
+func ArchiveList(directory string, start time.Time, end time.Time) ([]ArchiveImageST, error) {
+	dates, err := os.ReadDir(directory)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []ArchiveImageST{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	images := []ArchiveImageST{}
+	for _, date := range dates {
+		day, err := time.Parse(recordDateLayout, date.Name())
+		if err != nil || !date.IsDir() {
+			continue
+		}
+		// skip whole days outside of the range
+		if (!start.IsZero() && day.Add(24*time.Hour).Before(start)) || (!end.IsZero() && day.After(end)) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(directory, date.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(file.Name(), archiveFileExt)
+			if name == file.Name() {
+				continue
+			}
+			at, err := time.Parse(recordDateLayout+" "+archiveFileLayout, date.Name()+" "+name)
+			if err != nil {
+				continue
+			}
+			if (!start.IsZero() && at.Before(start)) || (!end.IsZero() && at.After(end)) {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil {
+				continue
+			}
+			images = append(images, ArchiveImageST{File: filepath.Join(date.Name(), file.Name()), Time: at, Bytes: info.Size()})
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Time.Before(images[j].Time)
+	})
+	return images, nil
+}
+
+//ArchiveWindow daily capture window, both zero when snapshots are taken all day
+func ArchiveWindow(cfg ArchiveST) (time.Duration, time.Duration, error) {
+	if cfg.Start == "" && cfg.End == "" {
+		return 0, 0, nil
+	}
+	var window [2]time.Duration
+	for i, val := range []string{cfg.Start, cfg.End} {
+		at, err := time.Parse(archiveWindowLayout, val)
+		if err != nil {
+			return 0, 0, errors.New("archive start and end must both be set as HH:MM")
+		}
+		window[i] = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+	}
+	return window[0], window[1], nil
+}
+
+//ArchiveInWindow check the local time of day is inside the capture window, which may span midnight
+func ArchiveInWindow(at time.Time, start time.Duration, end time.Duration) bool {
+	if start == end {
+		return true
+	}
+	// wall clock time, the time elapsed since midnight is an hour off on daylight saving days
+	offset := time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute + time.Duration(at.Second())*time.Second
+	if start < end {
+		return offset >= start && offset < end
+	}
+	return offset >= start || offset < end
+}
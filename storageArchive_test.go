@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchive_List(t *testing.T) {
+	directory := t.TempDir()
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, at := range []time.Time{
+		day.Add(23*time.Hour + 59*time.Minute),
+		day.Add(10 * time.Hour),
+		day.Add(24*time.Hour + time.Minute),
+		day.Add(48 * time.Hour),
+	} {
+		writeArchiveImage(t, directory, at, []byte("jpeg"))
+	}
+	// files and directories which are not archived snapshots are ignored
+	for _, name := range []string{"2024-01-01/10-00-00.jpg.tmp", "2024-01-01/noon.jpg", "thumbs/10-00-00.jpg"} {
+		os.MkdirAll(filepath.Join(directory, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(directory, name), nil, 0644)
+	}
+
+	tests := []struct {
+		name     string
+		start    time.Time
+		end      time.Time
+		expected []string
+	}{
+		{"open range, sorted across days", time.Time{}, time.Time{},
+			[]string{"2024-01-01/10-00-00.jpg", "2024-01-01/23-59-00.jpg", "2024-01-02/00-01-00.jpg", "2024-01-03/00-00-00.jpg"}},
+		{"range spanning midnight", day.Add(23 * time.Hour), day.Add(25 * time.Hour),
+			[]string{"2024-01-01/23-59-00.jpg", "2024-01-02/00-01-00.jpg"}},
+		{"bounds are inclusive", day.Add(10 * time.Hour), day.Add(48 * time.Hour),
+			[]string{"2024-01-01/10-00-00.jpg", "2024-01-01/23-59-00.jpg", "2024-01-02/00-01-00.jpg", "2024-01-03/00-00-00.jpg"}},
+		{"open start", time.Time{}, day.Add(11 * time.Hour), []string{"2024-01-01/10-00-00.jpg"}},
+		{"open end", day.Add(24 * time.Hour), time.Time{}, []string{"2024-01-02/00-01-00.jpg", "2024-01-03/00-00-00.jpg"}},
+		{"empty range", day.Add(11 * time.Hour), day.Add(12 * time.Hour), nil},
+	}
+	for _, test := range tests {
+		images, err := ArchiveList(directory, test.start, test.end)
+		if err != nil {
+			t.Fatalf("%v: ArchiveList() = %v", test.name, err)
+		}
+		var got []string
+		for _, image := range images {
+			got = append(got, filepath.ToSlash(image.File))
+		}
+		if len(got) != len(test.expected) {
+			t.Errorf("%v: ArchiveList() = %v - wanted %v", test.name, got, test.expected)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.expected[i] || images[i].Bytes != 4 {
+				t.Errorf("%v: ArchiveList() = %v - wanted %v", test.name, got, test.expected)
+				break
+			}
+		}
+	}
+
+	if images, err := ArchiveList(filepath.Join(directory, "missing"), time.Time{}, time.Time{}); err != nil || len(images) != 0 {
+		t.Errorf("ArchiveList() of a missing directory = %v, %v - wanted no image", images, err)
+	}
+}
+
+func TestArchive_Window(t *testing.T) {
+	tests := []struct {
+		start   string
+		end     string
+		inside  []string
+		outside []string
+	}{
+		{"", "", []string{"00:00", "12:00", "23:59"}, nil},
+		{"08:00", "08:00", []string{"00:00", "08:00", "23:59"}, nil},
+		{"08:00", "18:30", []string{"08:00", "12:00", "18:29"}, []string{"07:59", "18:30", "23:00", "00:00"}},
+		{"22:00", "06:00", []string{"22:00", "23:59", "00:00", "05:59"}, []string{"06:00", "12:00", "21:59"}},
+		{"00:00", "06:00", []string{"00:00", "05:59"}, []string{"06:00", "23:59"}},
+		{"18:00", "00:00", []string{"18:00", "23:59"}, []string{"00:00", "17:59"}},
+	}
+
+	for _, test := range tests {
+		start, end, err := ArchiveWindow(ArchiveST{Start: test.start, End: test.end})
+		if err != nil {
+			t.Fatalf("ArchiveWindow(%q, %q) = %v", test.start, test.end, err)
+		}
+		for _, val := range test.inside {
+			at, _ := time.ParseInLocation("2006-01-02 15:04", "2024-03-31 "+val, time.Local)
+			if !ArchiveInWindow(at, start, end) {
+				t.Errorf("ArchiveInWindow(%v) of %v-%v = false - wanted inside", val, test.start, test.end)
+			}
+		}
+		for _, val := range test.outside {
+			at, _ := time.ParseInLocation("2006-01-02 15:04", "2024-03-31 "+val, time.Local)
+			if ArchiveInWindow(at, start, end) {
+				t.Errorf("ArchiveInWindow(%v) of %v-%v = true - wanted outside", val, test.start, test.end)
+			}
+		}
+	}
+
+	// the window follows the wall clock on daylight saving days
+	if berlin, err := time.LoadLocation("Europe/Berlin"); err == nil {
+		start, end, _ := ArchiveWindow(ArchiveST{Start: "06:00", End: "08:00"})
+		for _, at := range []time.Time{
+			time.Date(2024, 3, 31, 6, 30, 0, 0, berlin),
+			time.Date(2024, 10, 27, 6, 30, 0, 0, berlin),
+		} {
+			if !ArchiveInWindow(at, start, end) {
+				t.Errorf("ArchiveInWindow(%v) of 06:00-08:00 = false - wanted inside", at)
+			}
+		}
+		if at := time.Date(2024, 10, 27, 5, 30, 0, 0, berlin); ArchiveInWindow(at, start, end) {
+			t.Errorf("ArchiveInWindow(%v) of 06:00-08:00 = true - wanted outside", at)
+		}
+	}
+
+	for _, window := range [][2]string{{"08:00", ""}, {"", "18:00"}, {"8h", "18h"}, {"25:00", "06:00"}} {
+		if _, _, err := ArchiveWindow(ArchiveST{Start: window[0], End: window[1]}); err == nil {
+			t.Errorf("ArchiveWindow(%q, %q) = nil - wanted an error", window[0], window[1])
+		}
+	}
+}
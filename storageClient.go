@@ -7,30 +7,38 @@ import (
 )
 
 //ClientAdd Add New Client to Translations
-func (obj *StorageST) ClientAdd(streamID string, channelID string, mode int) (string, chan *av.Packet, chan *[]byte, error) {
+func (obj *StorageST) ClientAdd(streamID string, channelID string, mode int) (string, chan *av.Packet, chan *[]byte, chan int, error) {
 	obj.mutex.Lock()
 	defer obj.mutex.Unlock()
 	streamTmp, ok := obj.Streams[streamID]
 	if !ok {
-		return "", nil, nil, ErrorStreamNotFound
+		return "", nil, nil, nil, ErrorStreamNotFound
 	}
 	//Generate UUID client
 	cid, err := generateUUID()
 	if err != nil {
-		return "", nil, nil, err
+		return "", nil, nil, nil, err
 	}
 	chAV := make(chan *av.Packet, 2000)
 	chRTP := make(chan *[]byte, 2000)
 	channelTmp, ok := streamTmp.Channels[channelID]
 	if !ok {
-		return "", nil, nil, ErrorStreamNotFound
+		return "", nil, nil, nil, ErrorStreamNotFound
 	}
 
-	channelTmp.clients[cid] = ClientST{mode: mode, outgoingAVPacket: chAV, outgoingRTPPacket: chRTP, signals: make(chan int, 100)}
+	signals := make(chan int, 100)
+	client := ClientST{mode: mode, outgoingAVPacket: chAV, outgoingRTPPacket: chRTP, signals: signals}
+	if mode == WEBRTC {
+		if channelTmp.MaxViewers > 0 && channelTmp.viewers(WEBRTC) >= channelTmp.MaxViewers {
+			return "", nil, nil, nil, ErrorStreamViewerLimit
+		}
+		client.timeshift = NewStreamTimeshift(cid, channelTmp.dvr)
+	}
+	channelTmp.clients[cid] = client
 	channelTmp.ack = time.Now()
 	streamTmp.Channels[channelID] = channelTmp
 	obj.Streams[streamID] = streamTmp
-	return cid, chAV, chRTP, nil
+	return cid, chAV, chRTP, signals, nil
 
 }
 
@@ -43,6 +51,25 @@ func (obj *StorageST) ClientDelete(streamID string, cid string, channelID string
 	}
 }
 
+//ClientTimeshift get timeshift state of a WebRTC client
+func (obj *StorageST) ClientTimeshift(streamID string, channelID string, cid string) (*StreamTimeshift, error) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	streamTmp, ok := obj.Streams[streamID]
+	if !ok {
+		return nil, ErrorStreamNotFound
+	}
+	channelTmp, ok := streamTmp.Channels[channelID]
+	if !ok {
+		return nil, ErrorStreamNotFound
+	}
+	client, ok := channelTmp.clients[cid]
+	if !ok || client.timeshift == nil {
+		return nil, ErrorClientNotFound
+	}
+	return client.timeshift, nil
+}
+
 //ClientHas check is client ext
 func (obj *StorageST) ClientHas(streamID string, channelID string) bool {
 	obj.mutex.Lock()
@@ -60,3 +87,14 @@ func (obj *StorageST) ClientHas(streamID string, channelID string) bool {
 	}
 	return true
 }
+
+//viewers count channel clients of the mode
+func (channel *ChannelST) viewers(mode int) int {
+	var count int
+	for _, client := range channel.clients {
+		if client.mode == mode {
+			count++
+		}
+	}
+	return count
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"flag"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"time"
 
@@ -20,11 +19,15 @@ import (
 // Command line flag global variables
 var debug bool
 var configFile string
+var secretsFile string
+var masksFile string
 
 //NewStreamCore do load config file
 func NewStreamCore() *StorageST {
 	flag.BoolVar(&debug, "debug", true, "set debug mode")
 	flag.StringVar(&configFile, "config", "config.json", "config patch (/etc/server/config.json or config.json)")
+	flag.StringVar(&secretsFile, "secrets", "secrets.json", "named credentials file, kept out of the config")
+	flag.StringVar(&masksFile, "masks", "masks.json", "snapshot privacy masks edited through the api, replacing the config ones")
 	flag.Parse()
 
 	var tmp StorageST
@@ -47,11 +50,39 @@ func NewStreamCore() *StorageST {
 		os.Exit(1)
 	}
 	debug = tmp.Server.Debug
+	tmp.credentials, err = LoadSecrets(secretsFile)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"module": "config",
+			"func":   "NewStreamCore",
+			"call":   "LoadSecrets",
+		}).Errorln(err.Error())
+		os.Exit(1)
+	}
+	tmp.snapshotMasks, err = LoadSnapshotMasks(masksFile)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"module": "config",
+			"func":   "NewStreamCore",
+			"call":   "LoadSnapshotMasks",
+		}).Errorln(err.Error())
+		os.Exit(1)
+	}
 
+	if err = validateHTTPAuth(tmp.Server); err != nil {
+		log.WithFields(logrus.Fields{
+			"module": "config",
+			"func":   "NewStreamCore",
+			"call":   "validateHTTPAuth",
+		}).Errorln(err.Error())
+		os.Exit(1)
+	}
 
 	for i, i2 := range tmp.Streams {
 		for i3, i4 := range i2.Channels {
 			channel := tmp.ChannelDefaults
+			// merging fills maps in place, the defaults are shared by every channel
+			channel.Snapshot.ModuleConfig = cloneSnapshotModuleConfig(channel.Snapshot.ModuleConfig)
 			err = mergo.Merge(&channel, i4)
 			if err != nil {
 				log.WithFields(logrus.Fields{
@@ -64,28 +95,22 @@ func NewStreamCore() *StorageST {
 			channel.clients = make(map[string]ClientST)
 			channel.ack = time.Now().Add(-255 * time.Hour)
 			channel.signals = make(chan int, 100)
+			channel.recordSignals = make(chan int, 100)
+			channel.archiveSignals = make(chan int, 100)
+			if channel.DVR.Enabled {
+				channel.dvr = NewStreamDVR(channel.DVR)
+			}
+			channel.keyframe = NewStreamKeyframe()
 
-			snapshotCfg := &channel.Snapshot
-			if snapshotCfg.URL != "" {
-				snapshotCfg.client = &http.Client{
-					Transport: HttpTransportWithTimeout(snapshotCfg.DialTimeout),
-				}
-
-				if snapshotCfg.DigestAuth.Enabled {
-					requestor := NewDigestAuthRequestor(snapshotCfg.client)
-
-					if snapshotCfg.DigestAuth.AllowNonceReuse {
-						if snapshotCfg.DigestAuth.NonceReuseTimeout != 0 {
-							requestor.NonceReusePolicy = DigestAuthNonceReuseWithinTimeout(snapshotCfg.DigestAuth.NonceReuseTimeout)
-						} else {
-							requestor.NonceReusePolicy = DigestAuthNonceReuseAlways
-						}
-					}
-
-					snapshotCfg.DigestAuth.requestor = requestor
-				}
-
-				snapshotCfg.LoadModules()
+			if err = tmp.StreamChannelSnapshotMake(i, i3, &channel); err != nil {
+				log.WithFields(logrus.Fields{
+					"module":  "config",
+					"stream":  i,
+					"channel": i3,
+					"func":    "NewStreamCore",
+					"call":    "StreamChannelSnapshotMake",
+				}).Errorln(err.Error())
+				os.Exit(1)
 			}
 
 			i2.Channels[i3] = channel
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//Event log options
+const (
+	eventLogSize          = 100
+	eventSubscriberBuffer = 16
+	eventWebhookTimeout   = 5 * time.Second
+)
+
+//Event types
+const (
+	EventMotionStart = "motion_start"
+	EventMotionStop  = "motion_stop"
+)
+
+//EventST channel event, with the snapshot which triggered it
+type EventST struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Stream      string    `json:"stream"`
+	Channel     string    `json:"channel"`
+	Time        time.Time `json:"time"`
+	Score       float64   `json:"score,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Snapshot    []byte    `json:"snapshot,omitempty"`
+}
+
+// EventPublish record event, send it to subscribers and webhooks
+func (obj *StorageST) EventPublish(event EventST, webhooks []string) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "events",
+		"stream":  event.Stream,
+		"channel": event.Channel,
+		"func":    "EventPublish",
+	})
+	requestLogger.WithFields(logrus.Fields{
+		"call":  "EventPublish",
+		"type":  event.Type,
+		"score": event.Score,
+	}).Infoln("Event", event.ID)
+
+	obj.mutex.Lock()
+	obj.events = append(obj.events, event)
+	if len(obj.events) > eventLogSize {
+		obj.events = obj.events[len(obj.events)-eventLogSize:]
+	}
+	for subscriber := range obj.eventSubscribers {
+		// a slow subscriber misses events instead of blocking the publisher
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+	obj.mutex.Unlock()
+
+	for _, webhook := range webhooks {
+		go EventWebhook(webhook, event, requestLogger)
+	}
+}
+
+// EventList recent events of a stream channel, all when empty, without snapshots
+func (obj *StorageST) EventList(streamID string, channelID string) []EventST {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	events := []EventST{}
+	for _, event := range obj.events {
+		if (streamID == "" || event.Stream == streamID) && (channelID == "" || event.Channel == channelID) {
+			event.Snapshot = nil
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// EventGet recent event by id
+func (obj *StorageST) EventGet(id string) (EventST, error) {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	for _, event := range obj.events {
+		if event.ID == id {
+			return event, nil
+		}
+	}
+	return EventST{}, ErrorEventNotFound
+}
+
+// EventSubscribe receive new events until unsubscribed
+func (obj *StorageST) EventSubscribe() chan EventST {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if obj.eventSubscribers == nil {
+		obj.eventSubscribers = make(map[chan EventST]struct{})
+	}
+	subscriber := make(chan EventST, eventSubscriberBuffer)
+	obj.eventSubscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+// EventUnsubscribe stop receiving events
+func (obj *StorageST) EventUnsubscribe(subscriber chan EventST) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	delete(obj.eventSubscribers, subscriber)
+}
+
+//EventWebhook post event as JSON to webhook
+func EventWebhook(url string, event EventST, requestLogger *logrus.Entry) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Marshal",
+		}).Errorln(err.Error())
+		return
+	}
+	client := http.Client{Timeout: eventWebhookTimeout}
+	res, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Post",
+		}).Errorln(err.Error())
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Post",
+		}).Errorln("webhook responded with status", res.StatusCode)
+	}
+}
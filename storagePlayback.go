@@ -0,0 +1,29 @@
+package main
+
+// PlaybackAdd register running playback session
+func (obj *StorageST) PlaybackAdd(session *PlaybackSession) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if obj.playback == nil {
+		obj.playback = make(map[string]*PlaybackSession)
+	}
+	obj.playback[session.ID()] = session
+}
+
+// PlaybackGet get playback session of the given channel
+func (obj *StorageST) PlaybackGet(streamID string, channelID string, id string) (*PlaybackSession, error) {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	session, ok := obj.playback[id]
+	if !ok || session.streamID != streamID || session.channelID != channelID {
+		return nil, ErrorPlaybackNotFound
+	}
+	return session, nil
+}
+
+// PlaybackDelete remove finished playback session
+func (obj *StorageST) PlaybackDelete(id string) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	delete(obj.playback, id)
+}
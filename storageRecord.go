@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Default recording options
+const (
+	recordDefaultDirectory         = "recordings"
+	recordDefaultSegmentDuration   = 60
+	recordDefaultMaxExportDuration = 3600
+	recordDefaultMaxExportSizeMB   = 2048
+	recordIndexFile                = "index.jsonl"
+	recordDateLayout               = "2006-01-02"
+	recordFileLayout               = "15-04-05.000"
+	recordFileExt                  = ".mp4"
+)
+
+//RecordSegmentST one recorded fMP4 segment file
+type RecordSegmentST struct {
+	File  string    `json:"file"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Bytes int64     `json:"bytes"`
+}
+
+//RecordRangeST continuous recorded time range
+type RecordRangeST struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+//RecordDirectory channel recordings directory
+func RecordDirectory(cfg RecordST, streamID string, channelID string) string {
+	directory := cfg.Directory
+	if directory == "" {
+		directory = recordDefaultDirectory
+	}
+	return filepath.Join(filepath.Clean(directory), filepath.Base(streamID), filepath.Base(channelID))
+}
+
+//RecordSegmentPath relative path of a segment starting at the given time, laid out by date
+func RecordSegmentPath(start time.Time) string {
+	start = start.UTC()
+	return filepath.Join(start.Format(recordDateLayout), start.Format(recordFileLayout)+recordFileExt)
+}
+
+//RecordIndexLoad read channel segment index, adding segment files missing from it
+func RecordIndexLoad(directory string) ([]RecordSegmentST, error) {
+	var segments []RecordSegmentST
+	known := make(map[string]bool)
+	file, err := os.Open(filepath.Join(directory, recordIndexFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var segment RecordSegmentST
+			// a truncated last line can be left by a crash, skip it
+			if json.Unmarshal(scanner.Bytes(), &segment) != nil {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(directory, segment.File)); err != nil {
+				continue
+			}
+			known[segment.File] = true
+			segments = append(segments, segment)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	// segments which were being written when the server stopped are not indexed yet
+	err = filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, recordFileExt) {
+			return err
+		}
+		rel, err := filepath.Rel(directory, path)
+		if err != nil || known[rel] {
+			return err
+		}
+		start, err := time.ParseInLocation(recordDateLayout+"/"+recordFileLayout, strings.TrimSuffix(filepath.ToSlash(rel), recordFileExt), time.UTC)
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		segments = append(segments, RecordSegmentST{File: rel, Start: start, End: info.ModTime(), Bytes: info.Size()})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Start.Before(segments[j].Start)
+	})
+	return segments, nil
+}
+
+//RecordRanges merge segments into continuous ranges overlapping [start,end], zero times are unbounded
+func RecordRanges(segments []RecordSegmentST, start time.Time, end time.Time) []RecordRangeST {
+	ranges := []RecordRangeST{}
+	for _, segment := range segments {
+		if (!start.IsZero() && !segment.End.After(start)) || (!end.IsZero() && !segment.Start.Before(end)) {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && segment.Start.Sub(ranges[last].End) <= recordMaxGap {
+			if segment.End.After(ranges[last].End) {
+				ranges[last].End = segment.End
+			}
+			continue
+		}
+		ranges = append(ranges, RecordRangeST{Start: segment.Start, End: segment.End})
+	}
+	return ranges
+}
+
+//RecordIndexAppend add a closed segment to the channel index
+func RecordIndexAppend(directory string, segment RecordSegmentST) error {
+	data, err := json.Marshal(segment)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(directory, recordIndexFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+//RecordIndexWrite replace the channel index
+func RecordIndexWrite(directory string, segments []RecordSegmentST) error {
+	var data []byte
+	for _, segment := range segments {
+		line, err := json.Marshal(segment)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	tmp := filepath.Join(directory, recordIndexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(directory, recordIndexFile))
+}
+
+// StreamChannelRecordStatus change stream recording status
+func (obj *StorageST) StreamChannelRecordStatus(key string, channelID string, val RecordStatusST) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if tmp, ok := obj.Streams[key]; ok {
+		if channelTmp, ok := tmp.Channels[channelID]; ok {
+			channelTmp.RecordStatus = val
+			tmp.Channels[channelID] = channelTmp
+			obj.Streams[key] = tmp
+		}
+	}
+}
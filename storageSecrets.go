@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+)
+
+//Secret value references
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+)
+
+//CredentialST named credentials of the secrets file, values may be literals, env:NAME or file:/path
+type CredentialST struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+//LoadSecrets read named credentials of the secrets file, a missing file holds none
+func LoadSecrets(path string) (map[string]CredentialST, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]CredentialST{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]CredentialST)
+	if err = json.Unmarshal(data, &credentials); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+//resolveSecret read an env:NAME or file:/path reference (e.g. Docker secrets), other values are literals
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("environment variable " + name + " is not set")
+		}
+		return val, nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		data, err := os.ReadFile(strings.TrimPrefix(value, secretFilePrefix))
+		if err != nil {
+			return "", err
+		}
+		// secret files usually end with a newline
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return value, nil
+}
+
+//ServerCredentials resolve named credentials, references are read on each call so rotated secrets apply on the next dial
+func (obj *StorageST) ServerCredentials(name string) (*url.Userinfo, error) {
+	obj.mutex.RLock()
+	credential, ok := obj.credentials[name]
+	obj.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrorCredentialsNotFound, name)
+	}
+	username, err := resolveSecret(credential.Username)
+	if err != nil {
+		return nil, err
+	}
+	password, err := resolveSecret(credential.Password)
+	if err != nil {
+		return nil, err
+	}
+	return url.UserPassword(username, password), nil
+}
+
+//CredentialsURL inject named credentials into the url, replacing its own, the url is unchanged without name
+func (obj *StorageST) CredentialsURL(rawURL string, name string) (string, error) {
+	if name == "" {
+		return rawURL, nil
+	}
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if uri.User, err = obj.ServerCredentials(name); err != nil {
+		return "", err
+	}
+	return uri.String(), nil
+}
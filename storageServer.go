@@ -2,6 +2,7 @@ package main
 
 import (
 	"path/filepath"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -56,6 +57,30 @@ func (obj *StorageST) ServerHTTPPassword() string {
 	return obj.Server.HTTPPassword
 }
 
+//ServerHTTPAuth read HTTP auth scheme, basic when empty
+func (obj *StorageST) ServerHTTPAuth() string {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	if obj.Server.HTTPAuth == "" {
+		return httpAuthBasic
+	}
+	return obj.Server.HTTPAuth
+}
+
+//ServerHTTPDigestAlgorithms read HTTP digest auth algorithms options
+func (obj *StorageST) ServerHTTPDigestAlgorithms() []string {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	return obj.Server.HTTPDigestAlgos
+}
+
+//ServerHTTPDigestNonceTimeout read HTTP digest auth nonce timeout options
+func (obj *StorageST) ServerHTTPDigestNonceTimeout() time.Duration {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	return time.Duration(obj.Server.HTTPDigestTimeout) * time.Second
+}
+
 //ServerHTTPPort read HTTP Port options
 func (obj *StorageST) ServerHTTPPort() string {
 	obj.mutex.RLock()
@@ -160,3 +185,11 @@ func (obj *StorageST) ServerWebRTCPortMax() uint16 {
 	defer obj.mutex.Unlock()
 	return obj.Server.WebRTCPortMax
 }
+
+//ServerMosaic read named mosaic layout
+func (obj *StorageST) ServerMosaic(name string) (MosaicST, bool) {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	mosaic, ok := obj.Server.Mosaics[name]
+	return mosaic, ok
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+//LoadSnapshotMasks read the privacy masks edited through the API by stream and channel, a missing file holds none
+func LoadSnapshotMasks(path string) (map[string]map[string][]SnapshotMaskST, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]map[string][]SnapshotMaskST{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	masks := make(map[string]map[string][]SnapshotMaskST)
+	if err = json.Unmarshal(data, &masks); err != nil {
+		return nil, err
+	}
+	return masks, nil
+}
+
+//saveSnapshotMasks write the edited masks, replacing the file at once so a crash keeps the previous ones
+func (obj *StorageST) saveSnapshotMasks() error {
+	data, err := json.MarshalIndent(obj.snapshotMasks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(masksFile), filepath.Base(masksFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), masksFile)
+}
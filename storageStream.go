@@ -33,13 +33,19 @@ func (obj *StorageST) StreamAdd(uuid string, val StreamST) error {
 	}
 	for i, i2 := range val.Channels {
 		i2 = obj.StreamChannelMake(i2)
-		if !i2.OnDemand {
+		if err := obj.StreamChannelSnapshotMake(uuid, i, &i2); err != nil {
+			return err
+		}
+		val.Channels[i] = i2
+	}
+	for i, i2 := range val.Channels {
+		// a DVR buffer is only filled while the channel is pulled
+		if !i2.OnDemand || i2.DVR.Enabled {
 			i2.runLock = true
 			val.Channels[i] = i2
 			go StreamServerRunStreamDo(uuid, i)
-		} else {
-			val.Channels[i] = i2
 		}
+		obj.StreamChannelRunWorkers(uuid, i, i2)
 	}
 	obj.Streams[uuid] = val
 	err := obj.SaveConfig()
@@ -54,22 +60,29 @@ func (obj *StorageST) StreamEdit(uuid string, val StreamST) error {
 	obj.mutex.Lock()
 	defer obj.mutex.Unlock()
 	if tmp, ok := obj.Streams[uuid]; ok {
+		// the current channels keep running when the new settings are invalid
+		for i3, i4 := range val.Channels {
+			i4 = obj.StreamChannelMake(i4)
+			if err := obj.StreamChannelSnapshotMake(uuid, i3, &i4); err != nil {
+				return err
+			}
+			val.Channels[i3] = i4
+		}
 		for i, i2 := range tmp.Channels {
 			if i2.runLock {
 				tmp.Channels[i] = i2
 				obj.Streams[uuid] = tmp
 				i2.signals <- SignalStreamStop
 			}
+			obj.StreamChannelStopWorkers(i2)
 		}
 		for i3, i4 := range val.Channels {
-			i4 = obj.StreamChannelMake(i4)
-			if !i4.OnDemand {
+			if !i4.OnDemand || i4.DVR.Enabled {
 				i4.runLock = true
 				val.Channels[i3] = i4
 				go StreamServerRunStreamDo(uuid, i3)
-			} else {
-				val.Channels[i3] = i4
 			}
+			obj.StreamChannelRunWorkers(uuid, i3, i4)
 		}
 		obj.Streams[uuid] = val
 		err := obj.SaveConfig()
@@ -90,6 +103,7 @@ func (obj *StorageST) StopAll() {
 			if i2.runLock {
 				i2.signals <- SignalStreamStop
 			}
+			obj.StreamChannelStopWorkers(i2)
 		}
 	}
 }
@@ -118,6 +132,7 @@ func (obj *StorageST) StreamDelete(uuid string) error {
 			if i2.runLock {
 				i2.signals <- SignalStreamStop
 			}
+			obj.StreamChannelStopWorkers(i2)
 		}
 		delete(obj.Streams, uuid)
 		err := obj.SaveConfig()
@@ -138,3 +153,18 @@ func (obj *StorageST) StreamInfo(uuid string) (*StreamST, error) {
 	}
 	return nil, ErrorStreamNotFound
 }
+
+//DigestAuthCaches snapshot digest auth state caches, "shared" and the isolated ones by stream/channel
+func (obj *StorageST) DigestAuthCaches() map[string]*DigestAuthStateCache {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	caches := map[string]*DigestAuthStateCache{"shared": digestAuthSharedCache}
+	for streamID, stream := range obj.Streams {
+		for channelID, channel := range stream.Channels {
+			if requestor := channel.Snapshot.DigestAuth.requestor; requestor != nil && requestor.Cache != nil {
+				caches[streamID+"/"+channelID] = requestor.Cache
+			}
+		}
+	}
+	return caches
+}
@@ -11,6 +11,8 @@ import (
 // StreamChannelMake check stream exist
 func (obj *StorageST) StreamChannelMake(val ChannelST) ChannelST {
 	channel := obj.ChannelDefaults
+	// merging fills maps in place, the defaults are shared by every channel
+	channel.Snapshot.ModuleConfig = cloneSnapshotModuleConfig(channel.Snapshot.ModuleConfig)
 	if err := mergo.Merge(&channel, val); err != nil {
 		// Just ignore the default values and continue
 		channel = val
@@ -26,6 +28,14 @@ func (obj *StorageST) StreamChannelMake(val ChannelST) ChannelST {
 	channel.ack = time.Now().Add(-255 * time.Hour)
 	//make signals buffer chain
 	channel.signals = make(chan int, 100)
+	channel.recordSignals = make(chan int, 100)
+	channel.archiveSignals = make(chan int, 100)
+	//make dvr buffer
+	if channel.DVR.Enabled {
+		channel.dvr = NewStreamDVR(channel.DVR)
+	}
+	//make last keyframe holder
+	channel.keyframe = NewStreamKeyframe()
 	return channel
 }
 
@@ -35,16 +45,47 @@ func (obj *StorageST) StreamChannelRunAll() {
 	defer obj.mutex.Unlock()
 	for k, v := range obj.Streams {
 		for ks, vs := range v.Channels {
-			if !vs.OnDemand {
+			if !vs.OnDemand || vs.DVR.Enabled {
 				vs.runLock = true
 				go StreamServerRunStreamDo(k, ks)
 				v.Channels[ks] = vs
 				obj.Streams[k] = v
 			}
+			obj.StreamChannelRunWorkers(k, ks, vs)
 		}
 	}
 }
 
+// StreamChannelRunWorkers start the recorder, motion detection, snapshot and archive workers of a channel
+func (obj *StorageST) StreamChannelRunWorkers(streamID string, channelID string, channel ChannelST) {
+	if channel.Record.Enabled {
+		go StreamRecordRun(streamID, channelID)
+	}
+	// the snapshot workers stop by themselves once the channel is deleted or replaced
+	if channel.motion != nil {
+		go StreamMotionRun(streamID, channelID)
+	}
+	if channel.Snapshot.mjpeg != nil {
+		go channel.Snapshot.mjpeg.Run(streamID, channelID)
+	}
+	if channel.Snapshot.cache != nil && channel.Snapshot.RefreshInterval > 0 {
+		go channel.Snapshot.cache.Refresh(streamID, channelID)
+	}
+	if channel.Archive.Enabled && channel.Snapshot.URL != "" {
+		go StreamArchiveRun(streamID, channelID)
+	}
+}
+
+// StreamChannelStopWorkers stop the recorder and archive workers of a channel being edited or deleted
+func (obj *StorageST) StreamChannelStopWorkers(channel ChannelST) {
+	if channel.Record.Enabled {
+		channel.recordSignals <- SignalStreamStop
+	}
+	if channel.Archive.Enabled && channel.Snapshot.URL != "" {
+		channel.archiveSignals <- SignalStreamStop
+	}
+}
+
 // StreamChannelRun one stream and lock
 func (obj *StorageST) StreamChannelRun(streamID string, channelID string) {
 	obj.mutex.Lock()
@@ -223,6 +264,12 @@ func (obj *StorageST) StreamChannelCodecsUpdate(streamID string, channelID strin
 		if channelTmp, ok := tmp.Channels[channelID]; ok {
 			channelTmp.codecs = val
 			channelTmp.sdp = sdp
+			if channelTmp.dvr != nil {
+				channelTmp.dvr.SetCodecs(val)
+			}
+			if channelTmp.keyframe != nil {
+				channelTmp.keyframe.SetCodecs(val)
+			}
 			tmp.Channels[channelID] = channelTmp
 			obj.Streams[streamID] = tmp
 		}
@@ -262,11 +309,15 @@ func (obj *StorageST) StreamChannelAdd(uuid string, channelID string, val Channe
 		return ErrorStreamChannelAlreadyExists
 	}
 	val = obj.StreamChannelMake(val)
-	obj.Streams[uuid].Channels[channelID] = val
-	if !val.OnDemand {
+	if err := obj.StreamChannelSnapshotMake(uuid, channelID, &val); err != nil {
+		return err
+	}
+	if !val.OnDemand || val.DVR.Enabled {
 		val.runLock = true
 		go StreamServerRunStreamDo(uuid, channelID)
 	}
+	obj.Streams[uuid].Channels[channelID] = val
+	obj.StreamChannelRunWorkers(uuid, channelID, val)
 	err := obj.SaveConfig()
 	if err != nil {
 		return err
@@ -280,15 +331,21 @@ func (obj *StorageST) StreamChannelEdit(uuid string, channelID string, val Chann
 	defer obj.mutex.Unlock()
 	if tmp, ok := obj.Streams[uuid]; ok {
 		if currentChannel, ok := tmp.Channels[channelID]; ok {
+			// the current channel keeps running when the new settings are invalid
+			val = obj.StreamChannelMake(val)
+			if err := obj.StreamChannelSnapshotMake(uuid, channelID, &val); err != nil {
+				return err
+			}
 			if currentChannel.runLock {
 				currentChannel.signals <- SignalStreamStop
 			}
-			val = obj.StreamChannelMake(val)
-			obj.Streams[uuid].Channels[channelID] = val
-			if !val.OnDemand {
+			obj.StreamChannelStopWorkers(currentChannel)
+			if !val.OnDemand || val.DVR.Enabled {
 				val.runLock = true
 				go StreamServerRunStreamDo(uuid, channelID)
 			}
+			obj.Streams[uuid].Channels[channelID] = val
+			obj.StreamChannelRunWorkers(uuid, channelID, val)
 			err := obj.SaveConfig()
 			if err != nil {
 				return err
@@ -308,6 +365,7 @@ func (obj *StorageST) StreamChannelDelete(uuid string, channelID string) error {
 			if channelTmp.runLock {
 				channelTmp.signals <- SignalStreamStop
 			}
+			obj.StreamChannelStopWorkers(channelTmp)
 			delete(obj.Streams[uuid].Channels, channelID)
 			err := obj.SaveConfig()
 			if err != nil {
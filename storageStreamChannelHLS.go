@@ -0,0 +1,65 @@
+package main
+
+import "time"
+
+// StreamChannelHLSMuxer get running channel HLS muxer or start a new one
+func (obj *StorageST) StreamChannelHLSMuxer(streamID string, channelID string) (*MuxerHLS, error) {
+	obj.mutex.RLock()
+	streamTmp, ok := obj.Streams[streamID]
+	if !ok {
+		obj.mutex.RUnlock()
+		return nil, ErrorStreamNotFound
+	}
+	channelTmp, ok := streamTmp.Channels[channelID]
+	obj.mutex.RUnlock()
+	if !ok {
+		return nil, ErrorStreamChannelNotFound
+	}
+	if channelTmp.hlsMuxer != nil {
+		channelTmp.hlsMuxer.Touch()
+		return channelTmp.hlsMuxer, nil
+	}
+	obj.StreamChannelRun(streamID, channelID)
+	codecs, err := obj.StreamChannelCodecs(streamID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	muxer, err := NewMuxerHLS(streamID, channelID, channelTmp.HLS, codecs)
+	if err != nil {
+		return nil, err
+	}
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	streamTmp, ok = obj.Streams[streamID]
+	if !ok {
+		return nil, ErrorStreamNotFound
+	}
+	channelTmp, ok = streamTmp.Channels[channelID]
+	if !ok {
+		return nil, ErrorStreamChannelNotFound
+	}
+	// another viewer might have started a muxer while codecs were awaited
+	if channelTmp.hlsMuxer != nil {
+		channelTmp.hlsMuxer.Touch()
+		return channelTmp.hlsMuxer, nil
+	}
+	channelTmp.hlsMuxer = muxer
+	channelTmp.ack = time.Now()
+	streamTmp.Channels[channelID] = channelTmp
+	obj.Streams[streamID] = streamTmp
+	go StreamHLSMuxerRun(streamID, channelID, muxer)
+	return muxer, nil
+}
+
+// StreamChannelHLSMuxerDelete detach stopped muxer from the channel
+func (obj *StorageST) StreamChannelHLSMuxerDelete(streamID string, channelID string, muxer *MuxerHLS) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if streamTmp, ok := obj.Streams[streamID]; ok {
+		if channelTmp, ok := streamTmp.Channels[channelID]; ok && channelTmp.hlsMuxer == muxer {
+			channelTmp.hlsMuxer = nil
+			streamTmp.Channels[channelID] = channelTmp
+			obj.Streams[streamID] = streamTmp
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StreamChannelSnapshotMake set up the snapshot client, digest auth, modules, motion detection,
+// overlay, privacy masks and persistent connection of a channel, the caller holds the lock
+func (obj *StorageST) StreamChannelSnapshotMake(streamID string, channelID string, channel *ChannelST) error {
+	snapshotCfg := &channel.Snapshot
+	snapshotCfg.credentials = snapshotCfg.Credentials
+	if snapshotCfg.credentials == "" {
+		snapshotCfg.credentials = channel.Credentials
+	}
+	for _, name := range []string{channel.Credentials, snapshotCfg.credentials} {
+		if _, ok := obj.credentials[name]; name != "" && !ok {
+			return fmt.Errorf("%w: %v", ErrorCredentialsNotFound, name)
+		}
+	}
+	if snapshotCfg.URL == "" {
+		return nil
+	}
+	snapshotCfg.client = &http.Client{
+		Transport: HttpTransportWithTimeout(snapshotCfg.DialTimeout),
+	}
+
+	if snapshotCfg.DigestAuth.Enabled {
+		requestor := NewDigestAuthRequestor(snapshotCfg.client)
+		if err := validateAuthSchemes(snapshotCfg.DigestAuth.Schemes); err != nil {
+			return err
+		}
+		requestor.Schemes = snapshotCfg.DigestAuth.Schemes
+		if snapshotCfg.DigestAuth.IsolatedCache {
+			requestor.Cache = NewDigestAuthStateCache(digestAuthCacheMaxEntries, digestAuthCacheTTL)
+		}
+
+		if snapshotCfg.DigestAuth.AllowNonceReuse {
+			if snapshotCfg.DigestAuth.NonceReuseTimeout != 0 {
+				requestor.NonceReusePolicy = DigestAuthNonceReuseWithinTimeout(snapshotCfg.DigestAuth.NonceReuseTimeout)
+			} else {
+				requestor.NonceReusePolicy = DigestAuthNonceReuseAlways
+			}
+		}
+
+		snapshotCfg.DigestAuth.requestor = requestor
+	}
+
+	var err error
+	if err = snapshotCfg.LoadModules(); err != nil {
+		return err
+	}
+	if channel.Motion.Enabled {
+		if channel.motion, err = NewStreamMotion(channel.Motion); err != nil {
+			return err
+		}
+	}
+	if snapshotCfg.Overlay.Enabled {
+		if snapshotCfg.overlay, err = NewSnapshotOverlay(snapshotCfg.Overlay, channel.Name); err != nil {
+			return err
+		}
+	}
+	// masks edited through the API replace the ones of the config
+	if masks, ok := obj.snapshotMasks[streamID][channelID]; ok {
+		snapshotCfg.Masks = masks
+	}
+	if snapshotCfg.privacy, err = NewSnapshotPrivacy(snapshotCfg.Masks); err != nil {
+		return err
+	}
+	switch snapshotCfg.Mode {
+	case "", snapshotModeJPEG:
+	case snapshotModeMJPEG:
+		if snapshotCfg.Persistent {
+			snapshotCfg.mjpeg = NewSnapshotMJPEG(*snapshotCfg)
+		}
+	default:
+		return fmt.Errorf("invalid snapshot mode %v", snapshotCfg.Mode)
+	}
+	snapshotCfg.cache = NewSnapshotCache(*snapshotCfg)
+	channel.mjpeg = NewStreamMJPEG()
+	return nil
+}
+
+// StreamChannelSnapshotMasks replace channel snapshot privacy masks, saved to the masks file
+// rather than the config so the config keeps its defaults and server settings as written
+func (obj *StorageST) StreamChannelSnapshotMasks(streamID string, channelID string, masks []SnapshotMaskST) error {
+	privacy, err := NewSnapshotPrivacy(masks)
+	if err != nil {
+		return err
+	}
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	streamTmp, ok := obj.Streams[streamID]
+	if !ok {
+		return ErrorStreamNotFound
+	}
+	channelTmp, ok := streamTmp.Channels[channelID]
+	if !ok {
+		return ErrorStreamChannelNotFound
+	}
+	channelTmp.Snapshot.Masks = masks
+	channelTmp.Snapshot.privacy = privacy
+	streamTmp.Channels[channelID] = channelTmp
+	obj.Streams[streamID] = streamTmp
+	if obj.snapshotMasks == nil {
+		obj.snapshotMasks = make(map[string]map[string][]SnapshotMaskST)
+	}
+	if obj.snapshotMasks[streamID] == nil {
+		obj.snapshotMasks[streamID] = make(map[string][]SnapshotMaskST)
+	}
+	obj.snapshotMasks[streamID][channelID] = masks
+	return obj.saveSnapshotMasks()
+}
@@ -18,6 +18,8 @@ const (
 	MSE = iota
 	WEBRTC
 	RTSP
+	HLS
+	RECORD
 )
 
 //Default stream status type
@@ -35,6 +37,7 @@ var (
 	ErrorStreamNotHLSSegments       = errors.New("stream hls not ts seq found")
 	ErrorStreamNoVideo              = errors.New("stream no video")
 	ErrorStreamNoClients            = errors.New("stream no clients")
+	ErrorClientNotFound             = errors.New("stream client not found")
 	ErrorStreamRestart              = errors.New("stream restart")
 	ErrorStreamStopCoreSignal       = errors.New("stream stop core signal")
 	ErrorStreamStopRTSPSignal       = errors.New("stream stop rtsp signal")
@@ -42,39 +45,69 @@ var (
 	ErrorStreamChannelCodecNotFound = errors.New("stream channel codec not ready, possible stream offline")
 	ErrorStreamChannelSnapshotDisabled = errors.New("stream channel does not support snapshots")
 	ErrorStreamsLen0                = errors.New("streams len zero")
+	ErrorStreamUnauthorized         = errors.New("stream unauthorized")
+	ErrorRecordNotFound             = errors.New("record not found for the requested time")
+	ErrorRecordCodecChanged         = errors.New("record codec changed")
+	ErrorRecordExportTooLong        = errors.New("record export range exceeds the max export duration")
+	ErrorRecordExportTooLarge       = errors.New("record export exceeds the max export size")
+	ErrorPlaybackNotFound           = errors.New("playback session not found")
+	ErrorEventNotFound              = errors.New("event not found")
+	ErrorStreamViewerLimit          = errors.New("stream channel viewer limit reached")
+	ErrorArchiveNotFound            = errors.New("no archived snapshot in the requested range")
+	ErrorDVRDisabled                = errors.New("stream channel dvr disabled")
+	ErrorDVRNotBuffered             = errors.New("dvr buffer does not cover the requested range")
+	ErrorCredentialsNotFound        = errors.New("credentials not found in the secrets")
 )
 
 //StorageST main storage struct
 type StorageST struct {
-	mutex           sync.RWMutex
-	Server          ServerST            `json:"server" groups:"api,config"`
-	Streams         map[string]StreamST `json:"streams,omitempty" groups:"api,config"`
-	ChannelDefaults ChannelST           `json:"channel_defaults,omitempty" groups:"api,config"`
+	mutex            sync.RWMutex
+	Server           ServerST            `json:"server" groups:"api,config"`
+	Streams          map[string]StreamST `json:"streams,omitempty" groups:"api,config"`
+	ChannelDefaults  ChannelST           `json:"channel_defaults,omitempty" groups:"api,config"`
+	playback         map[string]*PlaybackSession
+	events           []EventST
+	eventSubscribers map[chan EventST]struct{}
+	credentials      map[string]CredentialST
+	snapshotMasks    map[string]map[string][]SnapshotMaskST
 }
 
 //ServerST server storage section
 type ServerST struct {
-	Debug              bool         `json:"debug" groups:"api,config"`
-	LogLevel           logrus.Level `json:"log_level" groups:"api,config"`
-	HTTPDemo           bool         `json:"http_demo" groups:"api,config"`
-	HTTPDebug          bool         `json:"http_debug" groups:"api,config"`
-	HTTPLogin          string       `json:"http_login" groups:"api,config"`
-	HTTPPassword       string       `json:"http_password" groups:"api,config"`
-	HTTPDir            string       `json:"http_dir" groups:"api,config"`
-	HTTPPort           string       `json:"http_port" groups:"api,config"`
-	RTSPPort           string       `json:"rtsp_port" groups:"api,config"`
-	HTTPS              bool         `json:"https" groups:"api,config"`
-	HTTPSPort          string       `json:"https_port" groups:"api,config"`
-	HTTPSCert          string       `json:"https_cert" groups:"api,config"`
-	HTTPSKey           string       `json:"https_key" groups:"api,config"`
-	HTTPSAutoTLSEnable bool         `json:"https_auto_tls" groups:"api,config"`
-	HTTPSAutoTLSName   string       `json:"https_auto_tls_name" groups:"api,config"`
-	ICEServers         []string     `json:"ice_servers" groups:"api,config"`
-	ICEUsername        string       `json:"ice_username" groups:"api,config"`
-	ICECredential      string       `json:"ice_credential" groups:"api,config"`
-	Token              Token        `json:"token,omitempty" groups:"api,config"`
-	WebRTCPortMin      uint16       `json:"webrtc_port_min" groups:"api,config"`
-	WebRTCPortMax      uint16       `json:"webrtc_port_max" groups:"api,config"`
+	Debug              bool                `json:"debug" groups:"api,config"`
+	LogLevel           logrus.Level        `json:"log_level" groups:"api,config"`
+	HTTPDemo           bool                `json:"http_demo" groups:"api,config"`
+	HTTPDebug          bool                `json:"http_debug" groups:"api,config"`
+	HTTPLogin          string              `json:"http_login" groups:"api,config"`
+	HTTPPassword       string              `json:"http_password" groups:"api,config"`
+	HTTPAuth           string              `json:"http_auth,omitempty" groups:"api,config"`
+	HTTPDigestAlgos    []string            `json:"http_digest_algorithms,omitempty" groups:"api,config"`
+	HTTPDigestTimeout  int                 `json:"http_digest_nonce_timeout,omitempty" groups:"api,config"`
+	HTTPDir            string              `json:"http_dir" groups:"api,config"`
+	HTTPPort           string              `json:"http_port" groups:"api,config"`
+	RTSPPort           string              `json:"rtsp_port" groups:"api,config"`
+	HTTPS              bool                `json:"https" groups:"api,config"`
+	HTTPSPort          string              `json:"https_port" groups:"api,config"`
+	HTTPSCert          string              `json:"https_cert" groups:"api,config"`
+	HTTPSKey           string              `json:"https_key" groups:"api,config"`
+	HTTPSAutoTLSEnable bool                `json:"https_auto_tls" groups:"api,config"`
+	HTTPSAutoTLSName   string              `json:"https_auto_tls_name" groups:"api,config"`
+	ICEServers         []string            `json:"ice_servers" groups:"api,config"`
+	ICEUsername        string              `json:"ice_username" groups:"api,config"`
+	ICECredential      string              `json:"ice_credential" groups:"api,config"`
+	Token              Token               `json:"token,omitempty" groups:"api,config"`
+	WebRTCPortMin      uint16              `json:"webrtc_port_min" groups:"api,config"`
+	WebRTCPortMax      uint16              `json:"webrtc_port_max" groups:"api,config"`
+	Mosaics            map[string]MosaicST `json:"mosaics,omitempty" groups:"api,config"`
+}
+
+//MosaicST named snapshot mosaic layout
+type MosaicST struct {
+	Channels    []string `json:"channels" groups:"api,config"`
+	Columns     int      `json:"columns,omitempty" groups:"api,config"`
+	Width       int      `json:"width,omitempty" groups:"api,config"`
+	Height      int      `json:"height,omitempty" groups:"api,config"`
+	TileTimeout int      `json:"tile_timeout,omitempty" groups:"api,config"`
 }
 
 //Token auth
@@ -93,34 +126,155 @@ type DigestAuthST struct {
 	Enabled bool `json:"enabled,omitempty" groups:"config"`
 	AllowNonceReuse bool `json:"reuse_nonce,omitempty" groups:"config"`
 	NonceReuseTimeout int `json:"nonce_reuse_timeout,omitempty" groups:"config"`
+	Schemes []string `json:"schemes,omitempty" groups:"config"`
+	IsolatedCache bool `json:"isolated_cache,omitempty" groups:"config"`
 
 	requestor *DigestAuthRequestor
 }
 
 type SnapshotST struct {
 	URL string `json:"url,omitempty" groups:"config"`
+	Credentials string `json:"credentials,omitempty" groups:"config"`
+	Mode string `json:"mode,omitempty" groups:"config"`
+	Persistent bool `json:"persistent,omitempty" groups:"config"`
 	DialTimeout uint `json:"dial_timeout,omitempty" groups:"config"`
 	DigestAuth DigestAuthST `json:"digest_auth,omitempty" groups:"config"`
 	Modules []string `json:"modules" groups:"config"`
+	ModuleConfig map[string]map[string]interface{} `json:"module_config,omitempty" groups:"config"`
+	CacheControl string `json:"cache_control,omitempty" groups:"config"`
+	MaxAge int `json:"max_age,omitempty" groups:"config"`
+	MaxConcurrent int `json:"max_concurrent,omitempty" groups:"config"`
+	RefreshInterval int `json:"refresh_interval,omitempty" groups:"config"`
+	Overlay SnapshotOverlayST `json:"overlay,omitempty" groups:"config"`
+	Masks []SnapshotMaskST `json:"masks,omitempty" groups:"config"`
+	AdminUnmasked bool `json:"admin_unmasked,omitempty" groups:"config"`
 
 	client *http.Client
+	// Credentials, or those of the channel when unset
+	credentials string
+	cache *SnapshotCache
+	overlay *SnapshotOverlay
+	privacy *SnapshotPrivacy
+	mjpeg *SnapshotMJPEG
+	modules []SnapshotModule
+}
+
+type SnapshotMaskST struct {
+	Rect []int `json:"rect,omitempty" groups:"config"`
+	Polygon [][]int `json:"polygon,omitempty" groups:"config"`
+	Mode string `json:"mode,omitempty" groups:"config"`
+	Color string `json:"color,omitempty" groups:"config"`
+	PixelSize int `json:"pixel_size,omitempty" groups:"config"`
+}
+
+type SnapshotOverlayST struct {
+	Enabled bool `json:"enabled,omitempty" groups:"config"`
+	Text string `json:"text,omitempty" groups:"config"`
+	TimeFormat string `json:"time_format,omitempty" groups:"config"`
+	Position string `json:"position,omitempty" groups:"config"`
+	FontSize float64 `json:"font_size,omitempty" groups:"config"`
+	Color string `json:"color,omitempty" groups:"config"`
+	Background string `json:"background,omitempty" groups:"config"`
+}
+
+//HLSST HLS muxer settings
+type HLSST struct {
+	Format          string `json:"format,omitempty" groups:"api,config"`
+	SegmentDuration int    `json:"segment_duration,omitempty" groups:"api,config"`
+	WindowSize      int    `json:"window_size,omitempty" groups:"api,config"`
+	LowLatency      bool   `json:"low_latency,omitempty" groups:"api,config"`
+	PartDuration    int    `json:"part_duration,omitempty" groups:"api,config"`
+	IdleTimeout     int    `json:"idle_timeout,omitempty" groups:"api,config"`
+}
+
+//RecordST continuous recording settings
+type RecordST struct {
+	Enabled           bool   `json:"enabled,omitempty" groups:"api,config"`
+	Directory         string `json:"directory,omitempty" groups:"config"`
+	SegmentDuration   int    `json:"segment_duration,omitempty" groups:"api,config"`
+	RetentionDays     int    `json:"retention_days,omitempty" groups:"api,config"`
+	MaxSizeMB         int64  `json:"max_size_mb,omitempty" groups:"api,config"`
+	MaxExportDuration int    `json:"max_export_duration,omitempty" groups:"api,config"`
+	MaxExportSizeMB   int64  `json:"max_export_size_mb,omitempty" groups:"api,config"`
+}
+
+//DVRST rolling in-memory buffer settings
+type DVRST struct {
+	Enabled          bool   `json:"enabled,omitempty" groups:"api,config"`
+	Duration         int    `json:"duration,omitempty" groups:"api,config"`
+	MaxSizeMB        int64  `json:"max_size_mb,omitempty" groups:"api,config"`
+	CaptureDirectory string `json:"capture_directory,omitempty" groups:"config"`
+}
+
+//MotionST snapshot motion detection settings
+type MotionST struct {
+	Enabled     bool             `json:"enabled,omitempty" groups:"config"`
+	Interval    int              `json:"interval,omitempty" groups:"config"`
+	Sensitivity int              `json:"sensitivity,omitempty" groups:"config"`
+	MinArea     float64          `json:"min_area,omitempty" groups:"config"`
+	Cooldown    int              `json:"cooldown,omitempty" groups:"config"`
+	Zones       []SnapshotMaskST `json:"zones,omitempty" groups:"config"`
+	Webhooks    []string         `json:"webhooks,omitempty" groups:"config"`
+}
+
+//ArchiveST periodic snapshot archive settings
+type ArchiveST struct {
+	Enabled       bool   `json:"enabled,omitempty" groups:"api,config"`
+	Directory     string `json:"directory,omitempty" groups:"config"`
+	Interval      int    `json:"interval,omitempty" groups:"api,config"`
+	Start         string `json:"start,omitempty" groups:"api,config"`
+	End           string `json:"end,omitempty" groups:"api,config"`
+	RetentionDays int    `json:"retention_days,omitempty" groups:"api,config"`
+	MaxSizeMB     int64  `json:"max_size_mb,omitempty" groups:"api,config"`
+}
+
+//MJPEGST MJPEG proxy settings
+type MJPEGST struct {
+	FPS int `json:"fps,omitempty" groups:"api,config"`
+}
+
+//RecordStatusST continuous recording status
+type RecordStatusST struct {
+	Recording bool       `json:"recording" groups:"api"`
+	Segment   string     `json:"segment,omitempty" groups:"api"`
+	Segments  int        `json:"segments" groups:"api"`
+	Bytes     int64      `json:"bytes" groups:"api"`
+	Oldest    *time.Time `json:"oldest,omitempty" groups:"api"`
+	Newest    *time.Time `json:"newest,omitempty" groups:"api"`
+	Error     string     `json:"error,omitempty" groups:"api"`
 }
 
 type ChannelST struct {
-	Name               string      `json:"name,omitempty" groups:"api,config"`
-	URL                string      `json:"url,omitempty" groups:"config"`
-	OnDemand           bool        `json:"on_demand,omitempty" groups:"api,config"`
-	Debug              bool        `json:"debug,omitempty" groups:"api,config"`
-	Status             int         `json:"status,omitempty" groups:"api"`
-	InsecureSkipVerify bool        `json:"insecure_skip_verify,omitempty" groups:"api,config"`
-	Audio              bool        `json:"audio,omitempty" groups:"api,config"`
-	Snapshot           SnapshotST  `json:"snapshot,omitempty" groups:"config"`
+	Name               string         `json:"name,omitempty" groups:"api,config"`
+	URL                string         `json:"url,omitempty" groups:"config"`
+	Credentials        string         `json:"credentials,omitempty" groups:"config"`
+	OnDemand           bool           `json:"on_demand,omitempty" groups:"api,config"`
+	Debug              bool           `json:"debug,omitempty" groups:"api,config"`
+	Status             int            `json:"status,omitempty" groups:"api"`
+	InsecureSkipVerify bool           `json:"insecure_skip_verify,omitempty" groups:"api,config"`
+	Audio              bool           `json:"audio,omitempty" groups:"api,config"`
+	Snapshot           SnapshotST     `json:"snapshot,omitempty" groups:"config"`
+	HLS                HLSST          `json:"hls,omitempty" groups:"api,config"`
+	Record             RecordST       `json:"record,omitempty" groups:"api,config"`
+	RecordStatus       RecordStatusST `json:"record_status,omitempty" groups:"api"`
+	DVR                DVRST          `json:"dvr,omitempty" groups:"api,config"`
+	Motion             MotionST       `json:"motion,omitempty" groups:"config"`
+	MJPEG              MJPEGST        `json:"mjpeg,omitempty" groups:"api,config"`
+	MaxViewers         int            `json:"max_viewers,omitempty" groups:"api,config"`
+	Archive            ArchiveST      `json:"archive,omitempty" groups:"api,config"`
 	runLock            bool
 	codecs             []av.CodecData
 	sdp                []byte
 	signals            chan int
 	clients            map[string]ClientST
 	ack                time.Time
+	hlsMuxer           *MuxerHLS
+	recordSignals      chan int
+	archiveSignals     chan int
+	dvr                *StreamDVR
+	motion             *StreamMotion
+	keyframe           *StreamKeyframe
+	mjpeg              *StreamMJPEG
 }
 
 //ClientST client storage section
@@ -130,4 +284,5 @@ type ClientST struct {
 	outgoingAVPacket  chan *av.Packet
 	outgoingRTPPacket chan *[]byte
 	socket            net.Conn
+	timeshift         *StreamTimeshift
 }
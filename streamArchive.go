@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//StreamArchiveRun save channel snapshots at the archive interval until archiving is disabled
+func StreamArchiveRun(streamID string, channelID string) {
+	logger := log.WithFields(logrus.Fields{
+		"module":  "archive",
+		"stream":  streamID,
+		"channel": channelID,
+		"func":    "StreamArchiveRun",
+	})
+	opt, err := Storage.StreamChannelInfo(streamID, channelID)
+	if err != nil {
+		return
+	}
+	cfg := opt.Archive
+	start, end, err := ArchiveWindow(cfg)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"call": "ArchiveWindow",
+		}).Errorln(err.Error())
+		return
+	}
+	interval := time.Duration(cfg.Interval) * time.Second
+	if interval <= 0 {
+		interval = archiveDefaultInterval * time.Second
+	}
+	directory := ArchiveDirectory(cfg, streamID, channelID)
+	images, err := ArchiveList(directory, time.Time{}, time.Time{})
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"call": "ArchiveList",
+		}).Errorln(err.Error())
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		channel, err := Storage.StreamChannelInfo(streamID, channelID)
+		if err != nil || !channel.Archive.Enabled {
+			logger.WithFields(logrus.Fields{
+				"call": "StreamChannelInfo",
+			}).Debugln("Stop snapshot archive")
+			return
+		}
+		if ArchiveInWindow(time.Now(), start, end) {
+			image, err := StreamArchiveCapture(channel, directory, logger)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"call": "StreamArchiveCapture",
+				}).Errorln(err.Error())
+			} else {
+				images = append(images, image)
+			}
+		}
+		images = ArchiveRetention(cfg, directory, images, logger)
+		select {
+		case signal := <-opt.archiveSignals:
+			if signal == SignalStreamStop {
+				logger.WithFields(logrus.Fields{
+					"call": "archiveSignals",
+				}).Debugln("Stop snapshot archive")
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+//StreamArchiveCapture save a masked snapshot of the channel into the archive
+func StreamArchiveCapture(channel *ChannelST, directory string, logger *logrus.Entry) (ArchiveImageST, error) {
+	ctx := context.WithValue(context.Background(), "logger", logger)
+	frame, err := channel.Snapshot.Snapshot(ctx)
+	if err != nil {
+		return ArchiveImageST{}, err
+	}
+	// archived images are served later, they are masked like any served snapshot
+	transform, transformed, _ := ParseSnapshotTransform(nil)
+	if channel.Snapshot.privacy != nil || channel.Snapshot.overlay != nil {
+		transform.privacy = channel.Snapshot.privacy
+		transform.overlay = channel.Snapshot.overlay
+		transformed = true
+	}
+	if transformed {
+		if frame, err = channel.Snapshot.Transform(frame, transform); err != nil {
+			return ArchiveImageST{}, err
+		}
+	}
+	now := time.Now().UTC()
+	image := ArchiveImageST{File: ArchiveImagePath(now), Time: now.Truncate(time.Second), Bytes: int64(len(frame.Body))}
+	path := filepath.Join(directory, image.File)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return ArchiveImageST{}, err
+	}
+	// written aside and renamed, listings never see a partial image
+	if err = os.WriteFile(path+".tmp", frame.Body, 0644); err != nil {
+		return ArchiveImageST{}, err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return ArchiveImageST{}, err
+	}
+	return image, nil
+}
+
+//ArchiveRetention delete images older than the retention or exceeding the disk quota
+func ArchiveRetention(cfg ArchiveST, directory string, images []ArchiveImageST, logger *logrus.Entry) []ArchiveImageST {
+	var total int64
+	for _, image := range images {
+		total += image.Bytes
+	}
+	removed := 0
+	for _, image := range images {
+		expired := cfg.RetentionDays > 0 && time.Since(image.Time) > time.Duration(cfg.RetentionDays)*24*time.Hour
+		overQuota := cfg.MaxSizeMB > 0 && total > cfg.MaxSizeMB*1024*1024
+		if !expired && !overQuota {
+			break
+		}
+		path := filepath.Join(directory, image.File)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.WithFields(logrus.Fields{
+				"call": "Remove",
+			}).Errorln(err.Error())
+			break
+		}
+		// remove the date directory once empty
+		os.Remove(filepath.Dir(path))
+		total -= image.Bytes
+		removed++
+	}
+	return images[removed:]
+}
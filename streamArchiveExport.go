@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+)
+
+//Default timelapse options
+const (
+	timelapseDefaultFPS      = 10
+	timelapseMaxFPS          = 60
+	timelapseMaxFrames       = 10000
+	timelapseMaxGIFFrames    = 300
+	timelapseDefaultGIFWidth = 640
+)
+
+//aviWriter MJPEG in AVI writer, sizes and counts are patched into the headers on Close
+type aviWriter struct {
+	file      io.WriteSeeker
+	offset    int64
+	index     bytes.Buffer
+	frames    uint32
+	maxFrame  uint32
+	moviStart int64
+}
+
+//AVI header offsets patched on Close
+const (
+	aviRIFFSize       = 4
+	aviTotalFrames    = 48
+	aviAvihBufferSize = 60
+	aviStrhLength     = 140
+	aviStrhBufferSize = 144
+	aviMoviSize       = 216
+	aviMoviStart      = 220
+)
+
+//newAVIWriter write AVI headers of a single MJPEG video stream
+func newAVIWriter(file io.WriteSeeker, width int, height int, fps int) (*aviWriter, error) {
+	var header bytes.Buffer
+	w := func(values ...interface{}) {
+		for _, value := range values {
+			if fourcc, ok := value.(string); ok {
+				header.WriteString(fourcc)
+				continue
+			}
+			binary.Write(&header, binary.LittleEndian, value)
+		}
+	}
+	w("RIFF", uint32(0), "AVI ")
+	w("LIST", uint32(192), "hdrl")
+	// main header: µs per frame, max bytes per second, padding, flags (has index), frames,
+	// initial frames, streams, buffer size, width, height, reserved
+	w("avih", uint32(56), uint32(1000000/fps), uint32(0), uint32(0), uint32(0x10), uint32(0),
+		uint32(0), uint32(1), uint32(0), uint32(width), uint32(height), [4]uint32{})
+	w("LIST", uint32(116), "strl")
+	// stream header: type, handler, flags, priority, language, initial frames, scale, rate,
+	// start, length, buffer size, quality, sample size, frame rectangle
+	w("strh", uint32(56), "vids", "MJPG", uint32(0), uint16(0), uint16(0), uint32(0), uint32(1),
+		uint32(fps), uint32(0), uint32(0), uint32(0), uint32(0xffffffff), uint32(0),
+		[4]uint16{0, 0, uint16(width), uint16(height)})
+	// BITMAPINFOHEADER of the frames
+	w("strf", uint32(40), uint32(40), int32(width), int32(height), uint16(1), uint16(24), "MJPG",
+		uint32(width*height*3), int32(0), int32(0), uint32(0), uint32(0))
+	w("LIST", uint32(0), "movi")
+	if _, err := file.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return &aviWriter{file: file, offset: int64(header.Len()), moviStart: aviMoviStart}, nil
+}
+
+//WriteFrame append a JPEG frame
+func (element *aviWriter) WriteFrame(frame []byte) error {
+	size := uint32(len(frame))
+	var chunk bytes.Buffer
+	chunk.WriteString("00dc")
+	binary.Write(&chunk, binary.LittleEndian, size)
+	chunk.Write(frame)
+	// chunks are word aligned
+	if size%2 == 1 {
+		chunk.WriteByte(0)
+	}
+	if _, err := element.file.Write(chunk.Bytes()); err != nil {
+		return err
+	}
+	// index entry: chunk id, keyframe flag, offset from the movi list type, size
+	element.index.WriteString("00dc")
+	binary.Write(&element.index, binary.LittleEndian, [3]uint32{0x10, uint32(element.offset - element.moviStart), size})
+	element.offset += int64(chunk.Len())
+	element.frames++
+	if size > element.maxFrame {
+		element.maxFrame = size
+	}
+	return nil
+}
+
+//Close write the index and patch the headers
+func (element *aviWriter) Close() error {
+	moviSize := uint32(element.offset - element.moviStart)
+	var index bytes.Buffer
+	index.WriteString("idx1")
+	binary.Write(&index, binary.LittleEndian, uint32(element.index.Len()))
+	index.Write(element.index.Bytes())
+	if _, err := element.file.Write(index.Bytes()); err != nil {
+		return err
+	}
+	riffSize := uint32(element.offset + int64(index.Len()) - 8)
+	for _, patch := range []struct {
+		offset int64
+		value  uint32
+	}{
+		{aviRIFFSize, riffSize},
+		{aviTotalFrames, element.frames},
+		{aviAvihBufferSize, element.maxFrame},
+		{aviStrhLength, element.frames},
+		{aviStrhBufferSize, element.maxFrame},
+		{aviMoviSize, moviSize},
+	} {
+		if _, err := element.file.Seek(patch.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if err := binary.Write(element.file, binary.LittleEndian, patch.value); err != nil {
+			return err
+		}
+	}
+	_, err := element.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+//timelapseFrames evenly spread selection of at most max images
+func timelapseFrames(images []ArchiveImageST, max int) []ArchiveImageST {
+	if len(images) <= max {
+		return images
+	}
+	selected := make([]ArchiveImageST, 0, max)
+	for i := 0; i < max; i++ {
+		selected = append(selected, images[i*len(images)/max])
+	}
+	return selected
+}
+
+//ArchiveWriteAVI write archived images as a MJPEG AVI, frames of another size than the first are scaled to it
+func ArchiveWriteAVI(file io.WriteSeeker, directory string, images []ArchiveImageST, fps int, width int) error {
+	images = timelapseFrames(images, timelapseMaxFrames)
+	var writer *aviWriter
+	var transform SnapshotTransformST
+	for _, item := range images {
+		body, err := os.ReadFile(filepath.Join(directory, item.File))
+		if err != nil {
+			return err
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			// a corrupt image only loses its frame
+			continue
+		}
+		if writer == nil {
+			transform, _, _ = ParseSnapshotTransform(nil)
+			transform.Width, transform.Height = config.Width, config.Height
+			if width > 0 && width != config.Width {
+				transform.Width, transform.Height = width, config.Height*width/config.Width
+			}
+			transform.Fit = "fill"
+			if writer, err = newAVIWriter(file, transform.Width, transform.Height, fps); err != nil {
+				return err
+			}
+		}
+		if config.Width != transform.Width || config.Height != transform.Height {
+			frame, err := transform.Apply(&SnapshotImageST{Body: body})
+			if err != nil {
+				continue
+			}
+			body = frame.Body
+		}
+		if err = writer.WriteFrame(body); err != nil {
+			return err
+		}
+	}
+	if writer == nil {
+		return ErrorArchiveNotFound
+	}
+	return writer.Close()
+}
+
+//ArchiveWriteGIF write archived images as an animated GIF
+func ArchiveWriteGIF(file io.Writer, directory string, images []ArchiveImageST, fps int, width int) error {
+	images = timelapseFrames(images, timelapseMaxGIFFrames)
+	if width <= 0 {
+		width = timelapseDefaultGIFWidth
+	}
+	animation := &gif.GIF{}
+	transform, _, _ := ParseSnapshotTransform(nil)
+	transform.Width = width
+	var bounds image.Rectangle
+	for _, item := range images {
+		body, err := os.ReadFile(filepath.Join(directory, item.File))
+		if err != nil {
+			return err
+		}
+		if !bounds.Empty() {
+			transform.Height, transform.Fit = bounds.Dy(), "fill"
+		}
+		img, err := transform.Image(&SnapshotImageST{Body: body})
+		if err != nil {
+			continue
+		}
+		bounds = img.Bounds()
+		frame := image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(frame, bounds, img, image.Point{})
+		animation.Image = append(animation.Image, frame)
+		// delays are in hundredths of a second
+		animation.Delay = append(animation.Delay, 100/fps)
+	}
+	if len(animation.Image) == 0 {
+		return ErrorArchiveNotFound
+	}
+	return gif.EncodeAll(file, animation)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeArchiveImage(t *testing.T, directory string, at time.Time, body []byte) ArchiveImageST {
+	image := ArchiveImageST{File: ArchiveImagePath(at), Time: at.UTC().Truncate(time.Second), Bytes: int64(len(body))}
+	path := filepath.Join(directory, image.File)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("MkdirAll() = %v", err)
+	}
+	if err := os.WriteFile(path, body, 0644); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	return image
+}
+
+func encodeJPEG(t *testing.T, bounds image.Rectangle) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, gradientImage(bounds), nil); err != nil {
+		t.Fatalf("jpeg.Encode() = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveExport_AVI(t *testing.T) {
+	directory := t.TempDir()
+	at := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	images := []ArchiveImageST{
+		writeArchiveImage(t, directory, at, encodeJPEG(t, image.Rect(0, 0, 64, 48))),
+		// a corrupt image only loses its frame
+		writeArchiveImage(t, directory, at.Add(time.Second), []byte("not a jpeg")),
+		writeArchiveImage(t, directory, at.Add(2*time.Second), encodeJPEG(t, image.Rect(0, 0, 64, 48))),
+		// scaled to the size of the first frame
+		writeArchiveImage(t, directory, at.Add(3*time.Second), encodeJPEG(t, image.Rect(0, 0, 33, 17))),
+	}
+
+	path := filepath.Join(directory, "timelapse.avi")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if err = ArchiveWriteAVI(file, directory, images, 5, 0); err != nil {
+		t.Fatalf("ArchiveWriteAVI() = %v", err)
+	}
+	file.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() = %v", err)
+	}
+
+	u32 := func(offset int) uint32 {
+		return binary.LittleEndian.Uint32(data[offset:])
+	}
+	if string(data[:4]) != "RIFF" || string(data[8:12]) != "AVI " || int(u32(aviRIFFSize)) != len(data)-8 {
+		t.Fatalf("RIFF header = %q size %v - wanted the file size %v minus 8", data[:12], u32(aviRIFFSize), len(data))
+	}
+	if u32(32) != 200000 || u32(aviTotalFrames) != 3 || u32(aviStrhLength) != 3 || u32(64) != 64 || u32(68) != 48 {
+		t.Errorf("avih µs per frame %v, frames %v, strh length %v, size %vx%v - wanted 200000, 3, 3, 64x48",
+			u32(32), u32(aviTotalFrames), u32(aviStrhLength), u32(64), u32(68))
+	}
+	if string(data[aviMoviSize-4:aviMoviSize]) != "LIST" || string(data[aviMoviStart:aviMoviStart+4]) != "movi" {
+		t.Fatalf("movi list header = %q", data[aviMoviSize-4:aviMoviStart+4])
+	}
+
+	// the index follows the movi list, its offsets are relative to the movi list type
+	idx1 := aviMoviStart + int(u32(aviMoviSize))
+	if idx1+8 > len(data) || string(data[idx1:idx1+4]) != "idx1" || u32(idx1+4) != 3*16 || idx1+8+3*16 != len(data) {
+		t.Fatalf("idx1 at %v of %v bytes = %q", idx1, len(data), data[idx1:])
+	}
+	var maxFrame uint32
+	next := aviMoviStart + 4
+	for i := 0; i < 3; i++ {
+		entry := data[idx1+8+i*16:]
+		offset, size := int(binary.LittleEndian.Uint32(entry[8:])), binary.LittleEndian.Uint32(entry[12:])
+		if string(entry[:4]) != "00dc" || binary.LittleEndian.Uint32(entry[4:]) != 0x10 || aviMoviStart+offset != next {
+			t.Fatalf("idx1 entry %v = %q offset %v - wanted a keyframe at %v", i, entry[:8], offset, next-aviMoviStart)
+		}
+		chunk := data[aviMoviStart+offset:]
+		if string(chunk[:4]) != "00dc" || u32(aviMoviStart+offset+4) != size {
+			t.Fatalf("chunk %v = %q size %v - wanted a 00dc chunk of %v bytes", i, chunk[:4], u32(aviMoviStart+offset+4), size)
+		}
+		config, err := jpeg.DecodeConfig(bytes.NewReader(chunk[8 : 8+size]))
+		if err != nil || config.Width != 64 || config.Height != 48 {
+			t.Errorf("frame %v = %vx%v, %v - wanted a 64x48 JPEG", i, config.Width, config.Height, err)
+		}
+		if size > maxFrame {
+			maxFrame = size
+		}
+		// chunks are word aligned
+		next += 8 + int(size+size%2)
+	}
+	if next != idx1 {
+		t.Errorf("movi list ends at %v - wanted the idx1 offset %v", next, idx1)
+	}
+	if u32(aviAvihBufferSize) != maxFrame || u32(aviStrhBufferSize) != maxFrame {
+		t.Errorf("buffer sizes %v, %v - wanted the largest frame %v", u32(aviAvihBufferSize), u32(aviStrhBufferSize), maxFrame)
+	}
+
+	file, err = os.Create(filepath.Join(directory, "empty.avi"))
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	defer file.Close()
+	if err = ArchiveWriteAVI(file, directory, images[1:2], 5, 0); !errors.Is(err, ErrorArchiveNotFound) {
+		t.Errorf("ArchiveWriteAVI() of corrupt images only = %v - wanted %v", err, ErrorArchiveNotFound)
+	}
+}
+
+func TestArchiveExport_TimelapseFrames(t *testing.T) {
+	var images []ArchiveImageST
+	for i := 0; i < 10; i++ {
+		images = append(images, ArchiveImageST{File: string(rune('a' + i))})
+	}
+
+	tests := []struct {
+		max      int
+		expected string
+	}{
+		{20, "abcdefghij"},
+		{10, "abcdefghij"},
+		{4, "acfh"},
+		{1, "a"},
+	}
+	for _, test := range tests {
+		var got string
+		for _, image := range timelapseFrames(images, test.max) {
+			got += image.File
+		}
+		if got != test.expected {
+			t.Errorf("timelapseFrames(%v) = %q - wanted %q", test.max, got, test.expected)
+		}
+	}
+	if got := timelapseFrames(images[:0], 4); !reflect.DeepEqual(got, images[:0]) {
+		t.Errorf("timelapseFrames() of no image = %v", got)
+	}
+}
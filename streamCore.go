@@ -5,7 +5,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/format/rtspv2"
 	"github.com/sirupsen/logrus"
 )
@@ -35,7 +34,7 @@ func StreamServerRunStreamDo(streamID string, channelID string) {
 			}).Infoln("Exit", err)
 			return
 		}
-		if opt.OnDemand && !Storage.ClientHas(streamID, channelID) {
+		if opt.OnDemand && !opt.DVR.Enabled && !Storage.ClientHas(streamID, channelID) {
 			baseLogger.WithFields(logrus.Fields{
 				"call": "ClientHas",
 			}).Infoln("Stop stream no client")
@@ -63,11 +62,14 @@ func StreamServerRunStream(streamID string, channelID string, opt *ChannelST) (i
 	if url, err := url.Parse(opt.URL); err == nil && strings.ToLower(url.Scheme) == "rtmp" {
 		panic("rtmp support has been removed")
 	}
+	// named credentials are only injected at dial time, they never end up in the config
+	dialURL, err := Storage.CredentialsURL(opt.URL, opt.Credentials)
+	if err != nil {
+		return 0, err
+	}
 	keyTest := time.NewTimer(20 * time.Second)
 	checkClients := time.NewTimer(20 * time.Second)
-	var preKeyTS = time.Duration(0)
-	var Seq []*av.Packet
-	RTSPClient, err := rtspv2.Dial(rtspv2.RTSPClientOptions{URL: opt.URL, InsecureSkipVerify: opt.InsecureSkipVerify, DisableAudio: !opt.Audio, DialTimeout: 3 * time.Second, ReadWriteTimeout: 5 * time.Second, Debug: opt.Debug, OutgoingProxy: true})
+	RTSPClient, err := rtspv2.Dial(rtspv2.RTSPClientOptions{URL: dialURL, InsecureSkipVerify: opt.InsecureSkipVerify, DisableAudio: !opt.Audio, DialTimeout: 3 * time.Second, ReadWriteTimeout: 5 * time.Second, Debug: opt.Debug, OutgoingProxy: true})
 	if err != nil {
 		return 0, err
 	}
@@ -98,7 +100,7 @@ func StreamServerRunStream(streamID string, channelID string, opt *ChannelST) (i
 		select {
 		//Check stream have clients
 		case <-checkClients.C:
-			if opt.OnDemand && !Storage.ClientHas(streamID, channelID) {
+			if opt.OnDemand && !opt.DVR.Enabled && !Storage.ClientHas(streamID, channelID) {
 				return 1, ErrorStreamNoClients
 			}
 			checkClients.Reset(20 * time.Second)
@@ -133,12 +135,13 @@ func StreamServerRunStream(streamID string, channelID string, opt *ChannelST) (i
 
 			if packetAV.IsKeyFrame {
 				keyTest.Reset(20 * time.Second)
-				if preKeyTS > 0 {
-					Seq = []*av.Packet{}
-				}
-				preKeyTS = packetAV.Time
 			}
-			Seq = append(Seq, packetAV)
+			if opt.dvr != nil {
+				opt.dvr.WritePacket(packetAV)
+			}
+			if opt.keyframe != nil {
+				opt.keyframe.WritePacket(packetAV)
+			}
 			Storage.StreamChannelCast(streamID, channelID, packetAV)
 		}
 	}
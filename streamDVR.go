@@ -0,0 +1,252 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/sirupsen/logrus"
+)
+
+//Default DVR options
+const (
+	dvrDefaultDuration = 60
+)
+
+//dvrGOP buffered group of pictures, starting with a keyframe
+type dvrGOP struct {
+	start   time.Time
+	seq     int64
+	packets []*av.Packet
+	walls   []time.Time
+	bytes   int64
+}
+
+//StreamDVR keyframe aligned in-memory ring buffer of a channel
+type StreamDVR struct {
+	mutex    sync.RWMutex
+	duration time.Duration
+	maxBytes int64
+	codecs   []av.CodecData
+	gops     []*dvrGOP
+	bytes    int64
+	lastTime time.Duration
+	// sequence number of the next buffered packet, it keeps growing across resets
+	seq int64
+}
+
+//NewStreamDVR make channel ring buffer
+func NewStreamDVR(cfg DVRST) *StreamDVR {
+	if cfg.Duration <= 0 {
+		cfg.Duration = dvrDefaultDuration
+	}
+	return &StreamDVR{
+		duration: time.Duration(cfg.Duration) * time.Second,
+		maxBytes: cfg.MaxSizeMB * 1024 * 1024,
+	}
+}
+
+//Duration buffered duration target
+func (element *StreamDVR) Duration() time.Duration {
+	return element.duration
+}
+
+//SetCodecs drop buffered packets, which can't be muxed with new codecs
+func (element *StreamDVR) SetCodecs(codecs []av.CodecData) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.codecs = codecs
+	element.gops = nil
+	element.bytes = 0
+}
+
+//WritePacket append packet and drop the GOPs which are no longer needed
+func (element *StreamDVR) WritePacket(pkt *av.Packet) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	now := time.Now()
+	if len(element.gops) > 0 && pkt.Time < element.lastTime {
+		// the ingest was restarted, timestamps start over
+		element.gops = nil
+		element.bytes = 0
+	}
+	element.lastTime = pkt.Time
+	if pkt.IsKeyFrame {
+		element.gops = append(element.gops, &dvrGOP{start: now, seq: element.seq})
+	}
+	if len(element.gops) == 0 {
+		return
+	}
+	gop := element.gops[len(element.gops)-1]
+	gop.packets = append(gop.packets, pkt)
+	gop.walls = append(gop.walls, now)
+	gop.bytes += int64(len(pkt.Data))
+	element.seq++
+	element.bytes += int64(len(pkt.Data))
+	// keep a keyframe at or before the buffer duration, and always the GOP being written
+	for len(element.gops) > 1 {
+		expired := !element.gops[1].start.After(now.Add(-element.duration))
+		overQuota := element.maxBytes > 0 && element.bytes > element.maxBytes
+		if !expired && !overQuota {
+			break
+		}
+		element.bytes -= element.gops[0].bytes
+		element.gops[0] = nil
+		element.gops = element.gops[1:]
+	}
+}
+
+//Oldest wall clock time of the oldest buffered keyframe
+func (element *StreamDVR) Oldest() (time.Time, bool) {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if len(element.gops) == 0 {
+		return time.Time{}, false
+	}
+	return element.gops[0].start, true
+}
+
+//Seek sequence number of the last keyframe at or before at, or of the oldest one
+func (element *StreamDVR) Seek(at time.Time) (int64, error) {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if len(element.gops) == 0 {
+		return 0, ErrorDVRNotBuffered
+	}
+	seq := element.gops[0].seq
+	for _, gop := range element.gops {
+		if !gop.start.After(at) {
+			seq = gop.seq
+		}
+	}
+	return seq, nil
+}
+
+//ReadFrom buffered packets from sequence number seq, with the sequence number following them
+func (element *StreamDVR) ReadFrom(seq int64) ([]*av.Packet, []time.Time, int64) {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	var packets []*av.Packet
+	var walls []time.Time
+	for _, gop := range element.gops {
+		// packets dropped before they were read are skipped up to the oldest keyframe
+		if gop.seq+int64(len(gop.packets)) <= seq {
+			continue
+		}
+		first := 0
+		if seq > gop.seq {
+			first = int(seq - gop.seq)
+		}
+		packets = append(packets, gop.packets[first:]...)
+		walls = append(walls, gop.walls[first:]...)
+	}
+	return packets, walls, element.seq
+}
+
+//Clip buffered packets from the last keyframe at or before from, up to to
+func (element *StreamDVR) Clip(from time.Time, to time.Time) ([]av.CodecData, []*av.Packet, error) {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if len(element.gops) == 0 || element.codecs == nil {
+		return nil, nil, ErrorDVRNotBuffered
+	}
+	first := 0
+	for i, gop := range element.gops {
+		if !gop.start.After(from) {
+			first = i
+		}
+	}
+	var packets []*av.Packet
+	for _, gop := range element.gops[first:] {
+		for i, pkt := range gop.packets {
+			if gop.walls[i].After(to) {
+				return element.codecs, packets, nil
+			}
+			packets = append(packets, pkt)
+		}
+	}
+	return element.codecs, packets, nil
+}
+
+//DVRWriteMP4 write packets to an MP4 file, times are rebased on the first packet
+func DVRWriteMP4(path string, codecs []av.CodecData, packets []*av.Packet) (err error) {
+	tracks, indexes := mp4Tracks(codecs)
+	if len(tracks) == 0 {
+		return ErrorStreamChannelCodecNotFound
+	}
+	if len(packets) == 0 {
+		return ErrorDVRNotBuffered
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// a failed close loses the end of the file, it is reported unless writing failed first
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	muxer := mp4.NewMuxer(file)
+	if err = muxer.WriteHeader(tracks); err != nil {
+		return err
+	}
+	start := packets[0].Time
+	for _, pck := range packets {
+		idx, ok := indexes[pck.Idx]
+		if !ok {
+			continue
+		}
+		pkt := *pck
+		pkt.Idx = idx
+		pkt.Time -= start
+		if err = muxer.WritePacket(pkt); err != nil {
+			return err
+		}
+	}
+	return muxer.WriteTrailer()
+}
+
+//StreamDVRCapture write the [from,to] clip to path once it is buffered
+func StreamDVRCapture(streamID string, channelID string, path string, from time.Time, to time.Time) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "dvr",
+		"stream":  streamID,
+		"channel": channelID,
+		"func":    "StreamDVRCapture",
+	})
+	time.Sleep(time.Until(to))
+	opt, err := Storage.StreamChannelControl(streamID, channelID)
+	if err != nil || opt.dvr == nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "StreamChannelControl",
+		}).Errorln(ErrorDVRDisabled.Error())
+		return
+	}
+	codecs, packets, err := opt.dvr.Clip(from, to)
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Clip",
+		}).Errorln(err.Error())
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "MkdirAll",
+		}).Errorln(err.Error())
+		return
+	}
+	if err = DVRWriteMP4(path, codecs, packets); err != nil {
+		os.Remove(path)
+		requestLogger.WithFields(logrus.Fields{
+			"call": "DVRWriteMP4",
+		}).Errorln(err.Error())
+		return
+	}
+	requestLogger.WithFields(logrus.Fields{
+		"call": "DVRWriteMP4",
+	}).Infoln("Saved capture", path)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/fmp4"
+	"github.com/deepch/vdk/format/ts"
+	"github.com/sirupsen/logrus"
+)
+
+//Default HLS muxer options
+const (
+	hlsFormatTS   = "ts"
+	hlsFormatFMP4 = "fmp4"
+
+	hlsDefaultSegmentDuration = 2
+	hlsDefaultWindowSize      = 6
+	hlsDefaultPartDuration    = 200
+	hlsDefaultIdleTimeout     = 30
+
+	// number of segments, counting from the live edge, which advertise their parts in LL-HLS
+	hlsPartsWindow = 3
+)
+
+//hlsPart partial segment of a LL-HLS playlist
+type hlsPart struct {
+	duration    time.Duration
+	independent bool
+	data        []byte
+}
+
+//hlsSegment media segment, complete once the next keyframe has been muxed
+type hlsSegment struct {
+	msn      int
+	duration time.Duration
+	parts    []*hlsPart
+	data     []byte
+	complete bool
+}
+
+//MuxerHLS in-memory HLS muxer of a single channel
+type MuxerHLS struct {
+	mutex      sync.Mutex
+	opts       HLSST
+	streamID   string
+	channelID  string
+	codecs     []av.CodecData
+	indexes    map[int8]int8
+	init       []byte
+	segments   []*hlsSegment
+	nextMSN    int
+	lastAccess time.Time
+	updated    chan struct{}
+	done       chan struct{}
+	closed     bool
+
+	fragmenter *fmp4.MovieFragmenter
+	tsMuxer    *ts.Muxer
+	tsBuffer   *bytes.Buffer
+
+	segmentStart time.Duration
+	partStart    time.Duration
+	lastTime     time.Duration
+	frameDelta   time.Duration
+	maxDuration  time.Duration
+}
+
+//NewMuxerHLS make HLS muxer for the given channel codecs
+func NewMuxerHLS(streamID string, channelID string, opts HLSST, codecs []av.CodecData) (*MuxerHLS, error) {
+	if opts.Format == "" {
+		opts.Format = hlsFormatTS
+	}
+	if opts.LowLatency {
+		// partial segments are only produced for fragmented MP4
+		opts.Format = hlsFormatFMP4
+	}
+	if opts.SegmentDuration <= 0 {
+		opts.SegmentDuration = hlsDefaultSegmentDuration
+	}
+	if opts.WindowSize <= 0 {
+		opts.WindowSize = hlsDefaultWindowSize
+	}
+	if opts.PartDuration <= 0 {
+		opts.PartDuration = hlsDefaultPartDuration
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = hlsDefaultIdleTimeout
+	}
+	muxer := &MuxerHLS{
+		opts:       opts,
+		streamID:   streamID,
+		channelID:  channelID,
+		indexes:    make(map[int8]int8),
+		lastAccess: time.Now(),
+		updated:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for i, codec := range codecs {
+		switch opts.Format {
+		case hlsFormatTS:
+			if codec.Type() != av.H264 && codec.Type() != av.AAC {
+				continue
+			}
+		case hlsFormatFMP4:
+			if codec.Type() != av.H264 && codec.Type() != av.AAC && codec.Type() != av.OPUS {
+				continue
+			}
+		default:
+			return nil, fmt.Errorf("unknown hls format: %v", opts.Format)
+		}
+		muxer.indexes[int8(i)] = int8(len(muxer.codecs))
+		muxer.codecs = append(muxer.codecs, codec)
+	}
+	if len(muxer.codecs) == 0 {
+		return nil, ErrorStreamChannelCodecNotFound
+	}
+	if opts.Format == hlsFormatFMP4 {
+		fragmenter, err := fmp4.NewMovie(muxer.codecs)
+		if err != nil {
+			return nil, err
+		}
+		_, _, muxer.init = fragmenter.MovieHeader()
+		muxer.fragmenter = fragmenter
+	}
+	return muxer, nil
+}
+
+//SegmentExt file extension of the muxer media segments
+func (element *MuxerHLS) SegmentExt() string {
+	if element.opts.Format == hlsFormatFMP4 {
+		return "m4s"
+	}
+	return "ts"
+}
+
+//Init return fMP4 initialization section
+func (element *MuxerHLS) Init() []byte {
+	return element.init
+}
+
+//Touch mark muxer as used by a viewer
+func (element *MuxerHLS) Touch() {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.lastAccess = time.Now()
+}
+
+//Idle check muxer has no viewers for longer than the idle timeout
+func (element *MuxerHLS) Idle() bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return time.Since(element.lastAccess) > time.Duration(element.opts.IdleTimeout)*time.Second
+}
+
+//Done closed when muxer is stopped
+func (element *MuxerHLS) Done() <-chan struct{} {
+	return element.done
+}
+
+//Close stop muxer and wake up blocked viewers
+func (element *MuxerHLS) Close() {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.closed {
+		return
+	}
+	element.closed = true
+	close(element.done)
+}
+
+//notify wake up blocking playlist reloads, must hold mutex
+func (element *MuxerHLS) notify() {
+	close(element.updated)
+	element.updated = make(chan struct{})
+}
+
+//WritePacket mux packet into the current segment
+func (element *MuxerHLS) WritePacket(pkt av.Packet) error {
+	idx, ok := element.indexes[pkt.Idx]
+	if !ok {
+		return nil
+	}
+	pkt.Idx = idx
+	isVideo := element.codecs[idx].Type().IsVideo()
+
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+
+	if len(element.segments) == 0 {
+		if !isVideo || !pkt.IsKeyFrame {
+			return nil
+		}
+		element.startSegment(pkt.Time)
+	} else if isVideo && pkt.IsKeyFrame && pkt.Time-element.segmentStart >= time.Duration(element.opts.SegmentDuration)*time.Second {
+		if err := element.finishSegment(pkt); err != nil {
+			return err
+		}
+		element.startSegment(pkt.Time)
+		if element.opts.Format == hlsFormatTS {
+			return element.tsMuxer.WritePacket(pkt)
+		}
+		return nil
+	}
+
+	if element.opts.Format == hlsFormatTS {
+		return element.tsMuxer.WritePacket(pkt)
+	}
+	if err := element.fragmenter.WritePacket(pkt); err != nil {
+		return err
+	}
+	if !isVideo {
+		return nil
+	}
+	if pkt.Time > element.lastTime {
+		element.frameDelta = pkt.Time - element.lastTime
+	}
+	element.lastTime = pkt.Time
+	// cut a part when the next frame would exceed the part target
+	if element.opts.LowLatency && pkt.Time+element.frameDelta-element.partStart > time.Duration(element.opts.PartDuration)*time.Millisecond {
+		return element.flushPart(pkt.Time)
+	}
+	return nil
+}
+
+//startSegment open a new segment at the given time, must hold mutex
+func (element *MuxerHLS) startSegment(start time.Duration) {
+	element.segments = append(element.segments, &hlsSegment{msn: element.nextMSN})
+	element.nextMSN++
+	element.segmentStart = start
+	element.partStart = start
+	element.lastTime = start
+	if element.opts.Format == hlsFormatTS {
+		element.tsBuffer = &bytes.Buffer{}
+		element.tsMuxer = ts.NewMuxer(element.tsBuffer)
+		element.tsMuxer.PaddingToMakeCounterCont = true
+		if err := element.tsMuxer.WriteHeader(element.codecs); err != nil {
+			log.WithFields(logrus.Fields{
+				"module":  "hls",
+				"stream":  element.streamID,
+				"channel": element.channelID,
+				"func":    "startSegment",
+				"call":    "WriteHeader",
+			}).Errorln(err.Error())
+		}
+	} else {
+		element.fragmenter.NewSegment()
+	}
+	// drop segments out of the sliding window, keeping the one being written
+	if len(element.segments) > element.opts.WindowSize+1 {
+		element.segments = element.segments[len(element.segments)-element.opts.WindowSize-1:]
+	}
+	element.notify()
+}
+
+//flushPart mux queued packets up to the given time into a part, must hold mutex
+func (element *MuxerHLS) flushPart(end time.Duration) error {
+	frag, err := element.fragmenter.Fragment()
+	if err != nil {
+		return err
+	}
+	if frag.Length == 0 {
+		return nil
+	}
+	segment := element.segments[len(element.segments)-1]
+	segment.parts = append(segment.parts, &hlsPart{
+		duration:    end - element.partStart,
+		independent: frag.Independent,
+		data:        frag.Bytes,
+	})
+	element.partStart = end
+	element.notify()
+	return nil
+}
+
+//finishSegment complete the current segment, pkt is the keyframe opening the next one, must hold mutex
+func (element *MuxerHLS) finishSegment(pkt av.Packet) error {
+	segment := element.segments[len(element.segments)-1]
+	if element.opts.Format == hlsFormatTS {
+		if err := element.tsMuxer.WriteTrailer(); err != nil {
+			return err
+		}
+		segment.data = element.tsBuffer.Bytes()
+	} else {
+		// the keyframe terminates the last fragment and stays queued for the next segment
+		if err := element.fragmenter.WritePacket(pkt); err != nil {
+			return err
+		}
+		if err := element.flushPart(pkt.Time); err != nil {
+			return err
+		}
+		var data []byte
+		for _, part := range segment.parts {
+			data = append(data, part.data...)
+		}
+		segment.data = data
+		if !element.opts.LowLatency {
+			segment.parts = nil
+		}
+	}
+	segment.duration = pkt.Time - element.segmentStart
+	segment.complete = true
+	if segment.duration > element.maxDuration {
+		element.maxDuration = segment.duration
+	}
+	element.notify()
+	return nil
+}
+
+//ready check the playlist position is available, must hold mutex
+func (element *MuxerHLS) ready(msn int, part int) bool {
+	if len(element.segments) == 0 {
+		return false
+	}
+	if msn < 0 {
+		// no blocking request, wait for at least one complete segment
+		return element.segments[0].complete
+	}
+	last := element.segments[len(element.segments)-1]
+	if msn < last.msn {
+		return true
+	}
+	if msn > last.msn {
+		return false
+	}
+	if part < 0 {
+		return last.complete
+	}
+	return part < len(last.parts)
+}
+
+//Wait block until the given media sequence number and part are available, negative values wait for the first segment
+func (element *MuxerHLS) Wait(ctx context.Context, msn int, part int) error {
+	for {
+		element.mutex.Lock()
+		if element.ready(msn, part) {
+			element.mutex.Unlock()
+			return nil
+		}
+		updated := element.updated
+		element.mutex.Unlock()
+		select {
+		case <-updated:
+		case <-element.done:
+			return ErrorStreamNotHLSSegments
+		case <-ctx.Done():
+			return ErrorStreamNotHLSSegments
+		}
+	}
+}
+
+//TooFarAhead check a blocking request is beyond the allowed two segments from the live edge
+func (element *MuxerHLS) TooFarAhead(msn int) bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return msn > element.nextMSN+1
+}
+
+//Segment return complete segment by media sequence number
+func (element *MuxerHLS) Segment(msn int) ([]byte, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	for _, segment := range element.segments {
+		if segment.msn == msn && segment.complete {
+			return segment.data, true
+		}
+	}
+	return nil, false
+}
+
+//Part return part by media sequence number and index
+func (element *MuxerHLS) Part(msn int, index int) ([]byte, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	for _, segment := range element.segments {
+		if segment.msn == msn && index >= 0 && index < len(segment.parts) {
+			return segment.parts[index].data, true
+		}
+	}
+	return nil, false
+}
+
+//Playlist render media playlist, query is appended to every uri
+func (element *MuxerHLS) Playlist(query string) string {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if query != "" {
+		query = "?" + query
+	}
+	var complete []*hlsSegment
+	for _, segment := range element.segments {
+		if segment.complete {
+			complete = append(complete, segment)
+		}
+	}
+	if len(complete) > element.opts.WindowSize {
+		complete = complete[len(complete)-element.opts.WindowSize:]
+	}
+	targetDuration := int(math.Ceil(element.maxDuration.Seconds()))
+	if targetDuration < element.opts.SegmentDuration {
+		targetDuration = element.opts.SegmentDuration
+	}
+	partTarget := float64(element.opts.PartDuration) / 1000
+
+	var out strings.Builder
+	out.WriteString("#EXTM3U\n")
+	switch {
+	case element.opts.LowLatency:
+		out.WriteString("#EXT-X-VERSION:9\n")
+	case element.opts.Format == hlsFormatFMP4:
+		out.WriteString("#EXT-X-VERSION:7\n")
+	default:
+		out.WriteString("#EXT-X-VERSION:3\n")
+	}
+	out.WriteString("#EXT-X-TARGETDURATION:" + strconv.Itoa(targetDuration) + "\n")
+	if len(complete) > 0 {
+		out.WriteString("#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(complete[0].msn) + "\n")
+	}
+	if element.opts.LowLatency {
+		out.WriteString(fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", partTarget*3))
+		out.WriteString(fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget))
+	}
+	if element.opts.Format == hlsFormatFMP4 {
+		out.WriteString("#EXT-X-MAP:URI=\"init.mp4" + query + "\"\n")
+	}
+	for i, segment := range complete {
+		if element.opts.LowLatency && len(complete)-i <= hlsPartsWindow {
+			element.writeParts(&out, segment, query)
+		}
+		out.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", segment.duration.Seconds()))
+		out.WriteString(fmt.Sprintf("segment/%d.%s%s\n", segment.msn, element.SegmentExt(), query))
+	}
+	if element.opts.LowLatency && len(element.segments) > 0 {
+		last := element.segments[len(element.segments)-1]
+		if !last.complete {
+			element.writeParts(&out, last, query)
+			out.WriteString(fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part/%d.%d.m4s%s\"\n", last.msn, len(last.parts), query))
+		}
+	}
+	return out.String()
+}
+
+//writeParts render EXT-X-PART tags of a segment, must hold mutex
+func (element *MuxerHLS) writeParts(out *strings.Builder, segment *hlsSegment, query string) {
+	for i, part := range segment.parts {
+		out.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"part/%d.%d.m4s%s\"", part.duration.Seconds(), segment.msn, i, query))
+		if part.independent {
+			out.WriteString(",INDEPENDENT=YES")
+		}
+		out.WriteString("\n")
+	}
+}
+
+//StreamHLSMuxerRun feed muxer from the channel until it is idle or the channel stops
+func StreamHLSMuxerRun(streamID string, channelID string, muxer *MuxerHLS) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "hls",
+		"stream":  streamID,
+		"channel": channelID,
+		"func":    "StreamHLSMuxerRun",
+	})
+	defer func() {
+		muxer.Close()
+		Storage.StreamChannelHLSMuxerDelete(streamID, channelID, muxer)
+	}()
+	cid, ch, _, _, err := Storage.ClientAdd(streamID, channelID, HLS)
+	if err != nil {
+		requestLogger.WithFields(logrus.Fields{
+			"call": "ClientAdd",
+		}).Errorln(err.Error())
+		return
+	}
+	defer Storage.ClientDelete(streamID, cid, channelID)
+	noVideo := time.NewTimer(10 * time.Second)
+	idleCheck := time.NewTicker(time.Second)
+	defer idleCheck.Stop()
+	for {
+		select {
+		case <-noVideo.C:
+			requestLogger.WithFields(logrus.Fields{
+				"call": "ErrorStreamNoVideo",
+			}).Errorln(ErrorStreamNoVideo.Error())
+			return
+		case <-idleCheck.C:
+			if muxer.Idle() {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "Idle",
+				}).Infoln("Stop hls muxer no viewers")
+				return
+			}
+		case pck := <-ch:
+			if pck.IsKeyFrame {
+				noVideo.Reset(10 * time.Second)
+			}
+			err = muxer.WritePacket(*pck)
+			if err != nil {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "WritePacket",
+				}).Errorln(err.Error())
+				return
+			}
+		}
+	}
+}
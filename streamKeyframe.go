@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+//Default keyframe snapshot options
+const (
+	keyframeWaitTimeout   = 10 * time.Second
+	keyframeFrameDuration = 40 * time.Millisecond
+)
+
+//StreamKeyframe last video keyframe of a channel, the snapshot of channels without snapshot url
+type StreamKeyframe struct {
+	mutex  sync.RWMutex
+	codec  av.CodecData
+	index  int8
+	packet *av.Packet
+	wall   time.Time
+	ready  chan struct{}
+}
+
+//NewStreamKeyframe make channel keyframe holder
+func NewStreamKeyframe() *StreamKeyframe {
+	return &StreamKeyframe{ready: make(chan struct{})}
+}
+
+//SetCodecs keep the video codec, the held keyframe can't be decoded with new codecs
+func (element *StreamKeyframe) SetCodecs(codecs []av.CodecData) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.packet != nil {
+		element.ready = make(chan struct{})
+	}
+	element.codec = nil
+	element.packet = nil
+	for i, codec := range codecs {
+		if codec.Type() == av.H264 || codec.Type() == av.H265 {
+			element.codec = codec
+			element.index = int8(i)
+			return
+		}
+	}
+}
+
+//WritePacket hold the packet when it is a video keyframe
+func (element *StreamKeyframe) WritePacket(pkt *av.Packet) {
+	if !pkt.IsKeyFrame {
+		return
+	}
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.codec == nil || pkt.Idx != element.index {
+		return
+	}
+	if element.packet == nil {
+		close(element.ready)
+	}
+	element.packet = pkt
+	element.wall = time.Now()
+}
+
+//Wait wait for the first keyframe of the channel
+func (element *StreamKeyframe) Wait(ctx context.Context) error {
+	element.mutex.RLock()
+	ready := element.ready
+	element.mutex.RUnlock()
+	timer := time.NewTimer(keyframeWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		return ErrorStreamNoVideo
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Snapshot last keyframe wrapped in a single frame MP4
+func (element *StreamKeyframe) Snapshot() (*SnapshotImageST, error) {
+	element.mutex.RLock()
+	codec, pkt, wall := element.codec, element.packet, element.wall
+	element.mutex.RUnlock()
+	if pkt == nil {
+		return nil, ErrorStreamNoVideo
+	}
+	frame := *pkt
+	frame.Idx = 0
+	frame.Time = 0
+	if frame.Duration <= 0 {
+		frame.Duration = keyframeFrameDuration
+	}
+	// the mp4 muxer needs a seekable writer
+	file, err := os.CreateTemp("", "keyframe-*.mp4")
+	if err != nil {
+		return nil, err
+	}
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+	if err = DVRWriteMP4(path, []av.CodecData{codec}, []*av.Packet{&frame}); err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	return &SnapshotImageST{
+		Body:        body,
+		ContentType: "video/mp4",
+		ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		Modified:    wall,
+		fetched:     wall,
+	}, nil
+}
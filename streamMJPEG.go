@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//Default MJPEG proxy options
+const (
+	mjpegDefaultFPS = 2
+	mjpegMaxFPS     = 30
+)
+
+//StreamMJPEG single upstream MJPEG source of a channel, shared by its viewers
+type StreamMJPEG struct {
+	mutex   sync.Mutex
+	viewers map[chan *SnapshotImageST]struct{}
+	running bool
+}
+
+//NewStreamMJPEG make channel MJPEG proxy
+func NewStreamMJPEG() *StreamMJPEG {
+	return &StreamMJPEG{viewers: make(map[chan *SnapshotImageST]struct{})}
+}
+
+//Join add viewer, the upstream source is started for the first one
+func (element *StreamMJPEG) Join(streamID string, channelID string, maxViewers int) (chan *SnapshotImageST, error) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if maxViewers > 0 && len(element.viewers) >= maxViewers {
+		return nil, ErrorStreamViewerLimit
+	}
+	viewer := make(chan *SnapshotImageST, 1)
+	element.viewers[viewer] = struct{}{}
+	if !element.running {
+		element.running = true
+		go element.run(streamID, channelID)
+	}
+	return viewer, nil
+}
+
+//Leave remove viewer, the upstream source stops with the last one
+func (element *StreamMJPEG) Leave(viewer chan *SnapshotImageST) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	delete(element.viewers, viewer)
+}
+
+//Viewers count of connected viewers
+func (element *StreamMJPEG) Viewers() int {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return len(element.viewers)
+}
+
+//broadcast send frame to viewers, false once there is none left
+func (element *StreamMJPEG) broadcast(frame *SnapshotImageST) bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if len(element.viewers) == 0 {
+		element.running = false
+		return false
+	}
+	for viewer := range element.viewers {
+		// slow viewers skip frames, they always get the latest one
+		select {
+		case <-viewer:
+		default:
+		}
+		viewer <- frame
+	}
+	return true
+}
+
+//idle stop the upstream source when there is no viewer left
+func (element *StreamMJPEG) idle() bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if len(element.viewers) == 0 {
+		element.running = false
+		return true
+	}
+	return false
+}
+
+//refresh reload the channel settings, false once the channel is removed or reconfigured
+func (element *StreamMJPEG) refresh(streamID string, channelID string, channel **ChannelST) bool {
+	tmp, err := Storage.StreamChannelInfo(streamID, channelID)
+	if err != nil || tmp.mjpeg != element {
+		element.close()
+		return false
+	}
+	*channel = tmp
+	return true
+}
+
+//run read the upstream source until the last viewer leaves or the channel is removed
+func (element *StreamMJPEG) run(streamID string, channelID string) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "mjpeg",
+		"stream":  streamID,
+		"channel": channelID,
+		"func":    "StreamMJPEGRun",
+	})
+	requestLogger.WithFields(logrus.Fields{
+		"call": "Start",
+	}).Debugln("Start mjpeg source")
+	defer requestLogger.WithFields(logrus.Fields{
+		"call": "Stop",
+	}).Debugln("Stop mjpeg source")
+	for {
+		var channel *ChannelST
+		if !element.refresh(streamID, channelID, &channel) {
+			return
+		}
+		var err error
+		if channel.Snapshot.Mode == snapshotModeMJPEG {
+			err = element.relay(streamID, channelID, channel, requestLogger)
+		} else {
+			err = element.poll(streamID, channelID, channel, requestLogger)
+		}
+		if err == nil {
+			return
+		}
+		requestLogger.WithFields(logrus.Fields{
+			"call": "Source",
+		}).Errorln(err.Error())
+		time.Sleep(mjpegRetryDelay)
+		if element.idle() {
+			return
+		}
+	}
+}
+
+//close disconnect viewers of a removed channel
+func (element *StreamMJPEG) close() {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	for viewer := range element.viewers {
+		close(viewer)
+		delete(element.viewers, viewer)
+	}
+	element.running = false
+}
+
+//relay forward the frames of the camera MJPEG stream
+func (element *StreamMJPEG) relay(streamID string, channelID string, channel *ChannelST, requestLogger *logrus.Entry) error {
+	if channel.Snapshot.mjpeg != nil {
+		// the camera already streams to the persistent snapshot connection, no second stream is opened
+		return element.follow(streamID, channelID, channel)
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "logger", requestLogger))
+	defer cancel()
+	res, err := channel.Snapshot.RequestSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return snapshotStatusError(res.StatusCode)
+	}
+	reader, err := mjpegReader(res)
+	if err != nil {
+		return err
+	}
+	checked := time.Now()
+	for {
+		frame, err := mjpegFrame(reader)
+		if err != nil {
+			return err
+		}
+		// edited masks apply to the running source
+		if time.Since(checked) >= mjpegCheckInterval {
+			if !element.refresh(streamID, channelID, &channel) {
+				return nil
+			}
+			checked = time.Now()
+		}
+		if frame, err = element.mask(channel, frame); err != nil {
+			return err
+		}
+		if !element.broadcast(frame) {
+			return nil
+		}
+	}
+}
+
+//follow forward the frames of the persistent snapshot connection of the channel
+func (element *StreamMJPEG) follow(streamID string, channelID string, channel *ChannelST) error {
+	source := channel.Snapshot.mjpeg
+	frames := source.Subscribe()
+	defer source.Unsubscribe(frames)
+	stale := time.NewTimer(mjpegStaleTimeout)
+	defer stale.Stop()
+	checked := time.Now()
+	for {
+		select {
+		case frame := <-frames:
+			if !stale.Stop() {
+				<-stale.C
+			}
+			stale.Reset(mjpegStaleTimeout)
+			// edited masks apply to the running source
+			if time.Since(checked) >= mjpegCheckInterval {
+				if !element.refresh(streamID, channelID, &channel) {
+					return nil
+				}
+				checked = time.Now()
+			}
+			frame, err := element.mask(channel, frame)
+			if err != nil {
+				return err
+			}
+			if !element.broadcast(frame) {
+				return nil
+			}
+		case <-stale.C:
+			// the connection is down or reconnecting, viewers may have left meanwhile
+			if !element.refresh(streamID, channelID, &channel) || element.idle() {
+				return nil
+			}
+			return ErrorMJPEGStalled
+		}
+	}
+}
+
+//poll forward channel snapshots at the configured frame rate
+func (element *StreamMJPEG) poll(streamID string, channelID string, channel *ChannelST, requestLogger *logrus.Entry) error {
+	fps := channel.MJPEG.FPS
+	if fps <= 0 {
+		fps = mjpegDefaultFPS
+	}
+	if fps > mjpegMaxFPS {
+		fps = mjpegMaxFPS
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(fps))
+	defer ticker.Stop()
+	ctx := context.WithValue(context.Background(), "logger", requestLogger)
+	var etag string
+	for {
+		frame, err := channel.Snapshot.Snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		if frame.ETag != etag {
+			etag = frame.ETag
+			if frame, err = element.mask(channel, frame); err != nil {
+				return err
+			}
+			if !element.broadcast(frame) {
+				return nil
+			}
+		} else if element.idle() {
+			return nil
+		}
+		<-ticker.C
+		if !element.refresh(streamID, channelID, &channel) {
+			return nil
+		}
+	}
+}
+
+//mask apply the channel privacy masks and overlay to the frame
+func (element *StreamMJPEG) mask(channel *ChannelST, frame *SnapshotImageST) (*SnapshotImageST, error) {
+	if channel.Snapshot.privacy == nil && channel.Snapshot.overlay == nil {
+		return frame, nil
+	}
+	transform, _, _ := ParseSnapshotTransform(nil)
+	transform.privacy = channel.Snapshot.privacy
+	transform.overlay = channel.Snapshot.overlay
+	return channel.Snapshot.Transform(frame, transform)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Default mosaic options
+const (
+	mosaicDefaultWidth       = 1920
+	mosaicDefaultHeight      = 1080
+	mosaicDefaultTileTimeout = 3000
+	mosaicMaxTiles           = 64
+	mosaicLabelSize          = 14
+)
+
+//mosaicBackground colour of the gaps around tiles
+var mosaicBackground = color.RGBA{R: 16, G: 16, B: 16, A: 255}
+
+//mosaicOffline colour of the placeholder of failed tiles
+var mosaicOffline = color.RGBA{R: 48, G: 48, B: 48, A: 255}
+
+//StreamMosaic compose channel snapshots into one grid image
+func StreamMosaic(ctx context.Context, cfg MosaicST) (*image.RGBA, error) {
+	if len(cfg.Channels) == 0 {
+		return nil, snapshotTransformError("mosaic has no channels")
+	}
+	if len(cfg.Channels) > mosaicMaxTiles {
+		return nil, snapshotTransformError(fmt.Sprintf("mosaic is limited to %v channels", mosaicMaxTiles))
+	}
+	if cfg.Width <= 0 {
+		cfg.Width = mosaicDefaultWidth
+	}
+	if cfg.Height <= 0 {
+		cfg.Height = mosaicDefaultHeight
+	}
+	if cfg.Width > snapshotMaxDimension || cfg.Height > snapshotMaxDimension {
+		return nil, snapshotTransformError(fmt.Sprintf("width and height are limited to %v", snapshotMaxDimension))
+	}
+	if cfg.Columns <= 0 {
+		cfg.Columns = int(math.Ceil(math.Sqrt(float64(len(cfg.Channels)))))
+	}
+	if cfg.Columns > len(cfg.Channels) {
+		cfg.Columns = len(cfg.Channels)
+	}
+	if cfg.TileTimeout <= 0 {
+		cfg.TileTimeout = mosaicDefaultTileTimeout
+	}
+	rows := (len(cfg.Channels) + cfg.Columns - 1) / cfg.Columns
+	tileWidth, tileHeight := cfg.Width/cfg.Columns, cfg.Height/rows
+	if tileWidth < 1 || tileHeight < 1 {
+		return nil, snapshotTransformError("mosaic is too small for its channels")
+	}
+	label, err := NewSnapshotOverlay(SnapshotOverlayST{Position: "bottom-left", FontSize: mosaicLabelSize}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(mosaicBackground), image.Point{}, draw.Src)
+	var wg sync.WaitGroup
+	for i, name := range cfg.Channels {
+		x, y := i%cfg.Columns*tileWidth, i/cfg.Columns*tileHeight
+		tile := canvas.SubImage(image.Rect(x, y, x+tileWidth, y+tileHeight)).(*image.RGBA)
+		wg.Add(1)
+		go func(name string, tile *image.RGBA) {
+			defer wg.Done()
+			// a slow camera only blanks its own tile
+			tileCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TileTimeout)*time.Millisecond)
+			defer cancel()
+			title, err := mosaicTile(tileCtx, name, tile)
+			lines := []string{title}
+			if err != nil {
+				draw.Draw(tile, tile.Bounds(), image.NewUniform(mosaicOffline), image.Point{}, draw.Src)
+				lines = append(lines, "offline")
+			}
+			label.DrawLines(tile, lines)
+		}(name, tile)
+	}
+	wg.Wait()
+	return canvas, nil
+}
+
+//mosaicTile draw the masked snapshot of a "stream/channel" into the tile, returns the tile title
+func mosaicTile(ctx context.Context, name string, tile *image.RGBA) (string, error) {
+	streamID, channelID, found := strings.Cut(name, "/")
+	if !found {
+		channelID = "0"
+	}
+	channel, err := Storage.StreamChannelInfo(streamID, channelID)
+	if err != nil {
+		return name, err
+	}
+	title := name
+	if channel.Name != "" {
+		title = channel.Name
+	}
+	if channel.Snapshot.URL == "" {
+		return title, ErrorStreamChannelSnapshotDisabled
+	}
+	source, err := channel.Snapshot.Snapshot(ctx)
+	if err != nil {
+		return title, err
+	}
+	transform, _, _ := ParseSnapshotTransform(nil)
+	transform.Width, transform.Height = tile.Bounds().Dx(), tile.Bounds().Dy()
+	transform.privacy = channel.Snapshot.privacy
+	img, err := transform.Image(source)
+	if err != nil {
+		return title, err
+	}
+	// contain keeps the aspect ratio, the image is centered in the tile
+	offset := image.Pt((tile.Bounds().Dx()-img.Bounds().Dx())/2, (tile.Bounds().Dy()-img.Bounds().Dy())/2)
+	draw.Draw(tile, img.Bounds().Add(tile.Bounds().Min).Add(offset), img, image.Point{}, draw.Src)
+	return title, nil
+}
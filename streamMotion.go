@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//Default motion detection options
+const (
+	motionDefaultInterval    = 1000
+	motionDefaultSensitivity = 50
+	motionDefaultMinArea     = 1.0
+	motionDefaultCooldown    = 5
+	// frames are compared on a grid of this many cells per row
+	motionGridWidth = 64
+)
+
+//motionGrid downsampled luminance of a frame
+type motionGrid struct {
+	width  int
+	height int
+	bounds image.Rectangle
+	cells  []float64
+}
+
+//StreamMotion snapshot motion detector of a channel
+type StreamMotion struct {
+	interval  time.Duration
+	threshold float64
+	minArea   float64
+	cooldown  time.Duration
+	zones     *SnapshotPrivacy
+	webhooks  []string
+}
+
+//NewStreamMotion check motion detection settings
+func NewStreamMotion(cfg MotionST) (*StreamMotion, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = motionDefaultInterval
+	}
+	if cfg.Sensitivity <= 0 || cfg.Sensitivity > 100 {
+		cfg.Sensitivity = motionDefaultSensitivity
+	}
+	if cfg.MinArea <= 0 {
+		cfg.MinArea = motionDefaultMinArea
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = motionDefaultCooldown
+	}
+	// zones share the privacy mask shapes, their mode and colour are ignored
+	zones, err := NewSnapshotPrivacy(cfg.Zones)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamMotion{
+		interval: time.Duration(cfg.Interval) * time.Millisecond,
+		// luminance change of a cell, from 54 at sensitivity 1 down to 5 at 100
+		threshold: 5 + float64(100-cfg.Sensitivity)/2,
+		minArea:   cfg.MinArea / 100,
+		cooldown:  time.Duration(cfg.Cooldown) * time.Second,
+		zones:     zones,
+		webhooks:  cfg.Webhooks,
+	}, nil
+}
+
+//Score fraction of the zone cells which changed between two frames
+func (element *StreamMotion) Score(prev *motionGrid, next *motionGrid) float64 {
+	if prev.width != next.width || prev.height != next.height {
+		return 0
+	}
+	var cells []int
+	var mean float64
+	for i := range next.cells {
+		if element.zones != nil && !element.zones.Contains(next.cellCenter(i)) {
+			continue
+		}
+		cells = append(cells, i)
+		mean += next.cells[i] - prev.cells[i]
+	}
+	if len(cells) == 0 {
+		return 0
+	}
+	// a global brightness change (exposure, lights) is not motion
+	mean /= float64(len(cells))
+	var changed int
+	for _, i := range cells {
+		if math.Abs(next.cells[i]-prev.cells[i]-mean) > element.threshold {
+			changed++
+		}
+	}
+	return float64(changed) / float64(len(cells))
+}
+
+//newMotionGrid decode frame and average its luminance per cell
+func newMotionGrid(body []byte) (*motionGrid, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > snapshotMaxSourcePixels {
+		return nil, snapshotTransformError("camera snapshot is too large")
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	grid := &motionGrid{width: motionGridWidth, bounds: bounds}
+	if bounds.Dx() < grid.width {
+		grid.width = bounds.Dx()
+	}
+	grid.height = bounds.Dy() * grid.width / bounds.Dx()
+	if grid.height < 1 {
+		grid.height = 1
+	}
+	grid.cells = make([]float64, grid.width*grid.height)
+	counts := make([]int, len(grid.cells))
+	ycbcr, isYCbCr := img.(*image.YCbCr)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := (y - bounds.Min.Y) * grid.height / bounds.Dy() * grid.width
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := row + (x-bounds.Min.X)*grid.width/bounds.Dx()
+			// camera JPEGs decode to YCbCr, whose Y plane is the luminance
+			if isYCbCr {
+				grid.cells[i] += float64(ycbcr.Y[ycbcr.YOffset(x, y)])
+			} else {
+				grid.cells[i] += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+			counts[i]++
+		}
+	}
+	for i := range grid.cells {
+		if counts[i] > 0 {
+			grid.cells[i] /= float64(counts[i])
+		}
+	}
+	return grid, nil
+}
+
+//cellCenter camera image pixel at the center of the cell
+func (grid *motionGrid) cellCenter(i int) image.Point {
+	cx, cy := i%grid.width, i/grid.width
+	return image.Pt((2*cx+1)*grid.bounds.Dx()/(2*grid.width), (2*cy+1)*grid.bounds.Dy()/(2*grid.height))
+}
+
+//StreamMotionRun compare channel snapshots until motion detection is removed from the channel
+func StreamMotionRun(streamID string, channelID string) {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "motion",
+		"stream":  streamID,
+		"channel": channelID,
+		"func":    "StreamMotionRun",
+	})
+	opt, err := Storage.StreamChannelInfo(streamID, channelID)
+	if err != nil || opt.motion == nil {
+		return
+	}
+	detector := opt.motion
+	ticker := time.NewTicker(detector.interval)
+	defer ticker.Stop()
+	var prev *motionGrid
+	var etag string
+	var active bool
+	var lastMotion time.Time
+	for {
+		channel, err := Storage.StreamChannelInfo(streamID, channelID)
+		if err != nil || channel.motion != detector {
+			requestLogger.WithFields(logrus.Fields{
+				"call": "StreamChannelInfo",
+			}).Debugln("Stop motion detection")
+			return
+		}
+		frame, err := channel.Snapshot.Snapshot(context.WithValue(context.Background(), "logger", requestLogger))
+		if err != nil {
+			requestLogger.WithFields(logrus.Fields{
+				"call": "Snapshot",
+			}).Warningln(err.Error())
+		} else if frame.ETag != etag {
+			// cached snapshots are only compared once
+			etag = frame.ETag
+			grid, err := newMotionGrid(frame.Body)
+			if err != nil {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "newMotionGrid",
+				}).Warningln(err.Error())
+			} else {
+				if prev != nil {
+					score := detector.Score(prev, grid)
+					now := time.Now()
+					if score >= detector.minArea {
+						lastMotion = now
+						if !active {
+							active = true
+							StreamMotionEvent(streamID, channelID, channel, EventMotionStart, score, frame)
+						}
+					} else if active && now.Sub(lastMotion) >= detector.cooldown {
+						active = false
+						StreamMotionEvent(streamID, channelID, channel, EventMotionStop, score, frame)
+					}
+				}
+				prev = grid
+			}
+		}
+		<-ticker.C
+	}
+}
+
+//StreamMotionEvent publish motion event with the frame, masked like any served snapshot
+func StreamMotionEvent(streamID string, channelID string, channel *ChannelST, eventType string, score float64, frame *SnapshotImageST) {
+	id, err := generateUUID()
+	if err != nil {
+		return
+	}
+	event := EventST{ID: id, Type: eventType, Stream: streamID, Channel: channelID, Time: time.Now().UTC(), Score: score}
+	snapshot := frame
+	if channel.Snapshot.privacy != nil || channel.Snapshot.overlay != nil {
+		transform, _, _ := ParseSnapshotTransform(nil)
+		transform.privacy = channel.Snapshot.privacy
+		transform.overlay = channel.Snapshot.overlay
+		snapshot, err = channel.Snapshot.Transform(frame, transform)
+	}
+	// a frame which can't be masked is not attached
+	if err == nil {
+		event.Snapshot = snapshot.Body
+		event.ContentType = snapshot.ContentType
+	}
+	Storage.EventPublish(event, channel.motion.webhooks)
+}
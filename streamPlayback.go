@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	webrtc "github.com/deepch/vdk/format/webrtcv3"
+	"github.com/sirupsen/logrus"
+)
+
+//Default playback session options
+const (
+	playbackPauseTimeout = 10 * time.Minute
+	// output gap inserted on seeks, keeps timestamps increasing for the muxers
+	playbackSeekGap = 40 * time.Millisecond
+)
+
+//Playback session control actions
+const (
+	PlaybackPause = iota
+	PlaybackResume
+	PlaybackSeek
+)
+
+//playbackControl control request of a playback session
+type playbackControl struct {
+	action int
+	time   time.Time
+	result chan error
+}
+
+//PlaybackStatusST playback session status
+type PlaybackStatusST struct {
+	ID       string     `json:"id"`
+	Stream   string     `json:"stream"`
+	Channel  string     `json:"channel"`
+	Mode     string     `json:"mode"`
+	Paused   bool       `json:"paused"`
+	Position *time.Time `json:"position,omitempty"`
+}
+
+//PlaybackSession real time playback of channel recordings to a WebRTC or HLS viewer
+type PlaybackSession struct {
+	mutex     sync.Mutex
+	id        string
+	streamID  string
+	channelID string
+	reader    *RecordReader
+	webrtc    *webrtc.Muxer
+	hls       *MuxerHLS
+	paused    bool
+	position  time.Time
+	control   chan playbackControl
+	done      chan struct{}
+}
+
+//NewPlaybackSession open channel recordings at the given time
+func NewPlaybackSession(streamID string, channelID string, start time.Time) (*PlaybackSession, error) {
+	opt, err := Storage.StreamChannelControl(streamID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewRecordReader(RecordDirectory(opt.Record, streamID, channelID), start)
+	if err != nil {
+		return nil, err
+	}
+	id, err := generateUUID()
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return &PlaybackSession{
+		id:        id,
+		streamID:  streamID,
+		channelID: channelID,
+		reader:    reader,
+		control:   make(chan playbackControl),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+//ID playback session id
+func (element *PlaybackSession) ID() string {
+	return element.id
+}
+
+//Codecs recording codecs played by the session
+func (element *PlaybackSession) Codecs() []av.CodecData {
+	return element.reader.Codecs()
+}
+
+//HLS muxer of HLS playback sessions
+func (element *PlaybackSession) HLS() *MuxerHLS {
+	return element.hls
+}
+
+//Status playback session status
+func (element *PlaybackSession) Status() PlaybackStatusST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	status := PlaybackStatusST{ID: element.id, Stream: element.streamID, Channel: element.channelID, Mode: "webrtc", Paused: element.paused}
+	if element.hls != nil {
+		status.Mode = "hls"
+	}
+	if !element.position.IsZero() {
+		position := element.position
+		status.Position = &position
+	}
+	return status
+}
+
+//Control pause, resume or seek the playback
+func (element *PlaybackSession) Control(action int, seek time.Time) error {
+	request := playbackControl{action: action, time: seek, result: make(chan error, 1)}
+	select {
+	case element.control <- request:
+		return <-request.result
+	case <-element.done:
+		return ErrorPlaybackNotFound
+	}
+}
+
+//Done closed when the session ends
+func (element *PlaybackSession) Done() <-chan struct{} {
+	return element.done
+}
+
+//StartWebRTC answer viewer offer and start playback with the WebRTC muxer
+func (element *PlaybackSession) StartWebRTC(sdp64 string) (string, error) {
+	muxer := webrtc.NewMuxer(webrtc.Options{ICEServers: Storage.ServerICEServers(), ICEUsername: Storage.ServerICEUsername(), ICECredential: Storage.ServerICECredential(), PortMin: Storage.ServerWebRTCPortMin(), PortMax: Storage.ServerWebRTCPortMax()})
+	answer, err := muxer.WriteHeader(element.reader.Codecs(), sdp64)
+	if err != nil {
+		element.reader.Close()
+		return "", err
+	}
+	element.webrtc = muxer
+	Storage.PlaybackAdd(element)
+	go element.run()
+	return answer, nil
+}
+
+//StartHLS start playback into a dedicated HLS muxer
+func (element *PlaybackSession) StartHLS(opts HLSST) error {
+	muxer, err := NewMuxerHLS(element.streamID, element.channelID, opts, element.reader.Codecs())
+	if err != nil {
+		element.reader.Close()
+		return err
+	}
+	element.hls = muxer
+	Storage.PlaybackAdd(element)
+	go element.run()
+	return nil
+}
+
+//writePacket send packet to the session muxer
+func (element *PlaybackSession) writePacket(pkt av.Packet) error {
+	if element.hls != nil {
+		return element.hls.WritePacket(pkt)
+	}
+	return element.webrtc.WritePacket(pkt)
+}
+
+//run pace recorded packets in real time until the recording ends or the viewer leaves
+func (element *PlaybackSession) run() {
+	requestLogger := log.WithFields(logrus.Fields{
+		"module":  "playback",
+		"stream":  element.streamID,
+		"channel": element.channelID,
+		"func":    "PlaybackSessionRun",
+	})
+	defer func() {
+		close(element.done)
+		element.reader.Close()
+		if element.hls != nil {
+			element.hls.Close()
+		} else {
+			element.webrtc.Close()
+		}
+		Storage.PlaybackDelete(element.id)
+	}()
+
+	// output time of a packet is offset + reader time, it is sent at clock + output time
+	var offset, last time.Duration
+	var pending *av.Packet
+	var pausedAt time.Time
+	var ended bool
+	clock := time.Now()
+	wait := time.NewTimer(0)
+	idleCheck := time.NewTicker(time.Second)
+	defer idleCheck.Stop()
+	for {
+		if pending == nil && !element.paused && !ended {
+			pkt, wall, err := element.reader.ReadPacket()
+			if errors.Is(err, io.EOF) {
+				// keep the session for seeks and for HLS viewers fetching the last segments
+				ended = true
+				pausedAt = time.Now()
+				continue
+			}
+			if err != nil {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "ReadPacket",
+				}).Errorln(err.Error())
+				return
+			}
+			pkt.Time += offset
+			pending = &pkt
+			element.mutex.Lock()
+			element.position = wall
+			element.mutex.Unlock()
+			playbackTimerReset(wait, time.Until(clock.Add(pkt.Time)))
+		}
+		select {
+		case request := <-element.control:
+			var err error
+			element.mutex.Lock()
+			switch request.action {
+			case PlaybackPause:
+				if !element.paused {
+					element.paused = true
+					pausedAt = time.Now()
+				}
+			case PlaybackResume:
+				if element.paused {
+					element.paused = false
+					clock = clock.Add(time.Since(pausedAt))
+					if pending != nil {
+						playbackTimerReset(wait, time.Until(clock.Add(pending.Time)))
+					}
+				}
+			case PlaybackSeek:
+				err = element.reader.Seek(request.time)
+				if err == nil {
+					pending = nil
+					ended = false
+					element.position = request.time
+					offset = last + playbackSeekGap
+					clock = time.Now().Add(-offset)
+					pausedAt = time.Now()
+				}
+			}
+			element.mutex.Unlock()
+			request.result <- err
+			if err != nil && !errors.Is(err, ErrorRecordNotFound) {
+				// the reader moved to footage the muxer can't play
+				requestLogger.WithFields(logrus.Fields{
+					"call": "Seek",
+				}).Errorln(err.Error())
+				return
+			}
+		case <-idleCheck.C:
+			if (element.paused || ended) && time.Since(pausedAt) > playbackPauseTimeout {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "Paused",
+				}).Infoln("Stop playback paused for too long")
+				return
+			}
+			if element.hls != nil && element.hls.Idle() {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "Idle",
+				}).Infoln("Stop playback no viewers")
+				return
+			}
+		case <-wait.C:
+			if pending == nil || element.paused {
+				continue
+			}
+			if err := element.writePacket(*pending); err != nil {
+				requestLogger.WithFields(logrus.Fields{
+					"call": "WritePacket",
+				}).Errorln(err.Error())
+				return
+			}
+			last = pending.Time
+			pending = nil
+		}
+	}
+}
+
+//playbackTimerReset reset timer dropping a pending expiration
+func playbackTimerReset(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
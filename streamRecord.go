@@ -0,0 +1,361 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/fmp4"
+	"github.com/sirupsen/logrus"
+)
+
+//recordSegmentWriter fMP4 segment file being written
+type recordSegmentWriter struct {
+	file       *os.File
+	fragmenter *fmp4.MovieFragmenter
+	segment    RecordSegmentST
+	startTime  time.Duration
+	lastTime   time.Duration
+}
+
+//StreamRecorder continuous recorder of a single channel
+type StreamRecorder struct {
+	streamID  string
+	channelID string
+	cfg       RecordST
+	directory string
+	codecs    []av.CodecData
+	indexes   map[int8]int8
+	segments  []RecordSegmentST
+	writer    *recordSegmentWriter
+	status    RecordStatusST
+	logger    *logrus.Entry
+
+	// end of the last closed segment, so that rotated segments are contiguous
+	lastEnd     time.Time
+	lastEndTime time.Duration
+}
+
+//StreamRecordRun record channel packets to disk until the recorder is stopped
+func StreamRecordRun(streamID string, channelID string) {
+	logger := log.WithFields(logrus.Fields{
+		"module":  "record",
+		"stream":  streamID,
+		"channel": channelID,
+		"func":    "StreamRecordRun",
+	})
+	opt, err := Storage.StreamChannelControl(streamID, channelID)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"call": "StreamChannelControl",
+		}).Errorln(err.Error())
+		return
+	}
+	recorder := &StreamRecorder{
+		streamID:  streamID,
+		channelID: channelID,
+		cfg:       opt.Record,
+		directory: RecordDirectory(opt.Record, streamID, channelID),
+		logger:    logger,
+	}
+	if recorder.cfg.SegmentDuration <= 0 {
+		recorder.cfg.SegmentDuration = recordDefaultSegmentDuration
+	}
+	recorder.segments, err = RecordIndexLoad(recorder.directory)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"call": "RecordIndexLoad",
+		}).Errorln(err.Error())
+	}
+	recorder.applyRetention()
+	defer func() {
+		recorder.closeSegment()
+		recorder.status.Recording = false
+		recorder.updateStatus()
+	}()
+
+	// the recorder is a regular client, which keeps on demand channels running
+	cid, ch, _, signals, err := Storage.ClientAdd(streamID, channelID, RECORD)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"call": "ClientAdd",
+		}).Errorln(err.Error())
+		return
+	}
+	defer func() {
+		Storage.ClientDelete(streamID, cid, channelID)
+	}()
+	Storage.StreamChannelRun(streamID, channelID)
+
+	noVideo := time.NewTimer(10 * time.Second)
+	retention := time.NewTicker(time.Minute)
+	defer retention.Stop()
+	for {
+		select {
+		case signal := <-opt.recordSignals:
+			if signal == SignalStreamStop {
+				logger.WithFields(logrus.Fields{
+					"call": "recordSignals",
+				}).Infoln("Stop recording")
+				return
+			}
+		case signal := <-signals:
+			if signal != SignalStreamStop {
+				continue
+			}
+			// the recorder fell behind and packets were dropped, the segment ends before the gap
+			// and the next one starts at a keyframe of a new subscription without the backlog
+			logger.WithFields(logrus.Fields{
+				"call": "signals",
+			}).Warningln("Recorder too slow, restarting at the next keyframe")
+			recorder.closeSegment()
+			// subscribe before leaving so on demand channels never run out of clients
+			stale := cid
+			cid, ch, _, signals, err = Storage.ClientAdd(streamID, channelID, RECORD)
+			Storage.ClientDelete(streamID, stale, channelID)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"call": "ClientAdd",
+				}).Errorln(err.Error())
+				return
+			}
+		case <-retention.C:
+			recorder.applyRetention()
+		case <-noVideo.C:
+			// the ingest gave up, close the segment and keep the channel alive
+			recorder.closeSegment()
+			recorder.codecs = nil
+			recorder.status.Recording = false
+			recorder.status.Error = ErrorStreamNoVideo.Error()
+			recorder.updateStatus()
+			if !Storage.StreamChannelExist(streamID, channelID) {
+				return
+			}
+			Storage.StreamChannelRun(streamID, channelID)
+			noVideo.Reset(10 * time.Second)
+		case pck := <-ch:
+			if pck.IsKeyFrame {
+				noVideo.Reset(10 * time.Second)
+			}
+			if err := recorder.writePacket(*pck); err != nil {
+				logger.WithFields(logrus.Fields{
+					"call": "writePacket",
+				}).Errorln(err.Error())
+				recorder.closeSegment()
+				recorder.status.Error = err.Error()
+				recorder.updateStatus()
+			}
+		}
+	}
+}
+
+//setupCodecs select channel tracks supported by the fMP4 fragmenter
+func (element *StreamRecorder) setupCodecs() error {
+	codecs, err := Storage.StreamChannelCodecs(element.streamID, element.channelID)
+	if err != nil {
+		return err
+	}
+	element.codecs = nil
+	element.indexes = make(map[int8]int8)
+	for i, codec := range codecs {
+		switch codec.Type() {
+		case av.H264, av.AAC, av.OPUS:
+			element.indexes[int8(i)] = int8(len(element.codecs))
+			element.codecs = append(element.codecs, codec)
+		}
+	}
+	if len(element.codecs) == 0 {
+		return ErrorStreamChannelCodecNotFound
+	}
+	return nil
+}
+
+//writePacket write packet to the current segment, rotating segments on keyframes
+func (element *StreamRecorder) writePacket(pkt av.Packet) error {
+	orig := pkt
+	if element.writer == nil {
+		if !pkt.IsKeyFrame {
+			return nil
+		}
+		if element.codecs == nil {
+			if err := element.setupCodecs(); err != nil {
+				return err
+			}
+		}
+	}
+	idx, ok := element.indexes[pkt.Idx]
+	if !ok {
+		return nil
+	}
+	pkt.Idx = idx
+	isVideo := element.codecs[idx].Type().IsVideo()
+	if element.writer == nil {
+		if !isVideo {
+			return nil
+		}
+		if err := element.openSegment(pkt); err != nil {
+			return err
+		}
+	}
+	writer := element.writer
+	if pkt.Time < writer.startTime {
+		// timestamps went backwards, the ingest was restarted and codecs might have changed
+		element.closeSegment()
+		element.codecs = nil
+		return element.writePacket(orig)
+	}
+	pkt.Time -= writer.startTime
+	if err := writer.fragmenter.WritePacket(pkt); err != nil {
+		return err
+	}
+	if !isVideo || !pkt.IsKeyFrame || pkt.Time == 0 {
+		return nil
+	}
+	// the keyframe terminates the previous GOP, which is flushed as one fragment
+	if err := element.flushFragment(); err != nil {
+		return err
+	}
+	writer.lastTime = pkt.Time
+	if pkt.Time >= time.Duration(element.cfg.SegmentDuration)*time.Second {
+		element.closeSegment()
+		return element.writePacket(orig)
+	}
+	return nil
+}
+
+//flushFragment write queued packets of the current segment
+func (element *StreamRecorder) flushFragment() error {
+	frag, err := element.writer.fragmenter.Fragment()
+	if err != nil {
+		return err
+	}
+	if frag.Length == 0 {
+		return nil
+	}
+	n, err := element.writer.file.Write(frag.Bytes)
+	element.writer.segment.Bytes += int64(n)
+	return err
+}
+
+//openSegment create a new segment file starting with the given keyframe
+func (element *StreamRecorder) openSegment(pkt av.Packet) error {
+	fragmenter, err := fmp4.NewMovie(element.codecs)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if !element.lastEnd.IsZero() && pkt.Time == element.lastEndTime {
+		start = element.lastEnd
+	}
+	segment := RecordSegmentST{File: RecordSegmentPath(start), Start: start.UTC()}
+	path := filepath.Join(element.directory, segment.File)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, _, header := fragmenter.MovieHeader()
+	n, err := file.Write(header)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	segment.Bytes = int64(n)
+	element.writer = &recordSegmentWriter{
+		file:       file,
+		fragmenter: fragmenter,
+		segment:    segment,
+		startTime:  pkt.Time,
+	}
+	element.status.Recording = true
+	element.status.Segment = segment.File
+	element.status.Error = ""
+	element.updateStatus()
+	return nil
+}
+
+//closeSegment finish the current segment and add it to the index
+func (element *StreamRecorder) closeSegment() {
+	writer := element.writer
+	if writer == nil {
+		return
+	}
+	element.writer = nil
+	err := writer.file.Close()
+	if err != nil {
+		element.logger.WithFields(logrus.Fields{
+			"call": "Close",
+		}).Errorln(err.Error())
+	}
+	segment := writer.segment
+	segment.End = segment.Start.Add(writer.lastTime)
+	element.lastEnd, element.lastEndTime = segment.End, writer.startTime+writer.lastTime
+	if writer.lastTime == 0 {
+		// nothing was flushed besides the header
+		os.Remove(filepath.Join(element.directory, segment.File))
+		return
+	}
+	if err := RecordIndexAppend(element.directory, segment); err != nil {
+		element.logger.WithFields(logrus.Fields{
+			"call": "RecordIndexAppend",
+		}).Errorln(err.Error())
+	}
+	element.segments = append(element.segments, segment)
+	element.status.Segment = ""
+	element.updateStatus()
+}
+
+//applyRetention delete segments older than the retention or exceeding the disk quota
+func (element *StreamRecorder) applyRetention() {
+	var total int64
+	for _, segment := range element.segments {
+		total += segment.Bytes
+	}
+	removed := 0
+	for _, segment := range element.segments {
+		expired := element.cfg.RetentionDays > 0 && time.Since(segment.End) > time.Duration(element.cfg.RetentionDays)*24*time.Hour
+		overQuota := element.cfg.MaxSizeMB > 0 && total > element.cfg.MaxSizeMB*1024*1024
+		if !expired && !overQuota {
+			break
+		}
+		path := filepath.Join(element.directory, segment.File)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			element.logger.WithFields(logrus.Fields{
+				"call": "Remove",
+			}).Errorln(err.Error())
+			break
+		}
+		// remove the date directory once empty
+		os.Remove(filepath.Dir(path))
+		total -= segment.Bytes
+		removed++
+	}
+	if removed > 0 {
+		element.segments = element.segments[removed:]
+		if err := RecordIndexWrite(element.directory, element.segments); err != nil {
+			element.logger.WithFields(logrus.Fields{
+				"call": "RecordIndexWrite",
+			}).Errorln(err.Error())
+		}
+	}
+	element.updateStatus()
+}
+
+//updateStatus publish recording status to the channel status API
+func (element *StreamRecorder) updateStatus() {
+	status := element.status
+	status.Segments = len(element.segments)
+	status.Bytes = 0
+	for _, segment := range element.segments {
+		status.Bytes += segment.Bytes
+	}
+	status.Oldest, status.Newest = nil, nil
+	if len(element.segments) > 0 {
+		oldest, newest := element.segments[0].Start, element.segments[len(element.segments)-1].End
+		status.Oldest, status.Newest = &oldest, &newest
+	}
+	Storage.StreamChannelRecordStatus(element.streamID, element.channelID, status)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/opusparser"
+	"github.com/deepch/vdk/format/fmp4/fmp4io"
+)
+
+// gaps between segments longer than this are skipped, so that playback and exports stay continuous
+const recordMaxGap = time.Second
+
+//recordTrack track of a recorded segment file
+type recordTrack struct {
+	idx       int8
+	timeScale uint32
+}
+
+//recordSample packet read back from a segment file, with its recording wall clock time
+type recordSample struct {
+	packet av.Packet
+	wall   time.Time
+}
+
+//RecordReader sequential packet reader over the recorded segments of a channel
+type RecordReader struct {
+	directory string
+	segments  []RecordSegmentST
+	current   int
+	codecs    []av.CodecData
+	file      *os.File
+	tracks    map[uint32]recordTrack
+	fragments []*fmp4io.MovieFrag
+	fragment  int
+	queue     []recordSample
+	segStart  time.Time
+	origin    time.Time
+	skipped   time.Duration
+	lastWall  time.Time
+}
+
+//NewRecordReader open channel recordings positioned on the last keyframe at or before start
+func NewRecordReader(directory string, start time.Time) (*RecordReader, error) {
+	segments, err := RecordIndexLoad(directory)
+	if err != nil {
+		return nil, err
+	}
+	reader := &RecordReader{directory: directory, segments: segments}
+	if err := reader.Seek(start); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+//Codecs return codecs of the recording, fixed for the lifetime of the reader
+func (element *RecordReader) Codecs() []av.CodecData {
+	return element.codecs
+}
+
+//Seek reposition the reader on the last keyframe at or before the given time
+func (element *RecordReader) Seek(start time.Time) error {
+	// the first segment ending after start, which is the one holding it unless start falls in a gap
+	i := sort.Search(len(element.segments), func(i int) bool {
+		return element.segments[i].End.After(start)
+	})
+	if i == len(element.segments) {
+		return ErrorRecordNotFound
+	}
+	codecs := element.codecs
+	if err := element.openSegment(i); err != nil {
+		return err
+	}
+	if codecs != nil && !recordCodecsEqual(codecs, element.codecs) {
+		// muxers already received the previous codecs, the caller has to start over
+		return ErrorRecordCodecChanged
+	}
+	element.fragment = 0
+	for j, frag := range element.fragments {
+		if t, ok := element.fragmentTime(frag); ok && !t.After(start) {
+			element.fragment = j
+		}
+	}
+	element.queue = nil
+	element.skipped = 0
+	element.origin = time.Time{}
+	element.lastWall = time.Time{}
+	return nil
+}
+
+//ReadPacket read the next packet, its time is relative to the first packet read after the last seek
+func (element *RecordReader) ReadPacket() (av.Packet, time.Time, error) {
+	for len(element.queue) == 0 {
+		if element.fragment >= len(element.fragments) {
+			if element.current+1 >= len(element.segments) {
+				return av.Packet{}, time.Time{}, io.EOF
+			}
+			codecs := element.codecs
+			if err := element.openSegment(element.current + 1); err != nil {
+				return av.Packet{}, time.Time{}, err
+			}
+			if !recordCodecsEqual(codecs, element.codecs) {
+				// the camera was reconfigured, stitching can't continue with the same muxer
+				return av.Packet{}, time.Time{}, io.EOF
+			}
+			continue
+		}
+		if err := element.readFragment(element.fragments[element.fragment]); err != nil {
+			return av.Packet{}, time.Time{}, err
+		}
+		element.fragment++
+	}
+	sample := element.queue[0]
+	element.queue = element.queue[1:]
+	if element.origin.IsZero() {
+		element.origin = sample.wall
+	} else if gap := sample.wall.Sub(element.lastWall); gap > recordMaxGap {
+		element.skipped += gap - recordMaxGap
+	}
+	if sample.wall.After(element.lastWall) {
+		element.lastWall = sample.wall
+	}
+	sample.packet.Time = sample.wall.Sub(element.origin) - element.skipped
+	return sample.packet, sample.wall, nil
+}
+
+//Close release the current segment file
+func (element *RecordReader) Close() error {
+	if element.file == nil {
+		return nil
+	}
+	err := element.file.Close()
+	element.file = nil
+	return err
+}
+
+//openSegment open segment file and parse its tracks and fragments
+func (element *RecordReader) openSegment(i int) error {
+	element.Close()
+	segment := element.segments[i]
+	file, err := os.Open(filepath.Join(element.directory, segment.File))
+	if err != nil {
+		return err
+	}
+	atoms, err := fmp4io.ReadFileAtoms(file)
+	// the segment being recorded can end with an incomplete fragment, use what was read
+	if err != nil && len(atoms) == 0 {
+		file.Close()
+		return err
+	}
+	element.file = file
+	element.current = i
+	element.segStart = segment.Start
+	element.fragments = nil
+	element.fragment = 0
+	element.codecs = nil
+	element.tracks = make(map[uint32]recordTrack)
+	for _, atom := range atoms {
+		switch atom := atom.(type) {
+		case *fmp4io.Movie:
+			for _, track := range atom.Tracks {
+				codec, err := recordTrackCodec(track)
+				if err != nil {
+					return err
+				}
+				element.tracks[track.Header.TrackID] = recordTrack{idx: int8(len(element.codecs)), timeScale: track.Media.Header.TimeScale}
+				element.codecs = append(element.codecs, codec)
+			}
+		case *fmp4io.MovieFrag:
+			element.fragments = append(element.fragments, atom)
+		}
+	}
+	if len(element.codecs) == 0 {
+		return ErrorStreamChannelCodecNotFound
+	}
+	return nil
+}
+
+//fragmentTime wall clock time of the fragment video track start
+func (element *RecordReader) fragmentTime(frag *fmp4io.MovieFrag) (time.Time, bool) {
+	for _, trackFrag := range frag.Tracks {
+		track, ok := element.tracks[trackFrag.Header.TrackID]
+		if !ok || trackFrag.DecodeTime == nil || !element.codecs[track.idx].Type().IsVideo() {
+			continue
+		}
+		return element.segStart.Add(recordScaleToTime(trackFrag.DecodeTime.Time, track.timeScale)), true
+	}
+	return time.Time{}, false
+}
+
+//readFragment queue fragment samples of all tracks ordered by time
+func (element *RecordReader) readFragment(frag *fmp4io.MovieFrag) error {
+	moofOffset, _ := frag.Pos()
+	for _, trackFrag := range frag.Tracks {
+		track, ok := element.tracks[trackFrag.Header.TrackID]
+		if !ok || trackFrag.Run == nil || trackFrag.DecodeTime == nil {
+			continue
+		}
+		header := trackFrag.Header
+		run := trackFrag.Run
+		isVideo := element.codecs[track.idx].Type().IsVideo()
+		dts := trackFrag.DecodeTime.Time
+		offset := int64(moofOffset) + int64(run.DataOffset)
+		for i, entry := range run.Entries {
+			if run.Flags&fmp4io.TrackRunSampleDuration == 0 {
+				entry.Duration = header.DefaultDuration
+			}
+			if run.Flags&fmp4io.TrackRunSampleSize == 0 {
+				entry.Size = header.DefaultSize
+			}
+			if run.Flags&fmp4io.TrackRunSampleFlags == 0 {
+				entry.Flags = header.DefaultFlags
+				if i == 0 && run.Flags&fmp4io.TrackRunFirstSampleFlags != 0 {
+					entry.Flags = run.FirstSampleFlags
+				}
+			}
+			data := make([]byte, entry.Size)
+			if _, err := element.file.ReadAt(data, offset); err != nil {
+				if errors.Is(err, io.EOF) {
+					// incomplete fragment of the segment being recorded
+					break
+				}
+				return err
+			}
+			offset += int64(entry.Size)
+			element.queue = append(element.queue, recordSample{
+				packet: av.Packet{
+					Idx:             track.idx,
+					IsKeyFrame:      isVideo && entry.Flags&fmp4io.SampleIsNonSync == 0,
+					Data:            data,
+					Duration:        recordScaleToTime(uint64(entry.Duration), track.timeScale),
+					CompositionTime: time.Duration(entry.CTS) * time.Second / time.Duration(track.timeScale),
+				},
+				wall: element.segStart.Add(recordScaleToTime(dts, track.timeScale)),
+			})
+			dts += uint64(entry.Duration)
+		}
+	}
+	sort.SliceStable(element.queue, func(i, j int) bool {
+		return element.queue[i].wall.Before(element.queue[j].wall)
+	})
+	return nil
+}
+
+//recordScaleToTime convert track time scale units to duration
+func recordScaleToTime(ts uint64, timeScale uint32) time.Duration {
+	if timeScale == 0 {
+		return 0
+	}
+	return time.Duration(ts/uint64(timeScale))*time.Second + time.Duration(ts%uint64(timeScale))*time.Second/time.Duration(timeScale)
+}
+
+//recordTrackCodec codec data of a recorded track sample description
+func recordTrackCodec(track *fmp4io.Track) (av.CodecData, error) {
+	if track.Media == nil || track.Media.Info == nil || track.Media.Info.Sample == nil || track.Media.Info.Sample.SampleDesc == nil {
+		return nil, ErrorStreamChannelCodecNotFound
+	}
+	desc := track.Media.Info.Sample.SampleDesc
+	switch {
+	case desc.AVC1Desc != nil && desc.AVC1Desc.Conf != nil:
+		return h264parser.NewCodecDataFromAVCDecoderConfRecord(desc.AVC1Desc.Conf.Data)
+	case desc.MP4ADesc != nil && desc.MP4ADesc.Conf != nil && desc.MP4ADesc.Conf.StreamDescriptor != nil && desc.MP4ADesc.Conf.StreamDescriptor.DecoderConfig != nil:
+		return aacparser.NewCodecDataFromMPEG4AudioConfigBytes(desc.MP4ADesc.Conf.StreamDescriptor.DecoderConfig.AudioSpecific)
+	case desc.OpusDesc != nil:
+		return opusparser.NewCodecData(int(desc.OpusDesc.NumberOfChannels)), nil
+	}
+	return nil, ErrorStreamChannelCodecNotFound
+}
+
+//recordCodecsEqual check two recordings can be stitched without a new header
+func recordCodecsEqual(a []av.CodecData, b []av.CodecData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type() != b[i].Type() {
+			return false
+		}
+		switch codec := a[i].(type) {
+		case h264parser.CodecData:
+			if !bytes.Equal(codec.AVCDecoderConfRecordBytes(), b[i].(h264parser.CodecData).AVCDecoderConfRecordBytes()) {
+				return false
+			}
+		case aacparser.CodecData:
+			if !bytes.Equal(codec.MPEG4AudioConfigBytes(), b[i].(aacparser.CodecData).MPEG4AudioConfigBytes()) {
+				return false
+			}
+		}
+	}
+	return true
+}
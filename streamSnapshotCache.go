@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//snapshotHostLimits camera request slots shared by the channels of a host
+var snapshotHostLimits = make(map[string]chan struct{})
+var snapshotHostLimitsMutex sync.Mutex
+
+//snapshotHostLimit get request slots of the snapshot URL host, nil when unlimited
+func snapshotHostLimit(rawURL string, limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	snapshotHostLimitsMutex.Lock()
+	defer snapshotHostLimitsMutex.Unlock()
+	// the first channel configured for a host sets its limit
+	slots, ok := snapshotHostLimits[uri.Host]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		snapshotHostLimits[uri.Host] = slots
+	}
+	return slots
+}
+
+//snapshotCall camera request shared by concurrent callers
+type snapshotCall struct {
+	done  chan struct{}
+	image *SnapshotImageST
+	err   error
+}
+
+//SnapshotCache coalesced and cached camera snapshots of a channel
+type SnapshotCache struct {
+	mutex  sync.Mutex
+	config SnapshotST
+	maxAge time.Duration
+	limit  chan struct{}
+	image  *SnapshotImageST
+	call   *snapshotCall
+	// transformed images of the variants source
+	source   *SnapshotImageST
+	variants map[string]*SnapshotImageST
+}
+
+//NewSnapshotCache make channel snapshot cache
+func NewSnapshotCache(cfg SnapshotST) *SnapshotCache {
+	maxAge := time.Duration(cfg.MaxAge) * time.Second
+	// a refreshed image stays valid until the refresh after the next one is late
+	if refresh := 2 * time.Duration(cfg.RefreshInterval) * time.Second; refresh > maxAge {
+		maxAge = refresh
+	}
+	cfg.cache = nil
+	return &SnapshotCache{
+		config: cfg,
+		maxAge: maxAge,
+		limit:  snapshotHostLimit(cfg.URL, cfg.MaxConcurrent),
+	}
+}
+
+//Get cached image younger than max age, or join the pending camera request
+func (element *SnapshotCache) Get(ctx context.Context) (*SnapshotImageST, error) {
+	element.mutex.Lock()
+	if element.image != nil && time.Since(element.image.fetched) <= element.maxAge {
+		image := element.image
+		element.mutex.Unlock()
+		return image, nil
+	}
+	call := element.start(ctx.Value("logger"))
+	element.mutex.Unlock()
+	select {
+	case <-call.done:
+		return call.image, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//start camera request unless one is pending, called with the mutex held
+func (element *SnapshotCache) start(logger interface{}) *snapshotCall {
+	if element.call != nil {
+		return element.call
+	}
+	call := &snapshotCall{done: make(chan struct{})}
+	element.call = call
+	// the request outlives the caller which started it, others may be waiting for it
+	ctx := context.WithValue(context.Background(), "logger", logger)
+	go func() {
+		if element.limit != nil {
+			element.limit <- struct{}{}
+		}
+		call.image, call.err = element.config.FetchSnapshot(ctx)
+		if element.limit != nil {
+			<-element.limit
+		}
+		element.mutex.Lock()
+		if call.err == nil {
+			element.image = call.image
+		}
+		element.call = nil
+		element.mutex.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+//Variant transformed source image, cached until the source image changes
+func (element *SnapshotCache) Variant(source *SnapshotImageST, transform SnapshotTransformST) (*SnapshotImageST, error) {
+	key := transform.Key()
+	element.mutex.Lock()
+	if element.source != source {
+		element.source = source
+		element.variants = make(map[string]*SnapshotImageST)
+	}
+	variant, ok := element.variants[key]
+	element.mutex.Unlock()
+	if ok {
+		return variant, nil
+	}
+	variant, err := transform.Apply(source)
+	if err != nil {
+		return nil, err
+	}
+	element.mutex.Lock()
+	if element.source == source && len(element.variants) < snapshotMaxVariants {
+		element.variants[key] = variant
+	}
+	element.mutex.Unlock()
+	return variant, nil
+}
+
+//Refresh keep the cached image warm until the channel is removed or reconfigured
+func (element *SnapshotCache) Refresh(streamID string, channelID string) {
+	logger := log.WithFields(logrus.Fields{
+		"module":  "snapshot",
+		"stream":  streamID,
+		"channel": channelID,
+		"func":    "SnapshotCacheRefresh",
+	})
+	ticker := time.NewTicker(time.Duration(element.config.RefreshInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		element.mutex.Lock()
+		call := element.start(logger)
+		element.mutex.Unlock()
+		<-call.done
+		if call.err != nil {
+			logger.WithFields(logrus.Fields{
+				"call": "FetchSnapshot",
+			}).Errorln(call.err.Error())
+		}
+		<-ticker.C
+		channel, err := Storage.StreamChannelInfo(streamID, channelID)
+		if err != nil || channel.Snapshot.cache != element {
+			logger.WithFields(logrus.Fields{
+				"call": "StreamChannelInfo",
+			}).Debugln("Stop snapshot refresh")
+			return
+		}
+	}
+}
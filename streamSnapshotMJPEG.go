@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//Default MJPEG snapshot options
+const (
+	snapshotModeJPEG  = "jpeg"
+	snapshotModeMJPEG = "mjpeg"
+	// frames of a persistent connection older than this are not served
+	mjpegStaleTimeout  = 10 * time.Second
+	mjpegRetryDelay    = 3 * time.Second
+	mjpegCheckInterval = time.Second
+	mjpegMaxFrameSize  = 20 * 1024 * 1024
+)
+
+//ErrorMJPEGStalled persistent MJPEG connection has no recent frame
+var ErrorMJPEGStalled = errors.New("mjpeg stream has no recent frame")
+
+//mjpegReader multipart reader of a MJPEG camera response
+func mjpegReader(res *http.Response) (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid mjpeg content type: %w", err)
+	}
+	boundary := params["boundary"]
+	if !strings.HasPrefix(mediaType, "multipart/") || boundary == "" {
+		return nil, fmt.Errorf("camera response is %v, not a multipart mjpeg stream", mediaType)
+	}
+	// some cameras announce the boundary with its leading dashes, --boundary instead of boundary
+	body := bufio.NewReader(res.Body)
+	if strings.HasPrefix(boundary, "--") {
+		head, _ := body.Peek(len(boundary) + 64)
+		if !bytes.Contains(head, []byte("--"+boundary)) {
+			boundary = strings.TrimPrefix(boundary, "--")
+		}
+	}
+	return multipart.NewReader(body, boundary), nil
+}
+
+//mjpegFrame read the next complete JPEG part
+func mjpegFrame(reader *multipart.Reader) (*SnapshotImageST, error) {
+	part, err := reader.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("reading mjpeg part failed: %w", err)
+	}
+	defer part.Close()
+	body, err := io.ReadAll(io.LimitReader(part, mjpegMaxFrameSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading mjpeg part failed: %w", err)
+	}
+	if len(body) > mjpegMaxFrameSize {
+		return nil, fmt.Errorf("mjpeg part is larger than %v bytes", mjpegMaxFrameSize)
+	}
+	contentType := part.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "image/jpeg"
+	}
+	sum := sha256.Sum256(body)
+	return &SnapshotImageST{
+		Body:        body,
+		ContentType: contentType,
+		ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		Modified:    time.Now(),
+		fetched:     time.Now(),
+	}, nil
+}
+
+//SnapshotMJPEG persistent MJPEG connection keeping the latest frame of a channel
+type SnapshotMJPEG struct {
+	mutex       sync.Mutex
+	config      SnapshotST
+	image       *SnapshotImageST
+	err         error
+	ready       chan struct{}
+	subscribers map[chan *SnapshotImageST]struct{}
+}
+
+//NewSnapshotMJPEG make persistent MJPEG connection of a channel, started by Run
+func NewSnapshotMJPEG(cfg SnapshotST) *SnapshotMJPEG {
+	cfg.mjpeg = nil
+	cfg.cache = nil
+	return &SnapshotMJPEG{config: cfg, ready: make(chan struct{}), subscribers: make(map[chan *SnapshotImageST]struct{})}
+}
+
+//Subscribe receive the frames of the connection as they arrive, until Unsubscribe
+func (element *SnapshotMJPEG) Subscribe() chan *SnapshotImageST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	frames := make(chan *SnapshotImageST, 1)
+	element.subscribers[frames] = struct{}{}
+	return frames
+}
+
+//Unsubscribe stop receiving frames
+func (element *SnapshotMJPEG) Unsubscribe(frames chan *SnapshotImageST) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	delete(element.subscribers, frames)
+}
+
+//Latest latest frame, waiting for the first one
+func (element *SnapshotMJPEG) Latest(ctx context.Context) (*SnapshotImageST, error) {
+	timer := time.NewTimer(mjpegStaleTimeout)
+	defer timer.Stop()
+	select {
+	case <-element.ready:
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.image == nil || time.Since(element.image.fetched) > mjpegStaleTimeout {
+		if element.err != nil {
+			return nil, element.err
+		}
+		return nil, ErrorMJPEGStalled
+	}
+	return element.image, nil
+}
+
+//Run read frames, reconnecting on errors, until the channel is removed or reconfigured
+func (element *SnapshotMJPEG) Run(streamID string, channelID string) {
+	logger := log.WithFields(logrus.Fields{
+		"module":  "snapshot",
+		"stream":  streamID,
+		"channel": channelID,
+		"func":    "SnapshotMJPEGRun",
+	})
+	for element.active(streamID, channelID) {
+		err := element.read(streamID, channelID, logger)
+		element.mutex.Lock()
+		element.err = err
+		element.mutex.Unlock()
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"call": "read",
+			}).Errorln(err.Error())
+		}
+		time.Sleep(mjpegRetryDelay)
+	}
+	logger.WithFields(logrus.Fields{
+		"call": "StreamChannelInfo",
+	}).Debugln("Stop mjpeg connection")
+}
+
+//read keep the latest frame of one connection
+func (element *SnapshotMJPEG) read(streamID string, channelID string, logger *logrus.Entry) error {
+	ctx := context.WithValue(context.Background(), "logger", logger)
+	res, err := element.config.RequestSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return snapshotStatusError(res.StatusCode)
+	}
+	reader, err := mjpegReader(res)
+	if err != nil {
+		return err
+	}
+	checked := time.Now()
+	for {
+		image, err := mjpegFrame(reader)
+		if err != nil {
+			return err
+		}
+		element.mutex.Lock()
+		if element.image == nil {
+			close(element.ready)
+		}
+		element.image = image
+		element.err = nil
+		for frames := range element.subscribers {
+			// slow subscribers skip frames, they always get the latest one
+			select {
+			case <-frames:
+			default:
+			}
+			frames <- image
+		}
+		element.mutex.Unlock()
+		if time.Since(checked) >= mjpegCheckInterval {
+			if !element.active(streamID, channelID) {
+				return nil
+			}
+			checked = time.Now()
+		}
+	}
+}
+
+//active check the connection still belongs to the channel
+func (element *SnapshotMJPEG) active(streamID string, channelID string) bool {
+	channel, err := Storage.StreamChannelInfo(streamID, channelID)
+	return err == nil && channel.Snapshot.mjpeg == element
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func mjpegResponse(contentType string, body io.Reader) *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	return &http.Response{StatusCode: 200, Header: header, Body: io.NopCloser(body)}
+}
+
+func TestMJPEG_Frames(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		// split the body into one byte reads
+		oneByte bool
+		frames  []string
+	}{
+		{
+			name:        "content length",
+			contentType: "multipart/x-mixed-replace; boundary=frame",
+			body: "--frame\r\nContent-Type: image/jpeg\r\nContent-Length: 5\r\n\r\nfirst\r\n" +
+				"--frame\r\nContent-Type: image/jpeg\r\nContent-Length: 6\r\n\r\nsecond\r\n--frame--\r\n",
+			frames: []string{"first", "second"},
+		},
+		{
+			name:        "missing content length",
+			contentType: "multipart/x-mixed-replace; boundary=frame",
+			body:        "--frame\r\nContent-Type: image/jpeg\r\n\r\nfirst\r\n--frame\r\n\r\nsecond\r\n--frame--\r\n",
+			frames:      []string{"first", "second"},
+		},
+		{
+			name:        "quoted boundary",
+			contentType: `multipart/x-mixed-replace; boundary="my frame:1"`,
+			body:        "--my frame:1\r\nContent-Type: image/jpeg\r\n\r\nfirst\r\n--my frame:1\r\n\r\nsecond\r\n--my frame:1--\r\n",
+			frames:      []string{"first", "second"},
+		},
+		{
+			name:        "boundary announced with its dashes",
+			contentType: "multipart/x-mixed-replace; boundary=--myboundary",
+			body:        "--myboundary\r\nContent-Type: image/jpeg\r\n\r\nfirst\r\n--myboundary\r\n\r\nsecond\r\n--myboundary--\r\n",
+			frames:      []string{"first", "second"},
+		},
+		{
+			name:        "parts split across reads",
+			contentType: "multipart/x-mixed-replace; boundary=frame",
+			body:        "--frame\r\nContent-Type: image/jpeg\r\n\r\n\xff\xd8first\r\n--fra\xff\xd9\r\n--frame\r\n\r\nsecond\r\n--frame--\r\n",
+			oneByte:     true,
+			frames:      []string{"\xff\xd8first\r\n--fra\xff\xd9", "second"},
+		},
+	}
+
+	for _, test := range tests {
+		var body io.Reader = strings.NewReader(test.body)
+		if test.oneByte {
+			body = iotest.OneByteReader(body)
+		}
+		reader, err := mjpegReader(mjpegResponse(test.contentType, body))
+		if err != nil {
+			t.Fatalf("%v: mjpegReader() = %v", test.name, err)
+		}
+		for i, want := range test.frames {
+			frame, err := mjpegFrame(reader)
+			if err != nil {
+				t.Fatalf("%v: frame %v = %v", test.name, i, err)
+			}
+			if string(frame.Body) != want || frame.ContentType != "image/jpeg" {
+				t.Errorf("%v: frame %v = %q %v - wanted %q", test.name, i, frame.Body, frame.ContentType, want)
+			}
+		}
+		if frame, err := mjpegFrame(reader); err == nil {
+			t.Errorf("%v: frame after the last one = %q - wanted an error", test.name, frame.Body)
+		}
+	}
+}
+
+func TestMJPEG_Truncated(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"before the closing boundary", "--frame\r\nContent-Type: image/jpeg\r\n\r\nfirst\r\n--frame\r\n\r\nsecond\r\n"},
+		{"in a part", "--frame\r\nContent-Type: image/jpeg\r\n\r\nfirst\r\n--frame\r\n\r\nsec"},
+		{"in the part headers", "--frame\r\nContent-Type: image/jpeg\r\n\r\nfirst\r\n--frame\r\nContent-Ty"},
+		{"in the boundary", "--frame\r\nContent-Type: image/jpeg\r\n\r\nfirst\r\n--frame\r\n\r\nsecond\r\n--fr"},
+	}
+
+	for _, test := range tests {
+		reader, err := mjpegReader(mjpegResponse("multipart/x-mixed-replace; boundary=frame", strings.NewReader(test.body)))
+		if err != nil {
+			t.Fatalf("%v: mjpegReader() = %v", test.name, err)
+		}
+		frame, err := mjpegFrame(reader)
+		if err != nil || string(frame.Body) != "first" {
+			t.Fatalf("%v: first frame = %v, %v", test.name, frame, err)
+		}
+		// a partial JPEG must never be served
+		if frame, err := mjpegFrame(reader); err == nil {
+			t.Errorf("%v: truncated frame = %q - wanted an error", test.name, frame.Body)
+		}
+	}
+}
+
+func TestMJPEG_NotMultipart(t *testing.T) {
+	for _, contentType := range []string{"image/jpeg", "multipart/x-mixed-replace", "text/html; charset=utf-8"} {
+		if _, err := mjpegReader(mjpegResponse(contentType, strings.NewReader(""))); err == nil {
+			t.Errorf("mjpegReader(%q) = nil - wanted an error", contentType)
+		}
+	}
+}
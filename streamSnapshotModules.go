@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//Hikvision nonce expiration module
+const (
+	snapshotModuleHikvisionNonceExpirationSpoof = "hikvision_spoof_nonce_expiration"
+	oneYear                                     = time.Hour * 24 * 365 * 10
+)
+
+var isAllDigitsRe = regexp.MustCompile("^[0-9]+$")
+
+//SnapshotModule vendor quirks hooked into the camera snapshot requests
+type SnapshotModule interface {
+	//BeforeRequest alter the request to the camera, before any authentication
+	BeforeRequest(ctx context.Context, req *http.Request) error
+	//AfterResponse check the camera response before its body is read, an error fails the snapshot
+	AfterResponse(ctx context.Context, res *http.Response) error
+	//BeforePersistState alter a digest auth state before it is kept for reuse
+	BeforePersistState(ctx context.Context, state *DigestAuthState)
+}
+
+//SnapshotModuleFactory make a module from the snapshot configuration and its module_config block
+type SnapshotModuleFactory func(cfg *SnapshotST, options map[string]interface{}) (SnapshotModule, error)
+
+//snapshotModuleRegistry registered snapshot modules by name
+var snapshotModuleRegistry = make(map[string]SnapshotModuleFactory)
+
+//RegisterSnapshotModule register a module selectable by name in the snapshot modules list
+func RegisterSnapshotModule(name string, factory SnapshotModuleFactory) {
+	if _, ok := snapshotModuleRegistry[name]; ok {
+		panic("snapshot module registered twice: " + name)
+	}
+	snapshotModuleRegistry[name] = factory
+}
+
+//SnapshotModuleNames registered module names, sorted
+func SnapshotModuleNames() []string {
+	names := make([]string, 0, len(snapshotModuleRegistry))
+	for name := range snapshotModuleRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//decodeSnapshotModuleOptions decode a module_config block into the options struct of a module
+func decodeSnapshotModuleOptions(options map[string]interface{}, out interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	// a typo in a module option is reported rather than silently ignored
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+//cloneSnapshotModuleConfig copy of the module_config blocks, nil when empty
+func cloneSnapshotModuleConfig(config map[string]map[string]interface{}) map[string]map[string]interface{} {
+	if len(config) == 0 {
+		return nil
+	}
+	out := make(map[string]map[string]interface{}, len(config))
+	for name, options := range config {
+		out[name] = make(map[string]interface{}, len(options))
+		for key, val := range options {
+			out[name][key] = val
+		}
+	}
+	return out
+}
+
+//SnapshotModuleBase no-op hooks, embedded by modules implementing only some of them
+type SnapshotModuleBase struct{}
+
+//BeforeRequest no-op
+func (SnapshotModuleBase) BeforeRequest(context.Context, *http.Request) error { return nil }
+
+//AfterResponse no-op
+func (SnapshotModuleBase) AfterResponse(context.Context, *http.Response) error { return nil }
+
+//BeforePersistState no-op
+func (SnapshotModuleBase) BeforePersistState(context.Context, *DigestAuthState) {}
+
+//snapshotModuleHikvision spoof the expiration of Hikvision nonces, see README 'Snapshot modules'
+type snapshotModuleHikvision struct {
+	SnapshotModuleBase
+}
+
+func init() {
+	RegisterSnapshotModule(snapshotModuleHikvisionNonceExpirationSpoof, func(cfg *SnapshotST, options map[string]interface{}) (SnapshotModule, error) {
+		return &snapshotModuleHikvision{}, decodeSnapshotModuleOptions(options, &struct{}{})
+	})
+}
+
+//BeforePersistState set the timestamp of `<hash>:<unix_ts>` nonces one year ahead
+func (module *snapshotModuleHikvision) BeforePersistState(c context.Context, state *DigestAuthState) {
+	// Hikvision nonces are in the form of `<hash>:<unix_ts>`. The timestamp is not embedded
+	// into the hash whatsoever, so we can just spoof its expiration :-)
+	// assume already generated states are already patched
+	if !state.IsFresh() {
+		return
+	}
+	// note: potential for races here between the get and set, but it's not really that
+	// relevant as all nonces keep being valid, we just alter the timestamp.
+	nonce, expiration, found := strings.Cut(state.Get("nonce"), ":")
+	if !found || !isAllDigitsRe.MatchString(expiration) {
+		if logger, ok := c.Value("logger").(*logrus.Entry); ok {
+			logger.Warnf(
+				"Module '%v' is registered for snapshot config, but incompatible nonce was found",
+				snapshotModuleHikvisionNonceExpirationSpoof,
+			)
+		}
+		return
+	}
+	expiration = strconv.FormatInt(time.Now().Add(oneYear).UnixMilli(), 10)
+	state.Set("nonce", fmt.Sprintf("%v:%v", nonce, expiration))
+}
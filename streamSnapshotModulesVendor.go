@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Vendor snapshot modules
+const (
+	snapshotModuleNameDahua   = "dahua"
+	snapshotModuleNameAxis    = "axis"
+	snapshotModuleNameReolink = "reolink"
+	// error pages of cameras are short, longer bodies are not read
+	snapshotModuleMaxErrorBody = 4096
+)
+
+func init() {
+	RegisterSnapshotModule(snapshotModuleNameDahua, newSnapshotModuleDahua)
+	RegisterSnapshotModule(snapshotModuleNameAxis, newSnapshotModuleAxis)
+	RegisterSnapshotModule(snapshotModuleNameReolink, newSnapshotModuleReolink)
+}
+
+//snapshotErrorBody body of a successful response which is not an image, nil for images and MJPEG streams
+func snapshotErrorBody(res *http.Response) ([]byte, bool) {
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, false
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "multipart/") {
+		return nil, false
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, snapshotModuleMaxErrorBody))
+	return body, true
+}
+
+//setSnapshotQuery set the query parameters of the request which are not empty
+func setSnapshotQuery(req *http.Request, params map[string]string) {
+	query := req.URL.Query()
+	for key, val := range params {
+		if val != "" {
+			query.Set(key, val)
+		}
+	}
+	req.URL.RawQuery = query.Encode()
+}
+
+//snapshotModuleDahua Dahua and OEM cameras, /cgi-bin/snapshot.cgi
+type snapshotModuleDahua struct {
+	SnapshotModuleBase
+	// video channel, starting at 1
+	Channel int `json:"channel"`
+}
+
+func newSnapshotModuleDahua(cfg *SnapshotST, options map[string]interface{}) (SnapshotModule, error) {
+	module := &snapshotModuleDahua{}
+	if err := decodeSnapshotModuleOptions(options, module); err != nil {
+		return nil, err
+	}
+	if module.Channel < 0 {
+		return nil, errors.New("channel must be positive")
+	}
+	return module, nil
+}
+
+//BeforeRequest select the channel
+func (module *snapshotModuleDahua) BeforeRequest(ctx context.Context, req *http.Request) error {
+	if module.Channel > 0 {
+		setSnapshotQuery(req, map[string]string{"channel": strconv.Itoa(module.Channel)})
+	}
+	return nil
+}
+
+//AfterResponse Dahua answers errors such as an unknown channel with a 200 text body, e.g. "Error\r\nBad Request!"
+func (module *snapshotModuleDahua) AfterResponse(ctx context.Context, res *http.Response) error {
+	if body, ok := snapshotErrorBody(res); ok {
+		return fmt.Errorf("dahua camera error: %s", strings.Join(strings.Fields(string(body)), " "))
+	}
+	return nil
+}
+
+//snapshotModuleAxis Axis VAPIX cameras, /axis-cgi/jpg/image.cgi
+type snapshotModuleAxis struct {
+	SnapshotModuleBase
+	// e.g. 1920x1080, the camera default when empty
+	Resolution string `json:"resolution"`
+	// 0 to 100, higher is smaller
+	Compression *int `json:"compression"`
+	// video source of multi sensor cameras, starting at 1, "quad" for all of them
+	Camera string `json:"camera"`
+}
+
+func newSnapshotModuleAxis(cfg *SnapshotST, options map[string]interface{}) (SnapshotModule, error) {
+	module := &snapshotModuleAxis{}
+	if err := decodeSnapshotModuleOptions(options, module); err != nil {
+		return nil, err
+	}
+	if module.Compression != nil && (*module.Compression < 0 || *module.Compression > 100) {
+		return nil, errors.New("compression must be between 0 and 100")
+	}
+	return module, nil
+}
+
+//BeforeRequest set the image parameters
+func (module *snapshotModuleAxis) BeforeRequest(ctx context.Context, req *http.Request) error {
+	params := map[string]string{"resolution": module.Resolution, "camera": module.Camera}
+	if module.Compression != nil {
+		params["compression"] = strconv.Itoa(*module.Compression)
+	}
+	setSnapshotQuery(req, params)
+	return nil
+}
+
+//AfterResponse VAPIX reports invalid parameters as a text body
+func (module *snapshotModuleAxis) AfterResponse(ctx context.Context, res *http.Response) error {
+	if body, ok := snapshotErrorBody(res); ok {
+		return fmt.Errorf("axis camera error: %s", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+//snapshotModuleReolink Reolink cameras and NVRs, /cgi-bin/api.cgi?cmd=Snap
+type snapshotModuleReolink struct {
+	SnapshotModuleBase
+	// video channel, starting at 0
+	Channel int `json:"channel"`
+}
+
+func newSnapshotModuleReolink(cfg *SnapshotST, options map[string]interface{}) (SnapshotModule, error) {
+	module := &snapshotModuleReolink{}
+	if err := decodeSnapshotModuleOptions(options, module); err != nil {
+		return nil, err
+	}
+	if cfg.DigestAuth.Enabled {
+		return nil, errors.New("reolink cameras take the credentials in the query, disable digest_auth")
+	}
+	return module, nil
+}
+
+//BeforeRequest the Snap command takes the credentials in the query and a random rs parameter defeating caches
+func (module *snapshotModuleReolink) BeforeRequest(ctx context.Context, req *http.Request) error {
+	params := map[string]string{
+		"cmd":     "Snap",
+		"channel": strconv.Itoa(module.Channel),
+		"rs":      strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+	if req.URL.User != nil {
+		params["user"] = req.URL.User.Username()
+		params["password"], _ = req.URL.User.Password()
+		// the http client would send them again as Basic auth
+		req.URL.User = nil
+	}
+	setSnapshotQuery(req, params)
+	return nil
+}
+
+//AfterResponse Reolink answers errors with a 200 JSON body, e.g. [{"cmd":"Snap","code":1,"error":{"detail":"login failed","rspCode":-6}}]
+func (module *snapshotModuleReolink) AfterResponse(ctx context.Context, res *http.Response) error {
+	body, ok := snapshotErrorBody(res)
+	if !ok {
+		return nil
+	}
+	var replies []struct {
+		Error struct {
+			Detail  string `json:"detail"`
+			RspCode int    `json:"rspCode"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &replies); err != nil || len(replies) == 0 {
+		return fmt.Errorf("reolink camera error: %s", strings.TrimSpace(string(body)))
+	}
+	return fmt.Errorf("reolink camera error: %v (%v)", replies[0].Error.Detail, replies[0].Error.RspCode)
+}
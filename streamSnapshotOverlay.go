@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+//Default overlay options
+const (
+	snapshotOverlayDefaultFontSize   = 16
+	snapshotOverlayDefaultTimeFormat = "2006-01-02 15:04:05 MST"
+	snapshotOverlayDefaultColor      = "#ffffff"
+	snapshotOverlayDefaultBackground = "#00000099"
+)
+
+var snapshotOverlayFont *opentype.Font
+var snapshotOverlayFontOnce sync.Once
+var snapshotOverlayFontErr error
+
+//SnapshotOverlay label and timestamp rendered onto channel snapshots
+type SnapshotOverlay struct {
+	text       string
+	timeFormat string
+	position   string
+	size       float64
+	color      color.Color
+	background color.Color
+}
+
+//NewSnapshotOverlay check overlay settings, the label defaults to the channel name
+func NewSnapshotOverlay(cfg SnapshotOverlayST, name string) (*SnapshotOverlay, error) {
+	snapshotOverlayFontOnce.Do(func() {
+		snapshotOverlayFont, snapshotOverlayFontErr = opentype.Parse(gobold.TTF)
+	})
+	if snapshotOverlayFontErr != nil {
+		return nil, snapshotOverlayFontErr
+	}
+	overlay := &SnapshotOverlay{
+		text:       cfg.Text,
+		timeFormat: cfg.TimeFormat,
+		position:   cfg.Position,
+		size:       cfg.FontSize,
+	}
+	if overlay.text == "" {
+		overlay.text = name
+	}
+	if overlay.timeFormat == "" {
+		overlay.timeFormat = snapshotOverlayDefaultTimeFormat
+	}
+	switch overlay.position {
+	case "":
+		overlay.position = "top-left"
+	case "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return nil, fmt.Errorf("invalid overlay position %q", overlay.position)
+	}
+	if overlay.size <= 0 {
+		overlay.size = snapshotOverlayDefaultFontSize
+	}
+	var err error
+	if cfg.Color == "" {
+		cfg.Color = snapshotOverlayDefaultColor
+	}
+	if overlay.color, err = parseOverlayColor(cfg.Color); err != nil {
+		return nil, err
+	}
+	switch cfg.Background {
+	case "none":
+	case "":
+		overlay.background, _ = parseOverlayColor(snapshotOverlayDefaultBackground)
+	default:
+		if overlay.background, err = parseOverlayColor(cfg.Background); err != nil {
+			return nil, err
+		}
+	}
+	return overlay, nil
+}
+
+//Draw render the label and the time of the snapshot onto img
+func (overlay *SnapshotOverlay) Draw(img draw.Image, at time.Time) error {
+	var lines []string
+	if overlay.text != "" {
+		lines = append(lines, overlay.text)
+	}
+	lines = append(lines, at.Format(overlay.timeFormat))
+	return overlay.DrawLines(img, lines)
+}
+
+//DrawLines render text lines in a box at the overlay position of img
+func (overlay *SnapshotOverlay) DrawLines(img draw.Image, lines []string) error {
+	// faces keep glyph buffers, a face is not shared between requests
+	face, err := opentype.NewFace(snapshotOverlayFont, &opentype.FaceOptions{Size: overlay.size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	padding := int(overlay.size / 3)
+	var width int
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > width {
+			width = w
+		}
+	}
+	box := image.Rect(0, 0, width+2*padding, len(lines)*lineHeight+2*padding)
+	bounds := img.Bounds()
+	x, y := bounds.Min.X+padding, bounds.Min.Y+padding
+	if strings.HasSuffix(overlay.position, "right") {
+		x = bounds.Max.X - padding - box.Dx()
+	}
+	if strings.HasPrefix(overlay.position, "bottom") {
+		y = bounds.Max.Y - padding - box.Dy()
+	}
+	box = box.Add(image.Pt(x, y))
+
+	if overlay.background != nil {
+		draw.Draw(img, box, image.NewUniform(overlay.background), image.Point{}, draw.Over)
+	}
+	drawer := font.Drawer{Dst: img, Src: image.NewUniform(overlay.color), Face: face}
+	for i, line := range lines {
+		drawer.Dot = fixed.P(box.Min.X+padding, box.Min.Y+padding+i*lineHeight+metrics.Ascent.Ceil())
+		drawer.DrawString(line)
+	}
+	return nil
+}
+
+//parseOverlayColor parse #rrggbb or #rrggbbaa colour
+func parseOverlayColor(val string) (color.Color, error) {
+	raw, err := hex.DecodeString(strings.TrimPrefix(val, "#"))
+	if err != nil || !strings.HasPrefix(val, "#") || (len(raw) != 3 && len(raw) != 4) {
+		return nil, fmt.Errorf("invalid overlay colour %q, expected #rrggbb or #rrggbbaa", val)
+	}
+	c := color.NRGBA{R: raw[0], G: raw[1], B: raw[2], A: 255}
+	if len(raw) == 4 {
+		c.A = raw[3]
+	}
+	return c, nil
+}
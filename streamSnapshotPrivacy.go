@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+//Default privacy mask options
+const (
+	snapshotMaskDefaultColor     = "#000000"
+	snapshotMaskDefaultPixelSize = 16
+)
+
+//snapshotMask prepared privacy mask polygon
+type snapshotMask struct {
+	points    []image.Point
+	bounds    image.Rectangle
+	pixelate  bool
+	color     color.Color
+	pixelSize int
+}
+
+//SnapshotPrivacy privacy masks painted onto channel snapshots
+type SnapshotPrivacy struct {
+	masks []snapshotMask
+}
+
+//NewSnapshotPrivacy check privacy masks, nil when there is none
+func NewSnapshotPrivacy(masks []SnapshotMaskST) (*SnapshotPrivacy, error) {
+	if len(masks) == 0 {
+		return nil, nil
+	}
+	privacy := &SnapshotPrivacy{}
+	for i, cfg := range masks {
+		mask := snapshotMask{pixelSize: cfg.PixelSize}
+		switch {
+		case len(cfg.Rect) > 0 && len(cfg.Polygon) > 0:
+			return nil, fmt.Errorf("mask %v: set either rect or polygon", i)
+		case len(cfg.Rect) > 0:
+			if len(cfg.Rect) != 4 || cfg.Rect[2] <= 0 || cfg.Rect[3] <= 0 {
+				return nil, fmt.Errorf("mask %v: rect must be [x, y, width, height]", i)
+			}
+			x, y, w, h := cfg.Rect[0], cfg.Rect[1], cfg.Rect[2], cfg.Rect[3]
+			mask.points = []image.Point{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}}
+		case len(cfg.Polygon) >= 3:
+			for _, point := range cfg.Polygon {
+				if len(point) != 2 {
+					return nil, fmt.Errorf("mask %v: polygon points must be [x, y]", i)
+				}
+				mask.points = append(mask.points, image.Pt(point[0], point[1]))
+			}
+		default:
+			return nil, fmt.Errorf("mask %v: rect or polygon of at least 3 points required", i)
+		}
+		// one pixel rectangles, Union ignores empty ones
+		for _, point := range mask.points {
+			mask.bounds = mask.bounds.Union(image.Rectangle{Min: point, Max: point.Add(image.Pt(1, 1))})
+		}
+		switch cfg.Mode {
+		case "", "solid":
+		case "pixelate":
+			mask.pixelate = true
+		default:
+			return nil, fmt.Errorf("mask %v: mode must be solid or pixelate", i)
+		}
+		if mask.pixelSize <= 0 {
+			mask.pixelSize = snapshotMaskDefaultPixelSize
+		}
+		if cfg.Color == "" {
+			cfg.Color = snapshotMaskDefaultColor
+		}
+		fill, err := parseOverlayColor(cfg.Color)
+		if err != nil {
+			return nil, fmt.Errorf("mask %v: %w", i, err)
+		}
+		// a translucent mask would leak what it hides
+		opaque := fill.(color.NRGBA)
+		opaque.A = 255
+		mask.color = opaque
+		privacy.masks = append(privacy.masks, mask)
+	}
+	return privacy, nil
+}
+
+//Draw paint masks onto img, mask coordinates are camera image pixels
+func (privacy *SnapshotPrivacy) Draw(img draw.Image) {
+	origin := img.Bounds().Min
+	for _, mask := range privacy.masks {
+		area := mask.bounds.Add(origin).Intersect(img.Bounds())
+		if area.Empty() {
+			continue
+		}
+		step := 1
+		if mask.pixelate {
+			step = mask.pixelSize
+		}
+		for y := area.Min.Y; y < area.Max.Y; y += step {
+			for x := area.Min.X; x < area.Max.X; x += step {
+				block := image.Rect(x, y, x+step, y+step).Intersect(area)
+				fill := mask.color
+				if mask.pixelate {
+					fill = averageColor(img, block)
+				}
+				for by := block.Min.Y; by < block.Max.Y; by++ {
+					for bx := block.Min.X; bx < block.Max.X; bx++ {
+						if mask.contains(image.Pt(bx, by).Sub(origin)) {
+							img.Set(bx, by, fill)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+//Contains check the pixel is inside one of the masks
+func (privacy *SnapshotPrivacy) Contains(p image.Point) bool {
+	for _, mask := range privacy.masks {
+		if mask.contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+//contains check the center of the pixel is inside the polygon, even-odd rule
+func (mask snapshotMask) contains(p image.Point) bool {
+	px, py := float64(p.X)+0.5, float64(p.Y)+0.5
+	inside := false
+	for i, j := 0, len(mask.points)-1; i < len(mask.points); j, i = i, i+1 {
+		a, b := mask.points[i], mask.points[j]
+		ay, by := float64(a.Y), float64(b.Y)
+		if (ay > py) != (by > py) {
+			x := float64(a.X) + (py-ay)*float64(b.X-a.X)/(by-ay)
+			if px < x {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+//averageColor mean colour of the block
+func averageColor(img image.Image, block image.Rectangle) color.Color {
+	var r, g, b, n uint64
+	for y := block.Min.Y; y < block.Max.Y; y++ {
+		for x := block.Min.X; x < block.Max.X; x++ {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			r, g, b, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), n+1
+		}
+	}
+	if n == 0 {
+		return color.Black
+	}
+	return color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: 0xffff}
+}
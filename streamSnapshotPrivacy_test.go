@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSnapshotPrivacy_Contains(t *testing.T) {
+	tests := []struct {
+		name    string
+		mask    SnapshotMaskST
+		inside  []image.Point
+		outside []image.Point
+	}{
+		{
+			name: "rect",
+			mask: SnapshotMaskST{Rect: []int{10, 20, 30, 40}},
+			// the rect covers x 10 to 39 and y 20 to 59
+			inside:  []image.Point{{10, 20}, {39, 20}, {10, 59}, {39, 59}, {25, 40}},
+			outside: []image.Point{{9, 20}, {40, 20}, {10, 19}, {10, 60}, {0, 0}},
+		},
+		{
+			name: "triangle",
+			mask: SnapshotMaskST{Polygon: [][]int{{0, 0}, {100, 0}, {0, 100}}},
+			// pixel centers on the hypotenuse x+y=100 are outside
+			inside:  []image.Point{{0, 0}, {98, 0}, {0, 98}, {49, 49}},
+			outside: []image.Point{{99, 0}, {0, 99}, {50, 50}, {99, 99}},
+		},
+		{
+			name:    "concave U",
+			mask:    SnapshotMaskST{Polygon: [][]int{{0, 0}, {30, 0}, {30, 30}, {20, 30}, {20, 10}, {10, 10}, {10, 30}, {0, 30}}},
+			inside:  []image.Point{{5, 5}, {5, 25}, {25, 25}, {15, 5}},
+			outside: []image.Point{{15, 15}, {15, 29}, {10, 10}, {31, 5}},
+		},
+		{
+			name:    "self intersecting star, even-odd leaves the center out",
+			mask:    SnapshotMaskST{Polygon: [][]int{{50, 0}, {79, 90}, {2, 35}, {97, 35}, {20, 90}}},
+			inside:  []image.Point{{50, 10}, {10, 37}, {88, 37}},
+			outside: []image.Point{{50, 50}, {50, 95}, {0, 0}},
+		},
+		{
+			name:    "bow tie",
+			mask:    SnapshotMaskST{Polygon: [][]int{{0, 0}, {40, 40}, {40, 0}, {0, 40}}},
+			inside:  []image.Point{{5, 20}, {34, 20}},
+			outside: []image.Point{{20, 5}, {20, 34}},
+		},
+	}
+
+	for _, test := range tests {
+		privacy, err := NewSnapshotPrivacy([]SnapshotMaskST{test.mask})
+		if err != nil {
+			t.Fatalf("%v: NewSnapshotPrivacy() = %v", test.name, err)
+		}
+		for _, p := range test.inside {
+			if !privacy.Contains(p) {
+				t.Errorf("%v: Contains(%v) = false - wanted inside", test.name, p)
+			}
+		}
+		for _, p := range test.outside {
+			if privacy.Contains(p) {
+				t.Errorf("%v: Contains(%v) = true - wanted outside", test.name, p)
+			}
+		}
+	}
+}
+
+func gradientImage(bounds image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 3), G: uint8(y * 5), B: uint8(x ^ y), A: 255})
+		}
+	}
+	return img
+}
+
+func TestSnapshotPrivacy_Draw(t *testing.T) {
+	concave := [][]int{{8, 8}, {56, 8}, {56, 56}, {40, 56}, {40, 24}, {24, 24}, {24, 56}, {8, 56}}
+	tests := []struct {
+		name string
+		mask SnapshotMaskST
+		// offset of the image bounds, mask coordinates are relative to them
+		origin image.Point
+	}{
+		{"solid rect", SnapshotMaskST{Rect: []int{5, 7, 20, 30}, Color: "#ff0000"}, image.Point{}},
+		{"solid concave", SnapshotMaskST{Polygon: concave, Color: "#00ff00"}, image.Point{}},
+		{"pixelate rect", SnapshotMaskST{Rect: []int{5, 7, 20, 30}, Mode: "pixelate", PixelSize: 4}, image.Point{}},
+		{"pixelate concave", SnapshotMaskST{Polygon: concave, Mode: "pixelate", PixelSize: 8}, image.Pt(3, 2)},
+		{"rect past the image", SnapshotMaskST{Rect: []int{50, 50, 100, 100}, Mode: "pixelate"}, image.Point{}},
+	}
+
+	for _, test := range tests {
+		privacy, err := NewSnapshotPrivacy([]SnapshotMaskST{test.mask})
+		if err != nil {
+			t.Fatalf("%v: NewSnapshotPrivacy() = %v", test.name, err)
+		}
+		bounds := image.Rect(0, 0, 64, 64).Add(test.origin)
+		original := gradientImage(bounds)
+		img := gradientImage(bounds)
+		privacy.Draw(img)
+
+		mask := privacy.masks[0]
+		changed, inside := 0, 0
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				got, was := img.RGBAAt(x, y), original.RGBAAt(x, y)
+				if !privacy.Contains(image.Pt(x, y).Sub(test.origin)) {
+					if got != was {
+						t.Fatalf("%v: pixel (%v, %v) outside the mask = %v - wanted %v", test.name, x, y, got, was)
+					}
+					continue
+				}
+				inside++
+				if got != was {
+					changed++
+				}
+				if !mask.pixelate {
+					if r, g, b, _ := mask.color.RGBA(); got != (color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}) {
+						t.Fatalf("%v: pixel (%v, %v) = %v - wanted the mask colour", test.name, x, y, got)
+					}
+					continue
+				}
+				// pixelated pixels share the colour of their block
+				area := mask.bounds.Add(bounds.Min).Intersect(bounds)
+				block := image.Rect(0, 0, mask.pixelSize, mask.pixelSize).Add(image.Pt(
+					area.Min.X+(x-area.Min.X)/mask.pixelSize*mask.pixelSize,
+					area.Min.Y+(y-area.Min.Y)/mask.pixelSize*mask.pixelSize,
+				)).Intersect(area)
+				for ny := block.Min.Y; ny < block.Max.Y; ny++ {
+					for nx := block.Min.X; nx < block.Max.X; nx++ {
+						if privacy.Contains(image.Pt(nx, ny).Sub(test.origin)) && img.RGBAAt(nx, ny) != got {
+							t.Fatalf("%v: pixel (%v, %v) = %v - wanted the colour %v of its block", test.name, nx, ny, img.RGBAAt(nx, ny), got)
+						}
+					}
+				}
+			}
+		}
+		if inside == 0 || changed < inside/2 {
+			t.Errorf("%v: %v of %v pixels inside the mask changed", test.name, changed, inside)
+		}
+	}
+}
+
+func TestSnapshotPrivacy_Unmasked(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	camera := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		jpeg.Encode(&buf, gradientImage(image.Rect(0, 0, 32, 32)), nil)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(buf.Bytes())
+	}))
+	defer camera.Close()
+
+	privacy, err := NewSnapshotPrivacy([]SnapshotMaskST{{Rect: []int{0, 0, 16, 16}}})
+	if err != nil {
+		t.Fatalf("NewSnapshotPrivacy() = %v", err)
+	}
+	channel := func(adminUnmasked bool) ChannelST {
+		return ChannelST{Snapshot: SnapshotST{
+			URL:           camera.URL,
+			AdminUnmasked: adminUnmasked,
+			client:        camera.Client(),
+			privacy:       privacy,
+		}}
+	}
+	saved := Storage
+	t.Cleanup(func() {
+		Storage = saved
+	})
+	Storage = &StorageST{
+		Server: ServerST{HTTPLogin: "admin", HTTPPassword: "secret"},
+		Streams: map[string]StreamST{"cam": {Channels: map[string]ChannelST{
+			"0": channel(true),
+			"1": channel(false),
+		}}},
+	}
+
+	router := gin.New()
+	router.GET("/stream/:uuid/channel/:channel/snapshot", HTTPAPIServerProduceSnapshot)
+
+	tests := []struct {
+		channel  string
+		query    string
+		user     string
+		password string
+		status   int
+	}{
+		{"0", "", "", "", 200},
+		{"0", "?unmasked=true", "", "", 403},
+		{"0", "?unmasked=true", "admin", "wrong", 403},
+		{"0", "?unmasked=true", "viewer", "secret", 403},
+		{"0", "?unmasked=true", "admin", "secret", 200},
+		{"1", "?unmasked=true", "admin", "secret", 403},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/stream/cam/channel/"+test.channel+"/snapshot"+test.query, nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("channel %v%v as %q = %v - wanted %v", test.channel, test.query, test.user, rec.Code, test.status)
+		}
+	}
+}
+
+func TestSnapshotPrivacy_MasksEditRequiresLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	saved := Storage
+	t.Cleanup(func() {
+		Storage = saved
+	})
+
+	router := gin.New()
+	router.PUT("/masks", HTTPAPIServerRequireLogin, func(c *gin.Context) {
+		c.Status(204)
+	})
+
+	tests := []struct {
+		login    string
+		password string
+		status   int
+	}{
+		{"", "", 403},
+		{"admin", "", 403},
+		{"admin", "secret", 204},
+	}
+	for _, test := range tests {
+		Storage = &StorageST{Server: ServerST{HTTPLogin: test.login, HTTPPassword: test.password}}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("PUT", "/masks", nil))
+		if rec.Code != test.status {
+			t.Errorf("PUT with login %q and password %q = %v - wanted %v", test.login, test.password, rec.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+//Snapshot transform limits
+const (
+	snapshotMaxDimension    = 4096
+	snapshotMaxSourcePixels = 50 * 1000 * 1000
+	snapshotMaxVariants     = 32
+	snapshotDefaultQuality  = 85
+)
+
+//snapshotTransformError invalid transform request
+type snapshotTransformError string
+
+func (e snapshotTransformError) Error() string {
+	return string(e)
+}
+
+//SnapshotTransformST resize, crop and encoding options of a snapshot request
+type SnapshotTransformST struct {
+	Width   int
+	Height  int
+	Fit     string
+	Crop    image.Rectangle
+	Quality int
+	Format  string
+	overlay *SnapshotOverlay
+	privacy *SnapshotPrivacy
+}
+
+//ParseSnapshotTransform read transform query parameters, false when none is set
+func ParseSnapshotTransform(query url.Values) (SnapshotTransformST, bool, error) {
+	transform := SnapshotTransformST{Fit: "contain", Quality: snapshotDefaultQuality, Format: "jpeg"}
+	var set bool
+	for _, name := range []string{"width", "height", "quality"} {
+		val := query.Get(name)
+		if val == "" {
+			continue
+		}
+		set = true
+		number, err := strconv.Atoi(val)
+		if err != nil || number <= 0 {
+			return transform, false, snapshotTransformError("invalid " + name)
+		}
+		switch name {
+		case "width":
+			transform.Width = number
+		case "height":
+			transform.Height = number
+		case "quality":
+			transform.Quality = number
+		}
+	}
+	if transform.Width > snapshotMaxDimension || transform.Height > snapshotMaxDimension {
+		return transform, false, snapshotTransformError(fmt.Sprintf("width and height are limited to %v", snapshotMaxDimension))
+	}
+	if transform.Quality > 100 {
+		return transform, false, snapshotTransformError("invalid quality")
+	}
+	if val := query.Get("fit"); val != "" {
+		set = true
+		switch val {
+		case "contain", "cover", "fill":
+			transform.Fit = val
+		default:
+			return transform, false, snapshotTransformError("invalid fit, expected contain, cover or fill")
+		}
+	}
+	if val := query.Get("crop"); val != "" {
+		set = true
+		var values [4]int
+		parts := strings.Split(val, ",")
+		if len(parts) != 4 {
+			return transform, false, snapshotTransformError("invalid crop, expected x,y,width,height")
+		}
+		for i, part := range parts {
+			number, err := strconv.Atoi(part)
+			if err != nil || number < 0 {
+				return transform, false, snapshotTransformError("invalid crop, expected x,y,width,height")
+			}
+			values[i] = number
+		}
+		transform.Crop = image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3])
+		if transform.Crop.Empty() {
+			return transform, false, snapshotTransformError("invalid crop, empty rectangle")
+		}
+	}
+	if val := query.Get("format"); val != "" {
+		set = true
+		switch val {
+		case "jpeg", "jpg":
+			transform.Format = "jpeg"
+		case "png":
+			transform.Format = "png"
+		default:
+			return transform, false, snapshotTransformError("invalid format, expected jpeg or png")
+		}
+	}
+	return transform, set, nil
+}
+
+//Key cache key of the transform
+func (transform SnapshotTransformST) Key() string {
+	// edited masks get a new privacy pointer
+	return fmt.Sprintf("%vx%v/%v/%v/%v/%v/%p", transform.Width, transform.Height, transform.Fit, transform.Crop, transform.Quality, transform.Format, transform.privacy)
+}
+
+//Apply decode the snapshot, crop, resize and encode it
+func (transform SnapshotTransformST) Apply(source *SnapshotImageST) (*SnapshotImageST, error) {
+	dst, err := transform.Image(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	contentType := "image/jpeg"
+	if transform.Format == "png" {
+		contentType = "image/png"
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: transform.Quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return &SnapshotImageST{
+		Body:        buf.Bytes(),
+		ContentType: contentType,
+		ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		Modified:    source.Modified,
+		fetched:     source.fetched,
+	}, nil
+}
+
+//Image decode the snapshot, crop and resize it, without encoding
+func (transform SnapshotTransformST) Image(source *SnapshotImageST) (*image.RGBA, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(source.Body))
+	if err != nil {
+		return nil, fmt.Errorf("decoding camera snapshot failed: %w", err)
+	}
+	// check the size announced by the header before allocating the pixels
+	if config.Width*config.Height > snapshotMaxSourcePixels {
+		return nil, fmt.Errorf("camera snapshot of %vx%v is too large", config.Width, config.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(source.Body))
+	if err != nil {
+		return nil, fmt.Errorf("decoding camera snapshot failed: %w", err)
+	}
+
+	// masks are painted on the camera image, before it is cropped or resized
+	if transform.privacy != nil {
+		canvas := image.NewRGBA(src.Bounds())
+		draw.Copy(canvas, canvas.Bounds().Min, src, src.Bounds(), draw.Src, nil)
+		transform.privacy.Draw(canvas)
+		src = canvas
+	}
+
+	area := src.Bounds()
+	if !transform.Crop.Empty() {
+		area = transform.Crop.Add(area.Min).Intersect(area)
+		if area.Empty() {
+			return nil, snapshotTransformError("crop is outside of the image")
+		}
+	}
+	width, height := transform.size(area)
+	if transform.Fit == "cover" && transform.Width > 0 && transform.Height > 0 {
+		area = coverArea(area, width, height)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if area.Dx() == width && area.Dy() == height {
+		draw.Copy(dst, image.Point{}, src, area, draw.Src, nil)
+	} else {
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, area, draw.Src, nil)
+	}
+	// drawn at the output size, so that the text stays readable on thumbnails
+	if transform.overlay != nil {
+		if err = transform.overlay.Draw(dst, source.fetched); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+//size output size for the source area
+func (transform SnapshotTransformST) size(area image.Rectangle) (int, int) {
+	sw, sh := area.Dx(), area.Dy()
+	width, height := transform.Width, transform.Height
+	switch {
+	case width == 0 && height == 0:
+		width, height = sw, sh
+	case height == 0:
+		height = sh * width / sw
+	case width == 0:
+		width = sw * height / sh
+	case transform.Fit == "contain":
+		// the largest size of the source aspect ratio within width x height
+		if sw*height > sh*width {
+			height = sh * width / sw
+		} else {
+			width = sw * height / sh
+		}
+	}
+	if width > snapshotMaxDimension {
+		width = snapshotMaxDimension
+	}
+	if height > snapshotMaxDimension {
+		height = snapshotMaxDimension
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+//coverArea centered part of area with the aspect ratio of width x height
+func coverArea(area image.Rectangle, width int, height int) image.Rectangle {
+	sw, sh := area.Dx(), area.Dy()
+	if sw*height > sh*width {
+		cropped := sh * width / height
+		x := area.Min.X + (sw-cropped)/2
+		return image.Rect(x, area.Min.Y, x+cropped, area.Max.Y)
+	}
+	cropped := sw * height / width
+	y := area.Min.Y + (sh-cropped)/2
+	return image.Rect(area.Min.X, y, area.Max.X, y+cropped)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+//Default timeshift options
+const (
+	// retry delay when the viewer caught up with the buffered packets
+	timeshiftPollDelay = 40 * time.Millisecond
+	// output gap when a packet has no duration
+	timeshiftDefaultGap = 40 * time.Millisecond
+	// tracks are interleaved, only a larger step back is an ingest restart
+	timeshiftMaxJitter = time.Second
+)
+
+//timeshiftControl rewind or return to live request of a viewer
+type timeshiftControl struct {
+	rewind time.Duration
+	result chan error
+}
+
+//TimeshiftStatusST live viewer timeshift status
+type TimeshiftStatusST struct {
+	ID       string     `json:"id"`
+	Mode     string     `json:"mode"`
+	Position *time.Time `json:"position,omitempty"`
+	Delay    float64    `json:"delay"`
+}
+
+//StreamTimeshift rewind state of a live WebRTC viewer, fed from the channel DVR buffer
+type StreamTimeshift struct {
+	mutex    sync.Mutex
+	id       string
+	dvr      *StreamDVR
+	live     bool
+	position time.Time
+	control  chan timeshiftControl
+	done     chan struct{}
+	timer    *time.Timer
+	// buffered packets waiting to be sent and the sequence number following them
+	queue []*av.Packet
+	walls []time.Time
+	next  int64
+	// output time is packet time + shift, buffered packets are sent at clock + output time - base
+	waitKey bool
+	anchor  bool
+	shift   time.Duration
+	last    time.Duration
+	end     time.Duration
+	clock   time.Time
+	base    time.Duration
+}
+
+//NewStreamTimeshift make viewer timeshift state, dvr is nil when the channel has no buffer
+func NewStreamTimeshift(id string, dvr *StreamDVR) *StreamTimeshift {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &StreamTimeshift{
+		id:      id,
+		dvr:     dvr,
+		live:    true,
+		anchor:  true,
+		control: make(chan timeshiftControl),
+		done:    make(chan struct{}),
+		timer:   timer,
+	}
+}
+
+//Status viewer timeshift status
+func (element *StreamTimeshift) Status() TimeshiftStatusST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	status := TimeshiftStatusST{ID: element.id, Mode: "live"}
+	if !element.live {
+		position := element.position
+		status.Mode = "timeshift"
+		status.Position = &position
+		status.Delay = time.Since(position).Seconds()
+	}
+	return status
+}
+
+//Control rewind the viewer, or return it to live when rewind is 0
+func (element *StreamTimeshift) Control(rewind time.Duration) error {
+	if element.dvr == nil {
+		return ErrorDVRDisabled
+	}
+	request := timeshiftControl{rewind: rewind, result: make(chan error, 1)}
+	select {
+	case element.control <- request:
+		return <-request.result
+	case <-element.done:
+		return ErrorClientNotFound
+	}
+}
+
+//Requests control requests to be applied by the viewer loop
+func (element *StreamTimeshift) Requests() <-chan timeshiftControl {
+	return element.control
+}
+
+//Apply rewind from the current position or return to live
+func (element *StreamTimeshift) Apply(request timeshiftControl) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if request.rewind <= 0 {
+		if !element.live {
+			// live packets are rebased from the next keyframe
+			element.live = true
+			element.waitKey = true
+			element.anchor = true
+			element.queue = nil
+			element.walls = nil
+			element.timer.Stop()
+		}
+		request.result <- nil
+		return
+	}
+	position := time.Now()
+	if !element.live {
+		position = element.position
+	}
+	seq, err := element.dvr.Seek(position.Add(-request.rewind))
+	if err != nil {
+		request.result <- err
+		return
+	}
+	element.live = false
+	element.position = position.Add(-request.rewind)
+	element.anchor = true
+	element.queue = nil
+	element.walls = nil
+	element.next = seq
+	element.schedule()
+	request.result <- nil
+}
+
+//LivePacket rebase live packet, false while the viewer is rewound or waits for a live keyframe
+func (element *StreamTimeshift) LivePacket(pkt *av.Packet) (av.Packet, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if !element.live || (element.waitKey && !pkt.IsKeyFrame) {
+		return av.Packet{}, false
+	}
+	element.waitKey = false
+	return element.rebase(*pkt), true
+}
+
+//Timer fires when the next buffered packet is due
+func (element *StreamTimeshift) Timer() <-chan time.Time {
+	return element.timer.C
+}
+
+//BufferedPacket rebased buffered packet which is due, false if none
+func (element *StreamTimeshift) BufferedPacket() (av.Packet, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.live || len(element.queue) == 0 {
+		element.schedule()
+		return av.Packet{}, false
+	}
+	pkt := element.rebase(*element.queue[0])
+	element.position = element.walls[0]
+	element.queue = element.queue[1:]
+	element.walls = element.walls[1:]
+	element.schedule()
+	return pkt, true
+}
+
+//Close stop accepting control requests
+func (element *StreamTimeshift) Close() {
+	element.timer.Stop()
+	close(element.done)
+}
+
+//rebase shift packet time to continue the output timeline
+func (element *StreamTimeshift) rebase(pkt av.Packet) av.Packet {
+	if element.anchor || pkt.Time+element.shift < element.last-timeshiftMaxJitter {
+		// new source or restarted ingest, the packet follows the last one sent
+		element.anchor = false
+		element.shift = element.end - pkt.Time
+		element.clock = time.Now()
+		element.base = element.end
+	}
+	pkt.Time += element.shift
+	element.last = pkt.Time
+	if end := pkt.Time + pkt.Duration; pkt.Duration > 0 && end > element.end {
+		element.end = end
+	} else if pkt.Duration <= 0 && pkt.Time+timeshiftDefaultGap > element.end {
+		element.end = pkt.Time + timeshiftDefaultGap
+	}
+	return pkt
+}
+
+//schedule fill the queue from the buffer and arm the timer for its first packet
+func (element *StreamTimeshift) schedule() {
+	if element.live {
+		return
+	}
+	if len(element.queue) == 0 {
+		element.queue, element.walls, element.next = element.dvr.ReadFrom(element.next)
+	}
+	delay := timeshiftPollDelay
+	if len(element.queue) > 0 && !element.anchor {
+		delay = time.Until(element.clock.Add(element.queue[0].Time + element.shift - element.base))
+	} else if len(element.queue) > 0 {
+		delay = 0
+	}
+	playbackTimerReset(element.timer, delay)
+}